@@ -12,8 +12,9 @@ import "github.com/zhangdapeng520/zdpgo_smtp/smtp"
 
 // Backend 后台实现
 type Backend struct {
+	UserStore UserStore
 }
 
 func (bkd *Backend) NewSession(c smtp.ConnectionState) (smtp.Session, error) {
-	return &Session{}, nil
+	return &Session{userStore: bkd.UserStore}, nil
 }
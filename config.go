@@ -9,14 +9,87 @@ package zdpgo_smtp
 */
 
 type Config struct {
-	Debug       bool            `yaml:"debug" json:"debug"`
-	LogFilePath string          `yaml:"log_file_path" json:"log_file_path"`
-	Domain      string          `yaml:"domain" json:"domain"`
-	Host        string          `yaml:"host" json:"host"`
-	Port        int             `yaml:"port" json:"port"`
-	Auths       map[string]Auth `yaml:"auths" json:"auths"`
-	Cache       CacheConfig     `yaml:"cache" json:"cache"`
-	Client      ClientConfig    `yaml:"client" json:"client"`
+	Debug       bool              `yaml:"debug" json:"debug"`
+	LogFilePath string            `yaml:"log_file_path" json:"log_file_path"`
+	Domain      string            `yaml:"domain" json:"domain"`
+	Host        string            `yaml:"host" json:"host"` // 没有配置 Listeners 时使用的地址
+	Port        int               `yaml:"port" json:"port"`
+	Listeners   []ListenerConfig  `yaml:"listeners" json:"listeners"`
+	Auths       map[string]Auth   `yaml:"auths" json:"auths"`
+	Cache       CacheConfig       `yaml:"cache" json:"cache"`
+	Client      ClientConfig      `yaml:"client" json:"client"`
+	TLS         TLSConfig         `yaml:"tls" json:"tls"`
+	ACME        ACMEConfig        `yaml:"acme" json:"acme"`
+	Users       UsersConfig       `yaml:"users" json:"users"`
+	AuthLimit   AuthLimitConfig   `yaml:"auth_limit" json:"auth_limit"`
+	Submission  bool              `yaml:"submission" json:"submission"`     // 提交模式，认证之后才能发送邮件
+	CheckSender bool              `yaml:"check_sender" json:"check_sender"` // 发件地址必须与认证的用户名相同
+	SMTPUTF8    bool              `yaml:"smtputf8" json:"smtputf8"`         // 支持国际化邮件地址（RFC 6531）
+	VRFY        bool              `yaml:"vrfy" json:"vrfy"`                 // 认证用户可以使用 VRFY 检查用户是否存在
+	Language    string            `yaml:"language" json:"language"`         // 响应文本的语言，en（默认）或者 zh
+	Replies     map[string]string `yaml:"replies" json:"replies"`           // 替换部分响应文本，键为响应编号，例如 greeting
+}
+
+// AuthLimitConfig 认证失败限制配置，数值为0时使用默认值
+type AuthLimitConfig struct {
+	Disabled       bool `yaml:"disabled" json:"disabled"`
+	MaxFailures    int  `yaml:"max_failures" json:"max_failures"`       // 锁定前允许的失败次数
+	LockoutSeconds int  `yaml:"lockout_seconds" json:"lockout_seconds"` // 锁定时长
+}
+
+// 监听模式
+const (
+	ListenerSMTP       = "smtp"       // 端口25，STARTTLS可选
+	ListenerSubmission = "submission" // 端口587，需要STARTTLS和认证
+	ListenerSMTPS      = "smtps"      // 端口465，隐式TLS，需要认证
+)
+
+// ListenerConfig 监听地址配置，每个监听地址有自己的策略
+type ListenerConfig struct {
+	Host string `yaml:"host" json:"host"`
+	Port int    `yaml:"port" json:"port"` // 为0时根据模式使用 25、587 或者 465
+	Mode string `yaml:"mode" json:"mode"` // smtp（默认）、submission 或者 smtps
+	// STARTTLS 之前拒绝 MAIL、RCPT 和 AUTH，submission 模式总是开启
+	RequireTLS bool `yaml:"require_tls" json:"require_tls"`
+	// 不要求 STARTTLS 的客户端网络，CIDR 或者IP
+	TLSExemptNetworks []string `yaml:"tls_exempt_networks" json:"tls_exempt_networks"`
+}
+
+// UsersConfig 用户目录配置
+type UsersConfig struct {
+	Type       string `yaml:"type" json:"type"`                 // memory（默认，使用 Auths）、file、htpasswd 或者 ldap
+	Path       string `yaml:"path" json:"path"`                 // file 和 htpasswd 的文件路径
+	LDAPAddr   string `yaml:"ldap_addr" json:"ldap_addr"`       // 例如 ldap.example.com:389 或者 ldaps://ldap.example.com:636
+	LDAPBindDN string `yaml:"ldap_bind_dn" json:"ldap_bind_dn"` // 例如 uid=%s,ou=people,dc=example,dc=com
+	// 不是 ldaps 地址时默认使用 StartTLS，设置为 true 时允许明文连接，只应当用于本机或者测试环境
+	LDAPInsecure bool `yaml:"ldap_insecure" json:"ldap_insecure"`
+}
+
+// ACMEConfig 自动申请证书配置，Domains 为空时不开启
+type ACMEConfig struct {
+	Domains      []string `yaml:"domains" json:"domains"`             // 申请证书的域名
+	Email        string   `yaml:"email" json:"email"`                 // 账号联系邮箱
+	DirectoryURL string   `yaml:"directory_url" json:"directory_url"` // ACME目录地址，默认 Let's Encrypt
+	CertDir      string   `yaml:"cert_dir" json:"cert_dir"`           // 证书保存目录，默认使用 TLS.CertDir
+	Challenge    string   `yaml:"challenge" json:"challenge"`         // http-01（默认）或者 dns-01
+	HTTPAddr     string   `yaml:"http_addr" json:"http_addr"`         // http-01 验证服务的监听地址，默认 ":80"
+	CACertFile   string   `yaml:"ca_cert_file" json:"ca_cert_file"`   // 信任的ACME服务根证书，测试 Pebble 时使用
+}
+
+// TLSConfig 证书配置，CertDir 和 Certs 都为空时不开启TLS
+type TLSConfig struct {
+	CertDir        string       `yaml:"cert_dir" json:"cert_dir"`               // 证书目录，每个域名一个子目录
+	Certs          []CertConfig `yaml:"certs" json:"certs"`                     // 单独指定的证书
+	DefaultHost    string       `yaml:"default_host" json:"default_host"`       // SNI不匹配时使用的证书
+	ReloadInterval int          `yaml:"reload_interval" json:"reload_interval"` // 检查证书变化的间隔，单位秒
+	MinVersion     string       `yaml:"min_version" json:"min_version"`         // 最低TLS版本，例如 1.2
+	CipherSuites   []string     `yaml:"cipher_suites" json:"cipher_suites"`     // 允许的加密套件名称，为空时使用默认值
+}
+
+type CertConfig struct {
+	Hostname string `yaml:"hostname" json:"hostname"`
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
 }
 
 type ClientConfig struct {
@@ -35,7 +108,7 @@ type CacheConfig struct {
 
 type Auth struct {
 	Username string `yaml:"username" json:"username"`
-	Password string `yaml:"password" json:"password"`
+	Password string `yaml:"password" json:"password"` // bcrypt、argon2 哈希，或者 {plain} 开头的明文
 }
 
 type ServerInfo struct {
@@ -5,6 +5,11 @@ go 1.18
 require (
 	github.com/zhangdapeng520/zdpgo_cache_http v0.1.1
 	github.com/zhangdapeng520/zdpgo_email v1.1.6
+	github.com/zhangdapeng520/zdpgo_requests v0.5.7
+	github.com/zhangdapeng520/zdpgo_yaml v0.1.0
+	golang.org/x/crypto v0.9.0
+	golang.org/x/net v0.10.0
+	golang.org/x/text v0.9.0
 )
 
 require (
@@ -12,6 +17,5 @@ require (
 	github.com/zhangdapeng520/zdpgo_json v0.1.2 // indirect
 	github.com/zhangdapeng520/zdpgo_password v1.2.9 // indirect
 	github.com/zhangdapeng520/zdpgo_random v1.2.0 // indirect
-	github.com/zhangdapeng520/zdpgo_requests v0.5.7 // indirect
-	github.com/zhangdapeng520/zdpgo_yaml v0.1.0 // indirect
+	golang.org/x/sys v0.8.0 // indirect
 )
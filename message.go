@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"mime"
+	"net/mail"
 	"regexp"
 	"strings"
 	"time"
@@ -25,6 +26,9 @@ type Message struct {
 	Time        int               `json:"time"`
 	Author      string            `json:"author"`      // zdpgo_email发过来的唯一标识
 	Attachments map[string]string `json:"attachments"` // 文件名：文件内容的base64字符串
+	RequireTLS  bool              `json:"require_tls"` // MAIL命令是否带有REQUIRETLS参数，转发时必须使用TLS
+	AuthUser    string            `json:"auth_user"`   // 提交邮件的认证用户，未认证时为空
+	SMTPUTF8    bool              `json:"smtputf8"`    // MAIL命令是否带有SMTPUTF8参数，地址和头部可能包含UTF-8字符
 }
 
 // ParseString 解析字符串
@@ -37,17 +41,12 @@ func (m *Message) ParseString(data string) error {
 
 	// 处理请求头
 	m.Time = int(time.Now().Unix())
-	headerArr := strings.Split(dataArr[0], "\r\n")
+	headerArr := m.UnfoldHeader(dataArr[0])
 	for _, v := range headerArr {
 		if strings.HasPrefix(v, "To:") {
 			// 处理消息收件人
-			to := strings.Replace(v, "To: ", "", 1)
-			toArr := strings.Split(to, ",")
-			var toResult []string
-			for _, toTemp := range toArr {
-				toResult = append(toResult, strings.TrimSpace(toTemp))
-			}
-			m.To = toResult
+			to := strings.TrimSpace(strings.TrimPrefix(v, "To:"))
+			m.To = m.ParseAddressList(to)
 		} else if strings.HasPrefix(v, "X-ZdpgoEmail-Auther") {
 			// 处理作者
 			author := strings.Replace(v, "X-ZdpgoEmail-Auther: ", "", 1)
@@ -108,10 +107,42 @@ func (m *Message) ParseString(data string) error {
 	return nil
 }
 
-// ParseTitle 解析邮件标题
+// UnfoldHeader 拆分邮件头部，折行的字段合并为一行
+func (m *Message) UnfoldHeader(header string) []string {
+	var lines []string
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// ParseAddressList 解析收件人列表，支持 RFC 2047 编码和 UTF-8 的名称，只返回地址部分
+func (m *Message) ParseAddressList(value string) []string {
+	parser := mail.AddressParser{WordDecoder: new(mime.WordDecoder)}
+	if addrs, err := parser.ParseList(value); err == nil {
+		result := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			result = append(result, addr.Address)
+		}
+		return result
+	}
+
+	// 不符合 RFC 5322 的列表按逗号拆分
+	var result []string
+	for _, addr := range strings.Split(value, ",") {
+		result = append(result, strings.TrimSpace(addr))
+	}
+	return result
+}
+
+// ParseTitle 解析邮件标题，支持多个 RFC 2047 编码字和未编码的 UTF-8 标题
 func (m *Message) ParseTitle(title string) (string, error) {
 	dec := new(mime.WordDecoder)
-	result, err := dec.Decode(title)
+	result, err := dec.DecodeHeader(title)
 	if err != nil {
 		return "", err
 	}
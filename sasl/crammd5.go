@@ -0,0 +1,242 @@
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"time"
+)
+
+// The CRAM-MD5 mechanism name.
+const CramMD5 = "CRAM-MD5"
+
+type cramMD5Client struct {
+	Username string
+	Secret   string
+}
+
+func (a *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	return CramMD5, nil, nil
+}
+
+func (a *cramMD5Client) Next(challenge []byte) (response []byte, err error) {
+	d := hmac.New(md5.New, []byte(a.Secret))
+	d.Write(challenge)
+	s := make([]byte, 0, d.Size())
+	return []byte(fmt.Sprintf("%s %x", a.Username, d.Sum(s))), nil
+}
+
+// A client implementation of the CRAM-MD5 authentication mechanism, as
+// described in RFC 2195.
+//
+// CRAM-MD5 is obsolete and should only be used with legacy servers.
+func NewCramMD5Client(username, secret string) Client {
+	return &cramMD5Client{username, secret}
+}
+
+// CramMD5Secret is the secret of a user. Either the plaintext password or the
+// precomputed HMAC-MD5 state returned by CramMD5Precompute must be set, so
+// that servers don't need to store plaintext passwords.
+type CramMD5Secret struct {
+	Password    string
+	Precomputed string
+}
+
+// Looks up the secret of a user. Errors are reported to the client as an
+// invalid response, so that it can't tell whether the user exists.
+type CramMD5Lookup func(username string) (*CramMD5Secret, error)
+
+// Authenticates a user whose CRAM-MD5 response has been verified.
+type CramMD5Authenticator func(username string) error
+
+var errCramMD5Invalid = errors.New("sasl: CRAM-MD5 invalid response")
+
+// cramMD5Dummy is used to compute a response for unknown users.
+var cramMD5Dummy = CramMD5Precompute("")
+
+// CramMD5Precompute returns the precomputed secret for password: the
+// hex-encoded MD5 chaining values after the inner (ipad) and outer (opad)
+// blocks of HMAC-MD5 keyed with password, each as four little-endian 32-bit
+// words. The password can't be recovered from them, but they are enough to
+// verify CRAM-MD5 responses.
+func CramMD5Precompute(password string) string {
+	key := []byte(password)
+	if len(key) > md5.BlockSize {
+		sum := md5.Sum(key)
+		key = sum[:]
+	}
+	ipad := make([]byte, md5.BlockSize)
+	opad := make([]byte, md5.BlockSize)
+	copy(ipad, key)
+	copy(opad, key)
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
+	}
+
+	out := make([]byte, 32)
+	for i, pad := range [][]byte{ipad, opad} {
+		state := md5Init
+		md5Block(&state, pad)
+		for j, v := range state {
+			binary.LittleEndian.PutUint32(out[16*i+4*j:], v)
+		}
+	}
+	return hex.EncodeToString(out)
+}
+
+// response computes the expected hex-encoded response for a challenge.
+func (s *CramMD5Secret) response(challenge []byte) (string, error) {
+	if s.Precomputed == "" {
+		d := hmac.New(md5.New, []byte(s.Password))
+		d.Write(challenge)
+		return hex.EncodeToString(d.Sum(nil)), nil
+	}
+
+	states, err := hex.DecodeString(s.Precomputed)
+	if err != nil || len(states) != 32 {
+		return "", errors.New("sasl: malformed CRAM-MD5 precomputed secret")
+	}
+	var inner, outer [4]uint32
+	for i := range inner {
+		inner[i] = binary.LittleEndian.Uint32(states[4*i:])
+		outer[i] = binary.LittleEndian.Uint32(states[16+4*i:])
+	}
+	sum := md5Resume(inner, challenge)
+	sum = md5Resume(outer, sum[:])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+var md5Init = [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+
+// md5Resume finishes an MD5 digest whose first block has already been
+// processed into state, returning the digest of that block followed by data.
+func md5Resume(state [4]uint32, data []byte) [md5.Size]byte {
+	n := uint64(md5.BlockSize + len(data))
+	msg := append([]byte{}, data...)
+	msg = append(msg, 0x80)
+	for len(msg)%md5.BlockSize != 56 {
+		msg = append(msg, 0)
+	}
+	msg = append(msg, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], n*8)
+	for ; len(msg) > 0; msg = msg[md5.BlockSize:] {
+		md5Block(&state, msg[:md5.BlockSize])
+	}
+
+	var sum [md5.Size]byte
+	for i, v := range state {
+		binary.LittleEndian.PutUint32(sum[4*i:], v)
+	}
+	return sum
+}
+
+var md5Shifts = [64]uint32{
+	7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22,
+	5, 9, 14, 20, 5, 9, 14, 20, 5, 9, 14, 20, 5, 9, 14, 20,
+	4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23,
+	6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21,
+}
+
+var md5Table = [64]uint32{
+	0xd76aa478, 0xe8c7b756, 0x242070db, 0xc1bdceee, 0xf57c0faf, 0x4787c62a, 0xa8304613, 0xfd469501,
+	0x698098d8, 0x8b44f7af, 0xffff5bb1, 0x895cd7be, 0x6b901122, 0xfd987193, 0xa679438e, 0x49b40821,
+	0xf61e2562, 0xc040b340, 0x265e5a51, 0xe9b6c7aa, 0xd62f105d, 0x02441453, 0xd8a1e681, 0xe7d3fbc8,
+	0x21e1cde6, 0xc33707d6, 0xf4d50d87, 0x455a14ed, 0xa9e3e905, 0xfcefa3f8, 0x676f02d9, 0x8d2a4c8a,
+	0xfffa3942, 0x8771f681, 0x6d9d6122, 0xfde5380c, 0xa4beea44, 0x4bdecfa9, 0xf6bb4b60, 0xbebfbc70,
+	0x289b7ec6, 0xeaa127fa, 0xd4ef3085, 0x04881d05, 0xd9d4d039, 0xe6db99e5, 0x1fa27cf8, 0xc4ac5665,
+	0xf4292244, 0x432aff97, 0xab9423a7, 0xfc93a039, 0x655b59c3, 0x8f0ccc92, 0xffeff47d, 0x85845dd1,
+	0x6fa87e4f, 0xfe2ce6e0, 0xa3014314, 0x4e0811a1, 0xf7537e82, 0xbd3af235, 0x2ad7d2bb, 0xeb86d391,
+}
+
+// md5Block is the MD5 compression function of RFC 1321. It is implemented
+// here because crypto/md5 doesn't expose its intermediate state.
+func md5Block(state *[4]uint32, block []byte) {
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+	a, b, c, d := state[0], state[1], state[2], state[3]
+	for i := 0; i < 64; i++ {
+		var f uint32
+		var g int
+		switch i / 16 {
+		case 0:
+			f, g = (b&c)|(^b&d), i
+		case 1:
+			f, g = (d&b)|(^d&c), (5*i+1)%16
+		case 2:
+			f, g = b^c^d, (3*i+5)%16
+		default:
+			f, g = c^(b|^d), (7*i)%16
+		}
+		f += a + md5Table[i] + m[g]
+		a, d, c = d, c, b
+		b += bits.RotateLeft32(f, int(md5Shifts[i]))
+	}
+	state[0] += a
+	state[1] += b
+	state[2] += c
+	state[3] += d
+}
+
+type cramMD5Server struct {
+	domain       string
+	challenge    []byte
+	lookup       CramMD5Lookup
+	authenticate CramMD5Authenticator
+}
+
+// A server implementation of the CRAM-MD5 authentication mechanism, as
+// described in RFC 2195. The challenge is built from a random number, the
+// current time and domain.
+//
+// CRAM-MD5 is obsolete and should only be enabled for legacy clients.
+func NewCramMD5Server(domain string, lookup CramMD5Lookup, authenticator CramMD5Authenticator) Server {
+	return &cramMD5Server{domain: domain, lookup: lookup, authenticate: authenticator}
+}
+
+func (a *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.challenge == nil {
+		// CRAM-MD5 has no initial response.
+		if len(response) != 0 {
+			return nil, true, ErrUnexpectedClientResponse
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+		if err != nil {
+			return nil, true, err
+		}
+		a.challenge = []byte(fmt.Sprintf("<%d.%d@%s>", n, time.Now().Unix(), a.domain))
+		return a.challenge, false, nil
+	}
+
+	i := bytes.LastIndexByte(response, ' ')
+	if i <= 0 {
+		return nil, true, errCramMD5Invalid
+	}
+	username := string(response[:i])
+	digest := string(bytes.ToLower(response[i+1:]))
+
+	// Unknown users fail the same way as a wrong digest, after computing a
+	// response so that timing doesn't reveal whether the user exists.
+	secret, err := a.lookup(username)
+	unknown := err != nil || secret == nil
+	if unknown {
+		secret = &CramMD5Secret{Precomputed: cramMD5Dummy}
+	}
+	expected, err := secret.response(a.challenge)
+	if err != nil {
+		return nil, true, err
+	}
+	if !hmac.Equal([]byte(expected), []byte(digest)) || unknown {
+		return nil, true, errCramMD5Invalid
+	}
+	return nil, true, a.authenticate(username)
+}
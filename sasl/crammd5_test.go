@@ -0,0 +1,65 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCramMD5Precompute(t *testing.T) {
+	passwords := []string{"", "tanstaaftanstaaf", strings.Repeat("k", 64), strings.Repeat("long", 40)}
+	challenges := []string{"", "<1896.697170952@postoffice.reston.mci.net>", strings.Repeat("c", 55), strings.Repeat("c", 56), strings.Repeat("c", 200)}
+	for _, password := range passwords {
+		secret := &CramMD5Secret{Precomputed: CramMD5Precompute(password)}
+		for _, challenge := range challenges {
+			d := hmac.New(md5.New, []byte(password))
+			d.Write([]byte(challenge))
+			want := hex.EncodeToString(d.Sum(nil))
+			got, err := secret.response([]byte(challenge))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("response(%q) with password %q = %s, want %s", challenge, password, got, want)
+			}
+		}
+	}
+}
+
+func TestCramMD5Server(t *testing.T) {
+	lookup := func(username string) (*CramMD5Secret, error) {
+		if username != "tim" {
+			return nil, errors.New("unknown user")
+		}
+		return &CramMD5Secret{Precomputed: CramMD5Precompute("tanstaaftanstaaf")}, nil
+	}
+	auth := func(username, secret string) error {
+		server := NewCramMD5Server("example.com", lookup, func(string) error { return nil })
+		client := NewCramMD5Client(username, secret)
+		challenge, _, err := server.Next(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := client.Next(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = server.Next(response)
+		return err
+	}
+
+	if err := auth("tim", "tanstaaftanstaaf"); err != nil {
+		t.Errorf("valid secret: err = %v", err)
+	}
+	if err := auth("tim", "wrong"); err != errCramMD5Invalid {
+		t.Errorf("wrong secret: err = %v, want %v", err, errCramMD5Invalid)
+	}
+	// Unknown users get the same error as a wrong digest, even for the
+	// secret of the dummy response.
+	if err := auth("nobody", ""); err != errCramMD5Invalid {
+		t.Errorf("unknown user: err = %v, want %v", err, errCramMD5Invalid)
+	}
+}
@@ -24,3 +24,39 @@ func (a *externalClient) Next(challenge []byte) (response []byte, err error) {
 func NewExternalClient(identity string) Client {
 	return &externalClient{identity}
 }
+
+// Authenticates users with the authorization identity requested by the client.
+// The authentication identity itself is established by an external channel
+// (e.g. a TLS client certificate) and must be checked by the authenticator.
+// An empty identity means the client wants to act as the identity associated
+// with its external credentials.
+type ExternalAuthenticator func(identity string) error
+
+type externalServer struct {
+	done         bool
+	authenticate ExternalAuthenticator
+}
+
+func (a *externalServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.done {
+		err = ErrUnexpectedClientResponse
+		return
+	}
+
+	// No initial response, send an empty challenge
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	a.done = true
+
+	err = a.authenticate(string(response))
+	done = true
+	return
+}
+
+// A server implementation of the EXTERNAL authentication mechanism, as
+// described in RFC 4422.
+func NewExternalServer(authenticator ExternalAuthenticator) Server {
+	return &externalServer{authenticate: authenticator}
+}
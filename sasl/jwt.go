@@ -0,0 +1,510 @@
+package sasl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenValidator validates OAuth 2.0 bearer tokens presented with the
+// XOAUTH2 or OAUTHBEARER mechanisms. username is the user name sent by the
+// client, which may be empty for OAUTHBEARER.
+//
+// It returns the user name the token was issued for.
+type TokenValidator interface {
+	ValidateToken(username, token string) (string, error)
+}
+
+// OAuthBearerValidator returns an OAuthBearerAuthenticator checking tokens
+// with v. authenticated is called with the validated user name.
+func OAuthBearerValidator(v TokenValidator, authenticated func(username string) error) OAuthBearerAuthenticator {
+	return func(opts OAuthBearerOptions) *OAuthBearerError {
+		username, err := v.ValidateToken(opts.Username, opts.Token)
+		if err == nil {
+			err = authenticated(username)
+		}
+		if err != nil {
+			return &OAuthBearerError{Status: "invalid_token", Schemes: "bearer", Scope: tokenScope(v)}
+		}
+		return nil
+	}
+}
+
+// XOAuth2Validator returns an XOAuth2Authenticator checking tokens with v.
+// authenticated is called with the validated user name.
+func XOAuth2Validator(v TokenValidator, authenticated func(username string) error) XOAuth2Authenticator {
+	return func(username, token string) *OAuthBearerError {
+		username, err := v.ValidateToken(username, token)
+		if err == nil {
+			err = authenticated(username)
+		}
+		if err != nil {
+			return &OAuthBearerError{Status: "401", Schemes: "Bearer", Scope: tokenScope(v)}
+		}
+		return nil
+	}
+}
+
+func tokenScope(v TokenValidator) string {
+	if jv, ok := v.(*JWTValidator); ok {
+		return strings.Join(jv.Scopes, " ")
+	}
+	return ""
+}
+
+// JWK is a JSON Web Key, as defined in RFC 7517. Only the public key
+// parameters of RSA, EC and OKP keys are supported.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// PublicKey decodes the public key of the JWK.
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := dec.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("sasl: unsupported JWK curve %q", k.Crv)
+		}
+		x, err := dec.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("sasl: JWK point is not on curve")
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("sasl: unsupported JWK curve %q", k.Crv)
+		}
+		x, err := dec.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("sasl: malformed Ed25519 JWK")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("sasl: unsupported JWK key type %q", k.Kty)
+}
+
+// JWKS is a JSON Web Key Set. It can be loaded from a file or fetched from
+// an HTTP endpoint, in which case it is refreshed periodically and when an
+// unknown key ID is seen.
+type JWKS struct {
+	URL     string        // HTTP endpoint, mutually exclusive with File
+	File    string        // local file
+	Refresh time.Duration // refresh interval, defaults to one hour
+	// Minimum interval between refreshes triggered by an unknown key ID,
+	// defaults to one minute. Without it every token with a made-up kid would
+	// cause a request to the endpoint.
+	MinRefresh time.Duration
+	Client     *http.Client
+
+	mutex    sync.Mutex
+	keys     []JWK
+	fetched  time.Time // time of the last fetch attempt, successful or not
+	fetching bool
+}
+
+// NewJWKSFromFile loads a JWKS from a file.
+func NewJWKSFromFile(path string) (*JWKS, error) {
+	ks := &JWKS{File: path}
+	return ks, ks.load()
+}
+
+// NewJWKSFromURL fetches a JWKS from an HTTP endpoint.
+func NewJWKSFromURL(url string) (*JWKS, error) {
+	ks := &JWKS{URL: url}
+	return ks, ks.load()
+}
+
+func (ks *JWKS) load() error {
+	keys, err := ks.fetch()
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	ks.fetched = time.Now()
+	if err != nil {
+		return err
+	}
+	ks.keys = keys
+	return nil
+}
+
+// fetch reads the key set from the file or the endpoint. It doesn't touch
+// ks, so it can run without holding the mutex.
+func (ks *JWKS) fetch() ([]JWK, error) {
+	var r io.ReadCloser
+	if ks.File != "" {
+		f, err := os.Open(ks.File)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	} else {
+		client := ks.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Get(ks.URL)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("sasl: fetching JWKS failed: %s", resp.Status)
+		}
+		r = resp.Body
+	}
+	defer r.Close()
+
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, err
+	}
+	return set.Keys, nil
+}
+
+// Key returns the public key with the given key ID. If kid is empty and the
+// set contains a single key, that key is returned.
+//
+// The set is refetched when it is older than Refresh, or when kid is unknown
+// and the last attempt is older than MinRefresh, since the key may have been
+// rotated. Only one fetch runs at a time and it runs without holding the
+// lock; concurrent callers use the keys they already have.
+func (ks *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	k, err := ks.jwk(kid)
+	if err != nil {
+		return nil, err
+	}
+	return k.PublicKey()
+}
+
+// jwk looks up a key as described in Key.
+func (ks *JWKS) jwk(kid string) (*JWK, error) {
+	refresh := ks.Refresh
+	if refresh == 0 {
+		refresh = time.Hour
+	}
+	minRefresh := ks.MinRefresh
+	if minRefresh == 0 {
+		minRefresh = time.Minute
+	}
+
+	ks.mutex.Lock()
+	k := ks.find(kid)
+	age := time.Since(ks.fetched)
+	start := !ks.fetching && (age > refresh || (k == nil && age > minRefresh))
+	if start {
+		ks.fetching = true
+		ks.fetched = time.Now()
+	}
+	ks.mutex.Unlock()
+
+	var err error
+	if start {
+		var keys []JWK
+		keys, err = ks.fetch()
+		ks.mutex.Lock()
+		ks.fetching = false
+		if err == nil {
+			ks.keys = keys
+		}
+		k = ks.find(kid)
+		ks.mutex.Unlock()
+	}
+
+	if k != nil {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("sasl: unknown JWK %q", kid)
+}
+
+func (ks *JWKS) find(kid string) *JWK {
+	if kid == "" && len(ks.keys) == 1 {
+		return &ks.keys[0]
+	}
+	for i := range ks.keys {
+		if ks.keys[i].Kid == kid && (ks.keys[i].Use == "" || ks.keys[i].Use == "sig") {
+			return &ks.keys[i]
+		}
+	}
+	return nil
+}
+
+var (
+	errJWTMalformed  = errors.New("sasl: malformed JWT")
+	errJWTSignature  = errors.New("sasl: invalid JWT signature")
+	errJWTAlgorithm  = errors.New("sasl: JWT algorithm doesn't match the key")
+	errJWTNoAudience = errors.New("sasl: JWTValidator.Audience is not set")
+	errJWTExpired    = errors.New("sasl: JWT expired")
+	errJWTAudience   = errors.New("sasl: JWT audience mismatch")
+	errJWTIssuer     = errors.New("sasl: JWT issuer mismatch")
+	errJWTScope      = errors.New("sasl: JWT missing required scope")
+	errJWTUsername   = errors.New("sasl: JWT user name mismatch")
+)
+
+// JWTValidator validates JWT access tokens (RFC 7519) signed with a key from
+// a JWKS. The RS256/384/512, PS256/384/512, ES256/384/512 and EdDSA
+// algorithms are supported.
+type JWTValidator struct {
+	Keys *JWKS
+	// Expected "iss" claim, not checked if empty.
+	Issuer string
+	// The "aud" claim must contain one of these values. It is required, since
+	// without it tokens issued for any other service would be accepted.
+	Audience []string
+	// All of these scopes must be present in the "scope" or "scp" claim.
+	Scopes []string
+	// Claim containing the user name, defaults to "sub". If the client sends
+	// a user name, it must match.
+	UsernameClaim string
+	// Allowed clock skew for "exp" and "nbf".
+	Leeway time.Duration
+}
+
+// ValidateToken implements TokenValidator.
+func (v *JWTValidator) ValidateToken(username, token string) (string, error) {
+	if len(v.Audience) == 0 {
+		return "", errJWTNoAudience
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errJWTMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := jwtDecode(parts[0], &header); err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errJWTMalformed
+	}
+	jwk, err := v.Keys.jwk(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	// The key may be restricted to a single algorithm, for instance an RSA
+	// key used for RS256 must not accept PS256 signatures.
+	if jwk.Alg != "" && jwk.Alg != header.Alg {
+		return "", errJWTAlgorithm
+	}
+	key, err := jwk.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	if err := jwtVerify(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", err
+	}
+
+	claims := make(map[string]interface{})
+	if err := jwtDecode(parts[1], &claims); err != nil {
+		return "", err
+	}
+	return v.checkClaims(username, claims)
+}
+
+func (v *JWTValidator) checkClaims(username string, claims map[string]interface{}) (string, error) {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+		return "", errJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", errJWTExpired
+	}
+
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return "", errJWTIssuer
+	}
+	if !jwtContainsAny(jwtStrings(claims["aud"]), v.Audience) {
+		return "", errJWTAudience
+	}
+
+	scopes := jwtStrings(claims["scp"])
+	if s, ok := claims["scope"].(string); ok {
+		scopes = append(scopes, strings.Fields(s)...)
+	}
+	for _, required := range v.Scopes {
+		if !jwtContainsAny(scopes, []string{required}) {
+			return "", errJWTScope
+		}
+	}
+
+	claim := v.UsernameClaim
+	if claim == "" {
+		claim = "sub"
+	}
+	subject, _ := claims[claim].(string)
+	if subject == "" {
+		return "", errJWTUsername
+	}
+	if username != "" && !strings.EqualFold(username, subject) {
+		return "", errJWTUsername
+	}
+	return subject, nil
+}
+
+func jwtDecode(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return errJWTMalformed
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errJWTMalformed
+	}
+	return nil
+}
+
+// jwtStrings converts a claim which is either a string or an array of strings.
+func jwtStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var l []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				l = append(l, s)
+			}
+		}
+		return l
+	}
+	return nil
+}
+
+func jwtContainsAny(l, values []string) bool {
+	for _, a := range l {
+		for _, b := range values {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var jwtCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+func jwtVerify(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if alg != "EdDSA" && len(alg) != 5 {
+		return fmt.Errorf("sasl: unsupported JWT algorithm %q", alg)
+	}
+
+	var h crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	}
+
+	switch {
+	case alg == "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signed, sig) {
+			return errJWTSignature
+		}
+		return nil
+	case h == 0:
+		return fmt.Errorf("sasl: unsupported JWT algorithm %q", alg)
+	}
+
+	d := h.New()
+	d.Write(signed)
+	digest := d.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, h, digest, sig) != nil {
+			return errJWTSignature
+		}
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPSS(pub, h, digest, sig, nil) != nil {
+			return errJWTSignature
+		}
+	case "ES":
+		// The curve is determined by the algorithm and the signature is R
+		// and S as fixed size big-endian integers, see RFC 7518 section 3.4.
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != jwtCurves[alg] {
+			return errJWTAlgorithm
+		}
+		if len(sig) != 2*((pub.Curve.Params().BitSize+7)/8) {
+			return errJWTSignature
+		}
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errJWTSignature
+		}
+	default:
+		return fmt.Errorf("sasl: unsupported JWT algorithm %q", alg)
+	}
+	return nil
+}
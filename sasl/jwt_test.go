@@ -0,0 +1,154 @@
+package sasl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+func rsaJWK(kid, alg string, pub *rsa.PublicKey) JWK {
+	return JWK{Kty: "RSA", Kid: kid, Alg: alg, N: b64.EncodeToString(pub.N.Bytes()), E: b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())}
+}
+
+func ecJWK(kid, crv string, pub *ecdsa.PublicKey) JWK {
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	return JWK{Kty: "EC", Kid: kid, Crv: crv, X: b64.EncodeToString(pub.X.FillBytes(make([]byte, size))), Y: b64.EncodeToString(pub.Y.FillBytes(make([]byte, size)))}
+}
+
+func writeJWKS(t *testing.T, keys ...JWK) *JWKS {
+	data, err := json.Marshal(map[string][]JWK{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ks, err := NewJWKSFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+// signJWT builds a token with the given header and claims. sign receives the
+// signing input and returns the signature.
+func signJWT(t *testing.T, alg, kid string, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	return signed + "." + b64.EncodeToString(sign([]byte(signed)))
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func TestJWTValidator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub := rsaJWK("rsa", "RS256", &rsaKey.PublicKey)
+	ks := writeJWKS(t, rsaPub, ecJWK("p256", "P-256", &p256.PublicKey), ecJWK("p384", "P-384", &p384.PublicKey))
+	v := &JWTValidator{Keys: ks, Audience: []string{"smtp"}}
+
+	claims := func(aud interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+		if aud != nil {
+			c["aud"] = aud
+		}
+		return c
+	}
+	rs256 := func(signed []byte) []byte {
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sha256Sum(signed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	ps256 := func(signed []byte) []byte {
+		sig, err := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, sha256Sum(signed), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	es := func(key *ecdsa.PrivateKey, size int) func(signed []byte) []byte {
+		return func(signed []byte) []byte {
+			r, s, err := ecdsa.Sign(rand.Reader, key, sha256Sum(signed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		}
+	}
+	// HMAC keyed with the public key, the classic algorithm confusion attack.
+	hs256 := func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(rsaPub.N))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+	none := func(signed []byte) []byte { return nil }
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa", claims("smtp"), rs256), nil},
+		{"ES256", signJWT(t, "ES256", "p256", claims([]string{"other", "smtp"}), es(p256, 32)), nil},
+		{"wrong audience", signJWT(t, "RS256", "rsa", claims("other"), rs256), errJWTAudience},
+		{"no audience", signJWT(t, "RS256", "rsa", claims(nil), rs256), errJWTAudience},
+		{"PS256 with RS256 key", signJWT(t, "PS256", "rsa", claims("smtp"), ps256), errJWTAlgorithm},
+		{"HS256 with RSA key", signJWT(t, "HS256", "rsa", claims("smtp"), hs256), errJWTAlgorithm},
+		{"none", signJWT(t, "none", "rsa", claims("smtp"), none), errJWTAlgorithm},
+		{"ES256 with P-384 key", signJWT(t, "ES256", "p384", claims("smtp"), es(p384, 48)), errJWTAlgorithm},
+		{"ES256 with short signature", signJWT(t, "ES256", "p256", claims("smtp"), func(signed []byte) []byte {
+			return es(p256, 32)(signed)[1:]
+		}), errJWTSignature},
+	}
+	for _, tc := range tests {
+		username, err := v.ValidateToken("", tc.token)
+		if err != tc.wantErr {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if err == nil && username != "alice" {
+			t.Errorf("%s: username = %q, want alice", tc.name, username)
+		}
+	}
+
+	// Without Audience every token is rejected.
+	v.Audience = nil
+	if _, err := v.ValidateToken("", tests[0].token); err != errJWTNoAudience {
+		t.Errorf("unset Audience: err = %v, want %v", err, errJWTNoAudience)
+	}
+}
@@ -0,0 +1,546 @@
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/secure/precis"
+)
+
+// The SCRAM mechanism names.
+const (
+	ScramSHA1       = "SCRAM-SHA-1"
+	ScramSHA1Plus   = "SCRAM-SHA-1-PLUS"
+	ScramSHA256     = "SCRAM-SHA-256"
+	ScramSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// Channel binding types.
+const (
+	ChannelBindingTLSUnique   = "tls-unique"
+	ChannelBindingTLSExporter = "tls-exporter"
+)
+
+// Default PBKDF2 iteration count for new SCRAM credentials, as recommended by
+// RFC 7677.
+const ScramDefaultIterations = 4096
+
+// ChannelBinding contains channel binding data used by the -PLUS variants of
+// SCRAM, as described in RFC 5929 and RFC 9266.
+type ChannelBinding struct {
+	Type string
+	Data []byte
+}
+
+// TLSChannelBinding returns the channel binding for a TLS connection:
+// tls-exporter for TLS 1.3 and tls-unique for older versions. It returns nil
+// if no channel binding is available.
+func TLSChannelBinding(state tls.ConnectionState) *ChannelBinding {
+	if !state.HandshakeComplete {
+		return nil
+	}
+	if state.Version >= tls.VersionTLS13 {
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return nil
+		}
+		return &ChannelBinding{Type: ChannelBindingTLSExporter, Data: data}
+	}
+	if len(state.TLSUnique) == 0 {
+		return nil
+	}
+	return &ChannelBinding{Type: ChannelBindingTLSUnique, Data: state.TLSUnique}
+}
+
+var (
+	errScramInvalidProof  = errors.New("sasl: SCRAM invalid proof")
+	errScramInvalidNonce  = errors.New("sasl: SCRAM invalid nonce")
+	errScramChannelBind   = errors.New("sasl: SCRAM channel bindings don't match")
+	errScramServerSig     = errors.New("sasl: SCRAM invalid server signature")
+	errScramMalformed     = errors.New("sasl: SCRAM malformed message")
+	errScramUnknownMech   = errors.New("sasl: unknown SCRAM mechanism")
+	errScramBindingNeeded = errors.New("sasl: SCRAM -PLUS mechanism requires channel binding")
+	errScramInvalidString = errors.New("sasl: SCRAM username or password contains disallowed characters")
+)
+
+// scramHash returns the hash function of a SCRAM mechanism and whether it is
+// a -PLUS variant.
+func scramHash(mech string) (func() hash.Hash, bool, error) {
+	switch mech {
+	case ScramSHA1:
+		return sha1.New, false, nil
+	case ScramSHA1Plus:
+		return sha1.New, true, nil
+	case ScramSHA256:
+		return sha256.New, false, nil
+	case ScramSHA256Plus:
+		return sha256.New, true, nil
+	}
+	return nil, false, errScramUnknownMech
+}
+
+func scramHMAC(h func() hash.Hash, key []byte, msg string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+func scramSum(h func() hash.Hash, b []byte) []byte {
+	d := h()
+	d.Write(b)
+	return d.Sum(nil)
+}
+
+// scramNonce generates a random nonce. It is a variable so that tests can use
+// the nonces of the RFC examples.
+var scramNonce = func() string {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+// scramFakeKey is used to derive credentials for unknown users. It is random
+// for each process, so fake salts can't be told apart from real ones.
+var scramFakeKey = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// scramFakeCredentials returns credentials for a user unknown to the store. As
+// suggested by RFC 5802 section 5.1, the salt is the same for each attempt
+// with the same username, so that the server-first-message doesn't reveal
+// whether the user exists. No proof matches the keys.
+func scramFakeCredentials(h func() hash.Hash, mech, username string) *ScramCredentials {
+	key := scramHMAC(sha256.New, scramFakeKey, mech+"\x00"+username)
+	return &ScramCredentials{
+		Salt:       key[:16],
+		Iterations: ScramDefaultIterations,
+		StoredKey:  scramHMAC(h, key, "Stored Key"),
+		ServerKey:  scramHMAC(h, key, "Server Key"),
+	}
+}
+
+// scramPrep prepares a username or password before it is used, as required by
+// RFC 5802 section 2.2. SASLprep (RFC 4013) has been obsoleted by the PRECIS
+// OpaqueString profile (RFC 8265 section 4.2), which is applied instead: non-ASCII
+// spaces are mapped to ASCII spaces, the string is NFC normalized, and empty
+// strings or strings with control characters are rejected. Printable ASCII
+// strings are returned unchanged.
+func scramPrep(s string) (string, error) {
+	prepped, err := precis.OpaqueString.String(s)
+	if err != nil {
+		return "", errScramInvalidString
+	}
+	return prepped, nil
+}
+
+// scramEscape escapes a username as required by RFC 5802 section 5.1, after
+// scramPrep has been applied.
+func scramEscape(s string) string {
+	s = strings.ReplaceAll(s, "=", "=3D")
+	return strings.ReplaceAll(s, ",", "=2C")
+}
+
+func scramUnescape(s string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			out.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=3D"):
+			out.WriteByte('=')
+		case strings.HasPrefix(s[i:], "=2C"):
+			out.WriteByte(',')
+		default:
+			return "", errScramMalformed
+		}
+		i += 2
+	}
+	return out.String(), nil
+}
+
+// scramAttrs parses a comma-separated list of attribute-value pairs.
+func scramAttrs(msg string) (map[byte]string, error) {
+	attrs := make(map[byte]string)
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) < 2 || field[1] != '=' {
+			return nil, errScramMalformed
+		}
+		attrs[field[0]] = field[2:]
+	}
+	return attrs, nil
+}
+
+// ScramCredentials contains the salted keys stored by a server for a user.
+// The plaintext password is not needed by the server.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredentials derives SCRAM credentials from a password. If salt is
+// nil a random one is generated, if iterations is zero
+// ScramDefaultIterations is used. The password is prepared with scramPrep.
+func NewScramCredentials(mech, password string, salt []byte, iterations int) (*ScramCredentials, error) {
+	h, _, err := scramHash(mech)
+	if err != nil {
+		return nil, err
+	}
+	if password, err = scramPrep(password); err != nil {
+		return nil, err
+	}
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+	if iterations == 0 {
+		iterations = ScramDefaultIterations
+	}
+
+	salted := pbkdf2.Key([]byte(password), salt, iterations, h().Size(), h)
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  scramSum(h, scramHMAC(h, salted, "Client Key")),
+		ServerKey:  scramHMAC(h, salted, "Server Key"),
+	}, nil
+}
+
+// ScramCredentialStore looks up the SCRAM credentials of a user. mech is the
+// mechanism name without the -PLUS suffix, since keys depend on the hash
+// function only. username has been prepared with the PRECIS OpaqueString
+// profile, stores with non-ASCII usernames should normalize their keys the
+// same way. If an error is returned, the exchange continues with fake
+// credentials and fails at the proof step, so clients can't tell whether the
+// user exists.
+type ScramCredentialStore interface {
+	ScramCredentials(mech, username string) (*ScramCredentials, error)
+}
+
+type scramClient struct {
+	mech     string
+	username string
+	password string
+	cb       *ChannelBinding
+
+	h          func() hash.Hash
+	gs2Header  string
+	clientBare string
+	nonce      string
+	serverSig  []byte
+	step       int
+}
+
+// A client implementation of the SCRAM authentication mechanisms, as
+// described in RFC 5802 and RFC 7677. The -PLUS variants require channel
+// binding data, see TLSChannelBinding.
+func NewScramClient(mech, username, password string, cb *ChannelBinding) Client {
+	return &scramClient{
+		mech:     mech,
+		username: username,
+		password: password,
+		cb:       cb,
+	}
+}
+
+func (a *scramClient) Start() (mech string, ir []byte, err error) {
+	h, plus, err := scramHash(a.mech)
+	if err != nil {
+		return "", nil, err
+	}
+	a.h = h
+
+	switch {
+	case plus && a.cb == nil:
+		return "", nil, errScramBindingNeeded
+	case plus:
+		a.gs2Header = "p=" + a.cb.Type + ",,"
+	case a.cb != nil:
+		// We support channel binding but the server didn't advertise -PLUS.
+		a.gs2Header = "y,,"
+	default:
+		a.gs2Header = "n,,"
+	}
+
+	username, err := scramPrep(a.username)
+	if err != nil {
+		return "", nil, err
+	}
+	a.nonce = scramNonce()
+	a.clientBare = "n=" + scramEscape(username) + ",r=" + a.nonce
+	return a.mech, []byte(a.gs2Header + a.clientBare), nil
+}
+
+func (a *scramClient) Next(challenge []byte) (response []byte, err error) {
+	a.step++
+	switch a.step {
+	case 1:
+		return a.clientFinal(string(challenge))
+	case 2:
+		attrs, err := scramAttrs(string(challenge))
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := attrs['e']; ok {
+			return nil, fmt.Errorf("sasl: SCRAM server error: %s", e)
+		}
+		sig, err := base64.StdEncoding.DecodeString(attrs['v'])
+		if err != nil || !hmac.Equal(sig, a.serverSig) {
+			return nil, errScramServerSig
+		}
+		// Empty response so that the server can send the final reply.
+		return []byte{}, nil
+	}
+	return nil, ErrUnexpectedServerChallenge
+}
+
+func (a *scramClient) clientFinal(serverFirst string) ([]byte, error) {
+	attrs, err := scramAttrs(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, errScramInvalidNonce
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil {
+		return nil, errScramMalformed
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations <= 0 {
+		return nil, errScramMalformed
+	}
+
+	cbInput := []byte(a.gs2Header)
+	if strings.HasPrefix(a.gs2Header, "p=") {
+		cbInput = append(cbInput, a.cb.Data...)
+	}
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(cbInput) + ",r=" + nonce
+	authMessage := a.clientBare + "," + serverFirst + "," + withoutProof
+
+	password, err := scramPrep(a.password)
+	if err != nil {
+		return nil, err
+	}
+	salted := pbkdf2.Key([]byte(password), salt, iterations, a.h().Size(), a.h)
+	clientKey := scramHMAC(a.h, salted, "Client Key")
+	clientSig := scramHMAC(a.h, scramSum(a.h, clientKey), authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSig[i]
+	}
+	a.serverSig = scramHMAC(a.h, scramHMAC(a.h, salted, "Server Key"), authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Authenticates a user whose SCRAM proof has been verified. identity is the
+// requested authorization identity, empty if it is the same as the username.
+type ScramAuthenticator func(username, identity string) error
+
+type scramServer struct {
+	mech         string
+	store        ScramCredentialStore
+	cb           *ChannelBinding
+	authenticate ScramAuthenticator
+
+	h           func() hash.Hash
+	plus        bool
+	step        int
+	gs2Header   string
+	clientBare  string
+	serverFirst string
+	nonce       string
+	username    string
+	identity    string
+	creds       *ScramCredentials
+	unknown     bool
+}
+
+// A server implementation of the SCRAM authentication mechanisms, as
+// described in RFC 5802 and RFC 7677. cb is the channel binding of the
+// underlying connection, it is required for the -PLUS variants and may be nil
+// otherwise.
+func NewScramServer(mech string, store ScramCredentialStore, cb *ChannelBinding, authenticator ScramAuthenticator) Server {
+	return &scramServer{
+		mech:         mech,
+		store:        store,
+		cb:           cb,
+		authenticate: authenticator,
+	}
+}
+
+func (a *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.step {
+	case 0:
+		// No initial response, send an empty challenge
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		a.step++
+		challenge, err = a.serverFirstMessage(string(response))
+		return challenge, false, err
+	case 1:
+		a.step++
+		challenge, err = a.serverFinalMessage(string(response))
+		return challenge, false, err
+	case 2:
+		a.step++
+		if len(response) != 0 {
+			return nil, true, ErrUnexpectedClientResponse
+		}
+		return nil, true, nil
+	}
+	return nil, true, ErrUnexpectedClientResponse
+}
+
+func (a *scramServer) serverFirstMessage(clientFirst string) ([]byte, error) {
+	h, plus, err := scramHash(a.mech)
+	if err != nil {
+		return nil, err
+	}
+	a.h = h
+	a.plus = plus
+
+	// gs2-cbind-flag "," [authzid] "," client-first-message-bare
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 {
+		return nil, errScramMalformed
+	}
+	cbFlag := parts[0]
+	switch {
+	case strings.HasPrefix(cbFlag, "p="):
+		if !plus || a.cb == nil || cbFlag[2:] != a.cb.Type {
+			return nil, errScramChannelBind
+		}
+	case cbFlag == "y":
+		// The client supports channel binding and thinks we don't: this is a
+		// downgrade attack if we actually do.
+		if a.cb != nil {
+			return nil, errScramChannelBind
+		}
+		fallthrough
+	case cbFlag == "n":
+		if plus {
+			return nil, errScramChannelBind
+		}
+	default:
+		return nil, errScramMalformed
+	}
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, errScramMalformed
+		}
+		if a.identity, err = scramUnescape(parts[1][2:]); err != nil {
+			return nil, err
+		}
+	}
+	a.gs2Header = parts[0] + "," + parts[1] + ","
+	a.clientBare = parts[2]
+
+	attrs, err := scramAttrs(a.clientBare)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attrs['m']; ok {
+		return nil, errScramMalformed
+	}
+	if a.username, err = scramUnescape(attrs['n']); err != nil {
+		return nil, err
+	}
+	if a.username, err = scramPrep(a.username); err != nil {
+		return nil, err
+	}
+	if attrs['r'] == "" {
+		return nil, errScramInvalidNonce
+	}
+
+	mech := strings.TrimSuffix(a.mech, "-PLUS")
+	// Unknown users get fake credentials and fail at the proof step, like a
+	// wrong password.
+	a.creds, err = a.store.ScramCredentials(mech, a.username)
+	if err != nil || a.creds == nil {
+		a.creds = scramFakeCredentials(h, mech, a.username)
+		a.unknown = true
+	}
+
+	a.nonce = attrs['r'] + scramNonce()
+	a.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", a.nonce,
+		base64.StdEncoding.EncodeToString(a.creds.Salt), a.creds.Iterations)
+	return []byte(a.serverFirst), nil
+}
+
+func (a *scramServer) serverFinalMessage(clientFinal string) ([]byte, error) {
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return nil, errScramMalformed
+	}
+	withoutProof := clientFinal[:i]
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if err != nil {
+		return nil, errScramMalformed
+	}
+
+	attrs, err := scramAttrs(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+	if attrs['r'] != a.nonce {
+		return nil, errScramInvalidNonce
+	}
+	cbInput, err := base64.StdEncoding.DecodeString(attrs['c'])
+	if err != nil {
+		return nil, errScramMalformed
+	}
+	expected := []byte(a.gs2Header)
+	if strings.HasPrefix(a.gs2Header, "p=") {
+		expected = append(expected, a.cb.Data...)
+	}
+	if !bytes.Equal(cbInput, expected) {
+		return nil, errScramChannelBind
+	}
+
+	authMessage := a.clientBare + "," + a.serverFirst + "," + withoutProof
+	clientSig := scramHMAC(a.h, a.creds.StoredKey, authMessage)
+	if len(proof) != len(clientSig) {
+		return nil, errScramInvalidProof
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSig[i]
+	}
+	if subtle.ConstantTimeCompare(scramSum(a.h, clientKey), a.creds.StoredKey) != 1 || a.unknown {
+		return nil, errScramInvalidProof
+	}
+
+	if err := a.authenticate(a.username, a.identity); err != nil {
+		return nil, err
+	}
+
+	serverSig := scramHMAC(a.h, a.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSig)), nil
+}
@@ -0,0 +1,169 @@
+package sasl
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type scramTestStore map[string]*ScramCredentials
+
+func (s scramTestStore) ScramCredentials(mech, username string) (*ScramCredentials, error) {
+	if creds, ok := s[username]; ok {
+		return creds, nil
+	}
+	return nil, errors.New("unknown user")
+}
+
+// setScramNonces makes scramNonce return the given nonces in order.
+func setScramNonces(t *testing.T, nonces ...string) {
+	orig := scramNonce
+	t.Cleanup(func() { scramNonce = orig })
+	scramNonce = func() string {
+		n := nonces[0]
+		nonces = nonces[1:]
+		return n
+	}
+}
+
+// The examples of RFC 5802 section 5 and RFC 7677 section 3.
+var scramVectors = []struct {
+	mech        string
+	salt        string
+	clientNonce string
+	serverNonce string
+	clientFirst string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}{
+	{
+		mech:        ScramSHA1,
+		salt:        "QSXCR+Q6sek8bf92",
+		clientNonce: "fyko+d2lbbFgONRv9qkxdawL",
+		serverNonce: "3rfcNHYJY1ZVvWVs7j",
+		clientFirst: "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+		serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		mech:        ScramSHA256,
+		salt:        "W22ZaJ0SNY7soEsUEjb6gQ==",
+		clientNonce: "rOprNGfwEbeRWgbNEkqO",
+		serverNonce: "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+		clientFirst: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+func TestScramVectors(t *testing.T) {
+	for _, v := range scramVectors {
+		t.Run(v.mech, func(t *testing.T) {
+			salt, err := base64.StdEncoding.DecodeString(v.salt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			creds, err := NewScramCredentials(v.mech, "pencil", salt, 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setScramNonces(t, v.clientNonce, v.serverNonce)
+
+			var authenticated string
+			client := NewScramClient(v.mech, "user", "pencil", nil)
+			server := NewScramServer(v.mech, scramTestStore{"user": creds}, nil, func(username, identity string) error {
+				authenticated = username
+				return nil
+			})
+
+			_, ir, err := client.Start()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(ir) != v.clientFirst {
+				t.Errorf("client-first-message = %q, want %q", ir, v.clientFirst)
+			}
+			challenge, _, err := server.Next(ir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(challenge) != v.serverFirst {
+				t.Errorf("server-first-message = %q, want %q", challenge, v.serverFirst)
+			}
+			response, err := client.Next(challenge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(response) != v.clientFinal {
+				t.Errorf("client-final-message = %q, want %q", response, v.clientFinal)
+			}
+			challenge, _, err = server.Next(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(challenge) != v.serverFinal {
+				t.Errorf("server-final-message = %q, want %q", challenge, v.serverFinal)
+			}
+			if _, err := client.Next(challenge); err != nil {
+				t.Errorf("client rejected server-final-message: %v", err)
+			}
+			if authenticated != "user" {
+				t.Errorf("authenticated user = %q, want %q", authenticated, "user")
+			}
+		})
+	}
+}
+
+func TestScramUnknownUser(t *testing.T) {
+	creds, err := NewScramCredentials(ScramSHA256, "pencil", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := scramTestStore{"user": creds}
+
+	serverFirst := func(username, password string) (string, error) {
+		client := NewScramClient(ScramSHA256, username, password, nil)
+		server := NewScramServer(ScramSHA256, store, nil, func(username, identity string) error {
+			return nil
+		})
+		_, ir, err := client.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		challenge, _, err := server.Next(ir)
+		if err != nil {
+			t.Fatalf("server-first-message for %q: %v", username, err)
+		}
+		response, err := client.Next(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = server.Next(response)
+		return string(challenge), err
+	}
+
+	// Unknown users get a server-first-message with the same salt each time.
+	first, err := serverFirst("nobody", "pencil")
+	if err != errScramInvalidProof {
+		t.Errorf("unknown user: err = %v, want %v", err, errScramInvalidProof)
+	}
+	second, _ := serverFirst("nobody", "pencil")
+	params := func(msg string) string { return msg[strings.Index(msg, ",s="):] }
+	if params(first) != params(second) {
+		t.Errorf("fake salt changed between attempts: %q != %q", params(first), params(second))
+	}
+	if other, _ := serverFirst("someone", "pencil"); params(other) == params(first) {
+		t.Error("different unknown users got the same salt")
+	}
+
+	if _, err := serverFirst("user", "wrong"); err != errScramInvalidProof {
+		t.Errorf("wrong password: err = %v, want %v", err, errScramInvalidProof)
+	}
+	if _, err := serverFirst("user", "pencil"); err != nil {
+		t.Errorf("valid password: err = %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package sasl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// The XOAUTH2 mechanism name.
+const XOAuth2 = "XOAUTH2"
+
+type xoauth2Client struct {
+	Username string
+	Token    string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	mech = XOAuth2
+	ir = []byte("user=" + a.Username + "\x01auth=Bearer " + a.Token + "\x01\x01")
+	return
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server only sends a challenge to report an error.
+	authErr := &OAuthBearerError{}
+	if err := json.Unmarshal(challenge, authErr); err != nil {
+		return nil, err
+	}
+	return nil, authErr
+}
+
+// A client implementation of the XOAUTH2 authentication mechanism used by
+// Gmail and Microsoft 365, as described in
+// https://developers.google.com/gmail/imap/xoauth2-protocol.
+func NewXOAuth2Client(username, token string) Client {
+	return &xoauth2Client{username, token}
+}
+
+// Authenticates users with an username and an OAuth 2.0 access token. The
+// returned error is sent to the client as a JSON challenge.
+type XOAuth2Authenticator func(username, token string) *OAuthBearerError
+
+type xoauth2Server struct {
+	done         bool
+	failErr      error
+	authenticate XOAuth2Authenticator
+}
+
+func (a *xoauth2Server) fail(descr string) ([]byte, bool, error) {
+	blob, err := json.Marshal(OAuthBearerError{
+		Status:  "400",
+		Schemes: "Bearer",
+	})
+	if err != nil {
+		panic(err)
+	}
+	a.failErr = errors.New(descr)
+	return blob, false, nil
+}
+
+func (a *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	// As with OAUTHBEARER, errors are sent as a JSON challenge and the
+	// exchange stops after the client sends an empty response.
+	if a.failErr != nil {
+		if len(response) != 0 {
+			return nil, true, errors.New("unexpected response")
+		}
+		return nil, true, a.failErr
+	}
+
+	if a.done {
+		err = ErrUnexpectedClientResponse
+		return
+	}
+
+	// Generate empty challenge.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	a.done = true
+
+	// Cut user=...\x01auth=Bearer ...\x01\x01
+	var username, token string
+	for _, p := range bytes.Split(response, []byte{0x01}) {
+		if len(p) == 0 {
+			continue
+		}
+		kv := bytes.SplitN(p, []byte{'='}, 2)
+		if len(kv) != 2 {
+			return a.fail("Invalid response, missing '='")
+		}
+		switch string(kv[0]) {
+		case "user":
+			username = string(kv[1])
+		case "auth":
+			const prefix = "bearer "
+			value := string(kv[1])
+			if !strings.HasPrefix(strings.ToLower(value), prefix) {
+				return a.fail("Unsupported token type")
+			}
+			token = value[len(prefix):]
+		default:
+			return a.fail("Invalid response, unknown parameter: " + string(kv[0]))
+		}
+	}
+	if username == "" || token == "" {
+		return a.fail("Invalid response, missing user or auth")
+	}
+
+	if authErr := a.authenticate(username, token); authErr != nil {
+		blob, err := json.Marshal(authErr)
+		if err != nil {
+			panic(err)
+		}
+		a.failErr = authErr
+		return blob, false, nil
+	}
+
+	return nil, true, nil
+}
+
+// A server implementation of the XOAUTH2 authentication mechanism.
+func NewXOAuth2Server(auth XOAuth2Authenticator) Server {
+	return &xoauth2Server{authenticate: auth}
+}
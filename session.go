@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
 	"github.com/zhangdapeng520/zdpgo_smtp/smtp"
 	"io"
 	"io/ioutil"
@@ -21,16 +22,46 @@ import (
 
 // Session 会话实现
 type Session struct {
+	userStore UserStore
+	authUser  string
+}
+
+// AuthMechanisms 支持的认证方式
+func (s *Session) AuthMechanisms() []string {
+	return []string{sasl.Plain, sasl.Login, sasl.External}
+}
+
+// Auth 校验认证凭据
+func (s *Session) Auth(mech string, cred smtp.Credential) error {
+	switch cred := cred.(type) {
+	case *smtp.PlainCredential:
+		if cred.Identity != "" && cred.Identity != cred.Username {
+			return errors.New("不支持授权身份")
+		}
+		return s.AuthPlain(cred.Username, cred.Password)
+	case *smtp.LoginCredential:
+		return s.AuthPlain(cred.Username, cred.Password)
+	case *smtp.CertCredential:
+		// 客户端证书已经校验过，用户目录支持时再检查用户是否存在
+		if checker, ok := s.userStore.(UserChecker); ok && !checker.HasUser(cred.Username) {
+			return ErrUserNotFound
+		}
+		return nil
+	}
+	return smtp.ErrAuthUnsupported
 }
 
 // AuthPlain 用户名和密码校验
 func (s *Session) AuthPlain(username, password string) error {
-	cachePassword := cache.Get(username)
-	if cachePassword != password {
-		// 校验失败
-		return errors.New("用户名或密码错误")
+	if s.userStore == nil {
+		return ErrInvalidPassword
 	}
-	return nil
+	return s.userStore.Authenticate(username, password)
+}
+
+// SetAuthUser 记录认证成功的用户名
+func (s *Session) SetAuthUser(username string) {
+	s.authUser = username
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
@@ -38,6 +69,12 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	return nil
 }
 
+// DataOptions 记录MAIL命令的参数
+func (s *Session) DataOptions(opts *smtp.MailOptions) {
+	gMessage.RequireTLS = opts.RequireTLS
+	gMessage.SMTPUTF8 = opts.UTF8
+}
+
 func (s *Session) Rcpt(to string) error {
 	gMessage.To = strings.Split(to, ",")
 	return nil
@@ -55,6 +92,7 @@ func (s *Session) Data(r io.Reader) error {
 	if err != nil {
 		return err
 	}
+	gMessage.AuthUser = s.authUser
 
 	// 将数据缓存
 	key := s.GetMd5([]byte(fmt.Sprintf("%s--%s--%s", gMessage.From, gMessage.Author, gMessage.Body)))
@@ -68,6 +106,26 @@ func (s *Session) Data(r io.Reader) error {
 	return nil
 }
 
+// Verify 处理 VRFY 命令，用户目录支持时检查用户是否存在
+func (s *Session) Verify(user string) (string, error) {
+	checker, ok := s.userStore.(UserChecker)
+	if !ok {
+		return "", &smtp.SMTPError{
+			Code:         252,
+			EnhancedCode: smtp.EnhancedCode{2, 5, 0},
+			Message:      "无法验证用户，但是会接收消息",
+		}
+	}
+	if !checker.HasUser(user) {
+		return "", &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      ErrUserNotFound.Error(),
+		}
+	}
+	return user, nil
+}
+
 func (s *Session) Reset() {
 	gMessage = &Message{}
 }
@@ -1,12 +1,15 @@
 package zdpgo_smtp
 
 import (
+	"errors"
 	"fmt"
 	"github.com/zhangdapeng520/zdpgo_cache_http"
 	"github.com/zhangdapeng520/zdpgo_email"
 	"github.com/zhangdapeng520/zdpgo_requests"
 	"github.com/zhangdapeng520/zdpgo_smtp/smtp"
 	"os"
+	"strings"
+	"time"
 )
 
 /*
@@ -18,9 +21,14 @@ import (
 */
 
 type Smtp struct {
-	Config *Config
-	Server *smtp.Server
-	Cache  *zdpgo_cache_http.Client
+	Config      *Config
+	Server      *smtp.Server   // 公共配置，每个监听地址使用它的副本
+	Servers     []*smtp.Server // 正在运行的服务，与 Config.Listeners 一一对应
+	Cache       *zdpgo_cache_http.Client
+	UserStore   UserStore // 用户目录，为空时根据 Config.Users 创建
+	CertManager *smtp.CertManager
+	ACMEManager *smtp.ACMEManager
+	ACMESolver  smtp.ChallengeSolver // dns-01 验证时需要设置
 }
 
 func New() *Smtp {
@@ -53,7 +61,7 @@ func NewWitchConfig(config *Config) *Smtp {
 	if len(config.Auths) == 0 {
 		config.Auths["zhangdapeng520@zhangdapeng520.com"] = Auth{
 			Username: "zhangdapeng520@zhangdapeng520.com",
-			Password: "zhangdapeng520",
+			Password: PlainPrefix + "zhangdapeng520",
 		}
 	}
 
@@ -123,11 +131,6 @@ func (s *Smtp) Run() error {
 		},
 	})
 
-	// 初始化密码
-	for _, auth := range s.Config.Auths {
-		cache.Set(auth.Username, auth.Password)
-	}
-
 	// 创建服务
 	if s.Server == nil {
 		s.Server = smtp.NewServer(&Backend{})
@@ -146,13 +149,353 @@ func (s *Smtp) Run() error {
 		s.Server.Debug = os.Stdout
 	}
 
+	// 用户
+	if s.UserStore == nil {
+		userStore, err := s.GetUserStore()
+		if err != nil {
+			return err
+		}
+		s.UserStore = userStore
+	}
+	if legacy, ok := s.UserStore.(interface{ LegacyPlainUsers() []string }); ok {
+		if names := legacy.LegacyPlainUsers(); len(names) > 0 {
+			s.Server.ErrorLog.Printf("警告: 用户 %s 的密码是没有 %s 前缀的明文，请加上前缀或者改用 bcrypt 哈希",
+				strings.Join(names, ", "), PlainPrefix)
+		}
+	}
+	if be, ok := s.Server.Backend.(*Backend); ok && be.UserStore == nil {
+		be.UserStore = s.UserStore
+	}
+
+	// 提交模式
+	if s.Config.Submission {
+		s.Server.Submission = true
+	}
+	if s.Config.CheckSender && s.Server.SenderOwner == nil {
+		s.Server.SenderOwner = smtp.SameAddressOwner
+	}
+
+	// 国际化邮件地址
+	if s.Config.SMTPUTF8 {
+		s.Server.EnableSMTPUTF8 = true
+	}
+
+	// VRFY 只对认证用户开放
+	if s.Config.VRFY {
+		s.Server.EnableVRFY = true
+		s.Server.VerifyRequireAuth = true
+	}
+
+	// 响应文本
+	if s.Server.Replies == nil {
+		s.Server.Replies = s.serverReplies()
+	}
+
+	// 认证失败限制
+	if s.Server.AuthLimiter == nil && !s.Config.AuthLimit.Disabled {
+		s.Server.AuthLimiter = s.newAuthLimiter()
+	}
+
+	// 证书
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := s.initTLS(); err != nil {
+		return err
+	}
+	if s.CertManager != nil {
+		go s.CertManager.Watch(stop)
+	}
+	if s.ACMEManager != nil {
+		go s.ACMEManager.Run(stop)
+	}
+
 	// 启动服务
-	err := s.Server.ListenAndServe()
+	return s.serve()
+}
+
+// serve 为每个监听地址创建服务并启动
+//
+// 某个服务出错退出时（例如端口被占用）记录日志，其它服务继续运行；全部服务退出后返回第一个错误，
+// 调用 Close 正常关闭时返回 nil。
+func (s *Smtp) serve() error {
+	listeners := s.Config.Listeners
+	if len(listeners) == 0 {
+		listeners = []ListenerConfig{{Host: s.Config.Host, Port: s.Config.Port, Mode: ListenerSMTP}}
+	}
+
+	servers := make([]*smtp.Server, 0, len(listeners))
+	for _, listener := range listeners {
+		server, err := s.newListenerServer(listener)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+	s.Servers = servers
+
+	errCh := make(chan error, len(servers))
+	for i, server := range servers {
+		implicitTLS := listeners[i].Mode == ListenerSMTPS
+		go func(server *smtp.Server) {
+			var err error
+			if implicitTLS {
+				err = server.ListenAndServeTLS()
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil {
+				server.ErrorLog.Printf("监听 %s 的服务退出: %s", server.Addr, err)
+			}
+			errCh <- err
+		}(server)
+	}
+
+	var firstErr error
+	for range servers {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// newListenerServer 根据监听配置复制公共服务并设置策略
+func (s *Smtp) newListenerServer(listener ListenerConfig) (*smtp.Server, error) {
+	server := s.Server.Clone()
+
+	host := listener.Host
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	port := listener.Port
+
+	switch listener.Mode {
+	case "", ListenerSMTP:
+		if port == 0 {
+			port = 25
+		}
+	case ListenerSubmission:
+		if port == 0 {
+			port = 587
+		}
+		if server.TLSConfig == nil {
+			return nil, errors.New("submission 监听地址需要配置TLS证书")
+		}
+		// 只能在 STARTTLS 之后认证，认证之后才能发送邮件
+		server.AllowInsecureAuth = false
+		server.RequireSTARTTLS = true
+		server.Submission = true
+	case ListenerSMTPS:
+		if port == 0 {
+			port = 465
+		}
+		if server.TLSConfig == nil {
+			return nil, errors.New("smtps 监听地址需要配置TLS证书")
+		}
+		server.Submission = true
+	default:
+		return nil, fmt.Errorf("不支持的监听模式: %s", listener.Mode)
+	}
+
+	if listener.RequireTLS && listener.Mode != ListenerSMTPS {
+		if server.TLSConfig == nil {
+			return nil, errors.New("require_tls 需要配置TLS证书")
+		}
+		server.RequireSTARTTLS = true
+	}
+	if len(listener.TLSExemptNetworks) > 0 {
+		networks, err := smtp.ParseNetworks(listener.TLSExemptNetworks)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSExemptNetworks = networks
+	}
+
+	server.Addr = fmt.Sprintf("%s:%d", host, port)
+	return server, nil
+}
+
+// Close 关闭所有监听地址和连接
+func (s *Smtp) Close() error {
+	var err error
+	for _, server := range s.Servers {
+		if cerr := server.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// GetUserStore 根据配置创建用户目录
+func (s *Smtp) GetUserStore() (UserStore, error) {
+	users := s.Config.Users
+	switch users.Type {
+	case "", "memory":
+		return NewMemoryUserStore(s.Config.Auths)
+	case "file":
+		return NewFileUserStore(users.Path)
+	case "htpasswd":
+		return NewHtpasswdUserStore(users.Path)
+	case "ldap":
+		if users.LDAPAddr == "" || users.LDAPBindDN == "" {
+			return nil, errors.New("LDAP用户目录需要配置 ldap_addr 和 ldap_bind_dn")
+		}
+		store := NewLDAPUserStore(users.LDAPAddr, users.LDAPBindDN, nil)
+		store.Binder.(*LDAPConnBinder).Insecure = users.LDAPInsecure
+		return store, nil
+	}
+	return nil, fmt.Errorf("不支持的用户目录类型: %s", users.Type)
+}
+
+// newAuthLimiter 根据配置创建认证失败限制器，失败事件写入错误日志
+func (s *Smtp) newAuthLimiter() *smtp.AuthLimiter {
+	limiter := smtp.NewAuthLimiter()
+	if n := s.Config.AuthLimit.MaxFailures; n > 0 {
+		limiter.MaxFailures = n
+	}
+	if n := s.Config.AuthLimit.LockoutSeconds; n > 0 {
+		limiter.LockoutDuration = time.Duration(n) * time.Second
+	}
+	errorLog := s.Server.ErrorLog
+	limiter.OnFailure = func(e smtp.AuthEvent) {
+		errorLog.Printf("认证失败: ip=%s user=%q mechanism=%s failures=%d locked=%v err=%v",
+			e.IP, e.Username, e.Mechanism, e.Failures, e.Locked, e.Err)
+	}
+	return limiter
+}
+
+// serverReplies 根据配置的语言返回响应文本，Config.Replies 中的条目覆盖对应的文本
+func (s *Smtp) serverReplies() map[smtp.ReplyID]string {
+	base := smtp.DefaultReplies
+	if strings.HasPrefix(strings.ToLower(s.Config.Language), "zh") {
+		base = smtp.ChineseReplies
+	}
+	if len(s.Config.Replies) == 0 {
+		return base
+	}
+	replies := make(map[smtp.ReplyID]string, len(base)+len(s.Config.Replies))
+	for id, text := range base {
+		replies[id] = text
+	}
+	for id, text := range s.Config.Replies {
+		replies[smtp.ReplyID(id)] = text
+	}
+	return replies
+}
+
+// initTLS 根据配置创建证书管理器并设置TLS策略
+func (s *Smtp) initTLS() error {
+	tlsConfig := s.Config.TLS
+	if tlsConfig.MinVersion != "" {
+		version, err := smtp.ParseTLSVersion(tlsConfig.MinVersion)
+		if err != nil {
+			return err
+		}
+		s.Server.MinTLSVersion = version
+	}
+	if len(tlsConfig.CipherSuites) > 0 {
+		suites, err := smtp.ParseCipherSuites(tlsConfig.CipherSuites)
+		if err != nil {
+			return err
+		}
+		s.Server.TLSCipherSuites = suites
+	}
+	if s.Server.TLSLog == nil {
+		s.Server.TLSLog = s.Server.ErrorLog
+	}
+
+	if s.Server.TLSConfig != nil {
+		return nil
+	}
+	if err := s.initACME(); err != nil {
+		return err
+	}
+
+	tlsConfig = s.Config.TLS // initACME 可能修改了证书目录
+	if tlsConfig.CertDir == "" && len(tlsConfig.Certs) == 0 {
+		return nil
+	}
+
+	files := make([]smtp.CertFile, 0, len(tlsConfig.Certs))
+	for _, c := range tlsConfig.Certs {
+		files = append(files, smtp.CertFile{
+			Name:     c.Hostname,
+			CertFile: c.CertFile,
+			KeyFile:  c.KeyFile,
+		})
+	}
+	manager, err := smtp.NewCertManager(tlsConfig.CertDir, files, tlsConfig.DefaultHost)
 	if err != nil {
 		return err
 	}
+	manager.Interval = time.Duration(tlsConfig.ReloadInterval) * time.Second
+	manager.ErrorLog = s.Server.ErrorLog
 
-	// 返回
+	s.CertManager = manager
+	s.Server.TLSConfig = manager.TLSConfig()
+	return nil
+}
+
+// initACME 根据配置申请证书，证书保存在证书管理器的目录中
+func (s *Smtp) initACME() error {
+	acmeConfig := s.Config.ACME
+	if len(acmeConfig.Domains) == 0 {
+		return nil
+	}
+
+	if acmeConfig.CertDir == "" {
+		acmeConfig.CertDir = s.Config.TLS.CertDir
+	}
+	if acmeConfig.CertDir == "" {
+		acmeConfig.CertDir = "certs"
+	}
+	s.Config.TLS.CertDir = acmeConfig.CertDir
+
+	solver := s.ACMESolver
+	switch acmeConfig.Challenge {
+	case "", "http-01":
+		if solver == nil {
+			if acmeConfig.HTTPAddr == "" {
+				acmeConfig.HTTPAddr = ":80"
+			}
+			solver = &smtp.HTTP01Solver{Addr: acmeConfig.HTTPAddr}
+		}
+	case "dns-01":
+		if solver == nil {
+			return errors.New("dns-01 验证需要设置 ACMESolver")
+		}
+	default:
+		return fmt.Errorf("不支持的ACME验证方式: %s", acmeConfig.Challenge)
+	}
+
+	manager := &smtp.ACMEManager{
+		DirectoryURL: acmeConfig.DirectoryURL,
+		Email:        acmeConfig.Email,
+		Domains:      acmeConfig.Domains,
+		Dir:          acmeConfig.CertDir,
+		Solver:       solver,
+		ErrorLog:     s.Server.ErrorLog,
+		OnRenew: func() error {
+			if s.CertManager == nil {
+				return nil
+			}
+			return s.CertManager.Load()
+		},
+	}
+	if acmeConfig.CACertFile != "" {
+		client, err := smtp.ACMEHTTPClient(acmeConfig.CACertFile)
+		if err != nil {
+			return err
+		}
+		manager.HTTPClient = client
+	}
+
+	// 先使用已有的证书或者自签名的临时证书提供服务，正式证书由 ACMEManager.Run 在后台申请
+	if err := manager.WritePlaceholder(); err != nil {
+		return err
+	}
+
+	s.ACMEManager = manager
 	return nil
 }
 
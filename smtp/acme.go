@@ -0,0 +1,501 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// LetsEncryptURL Let's Encrypt 生产环境的目录地址
+const LetsEncryptURL = acme.LetsEncryptURL
+
+// ChallengeSolver ACME challenge 处理接口
+//
+// Present 发布验证内容：HTTP-01 时 value 为需要在
+// /.well-known/acme-challenge/<token> 返回的内容，DNS-01 时 value 为
+// _acme-challenge.<domain> TXT记录的值。验证结束后调用 CleanUp。
+type ChallengeSolver interface {
+	Type() string
+	Present(domain, token, value string) error
+	CleanUp(domain, token, value string) error
+}
+
+// HTTP01Solver 通过HTTP服务响应 http-01 challenge
+//
+// 设置了 Addr 时，Present 会自动启动HTTP服务，否则需要把 HTTP01Solver
+// 作为 http.Handler 挂载到已有的HTTP服务上。
+type HTTP01Solver struct {
+	Addr string // 例如 ":80"，使用 Pebble 测试时通常为 ":5002"
+
+	locker    sync.Mutex
+	responses map[string]string
+	server    *http.Server
+}
+
+func (s *HTTP01Solver) Type() string {
+	return "http-01"
+}
+
+func (s *HTTP01Solver) Present(domain, token, value string) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.responses == nil {
+		s.responses = make(map[string]string)
+	}
+	s.responses[token] = value
+
+	if s.Addr == "" || s.server != nil {
+		return nil
+	}
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.server = &http.Server{Handler: s}
+	go s.server.Serve(l)
+	return nil
+}
+
+func (s *HTTP01Solver) CleanUp(domain, token, value string) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	delete(s.responses, token)
+	if len(s.responses) == 0 && s.server != nil {
+		err := s.server.Close()
+		s.server = nil
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP 响应 /.well-known/acme-challenge/ 请求
+func (s *HTTP01Solver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/.well-known/acme-challenge/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.locker.Lock()
+	value, ok := s.responses[strings.TrimPrefix(r.URL.Path, prefix)]
+	s.locker.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(value))
+}
+
+// DNS01Solver 通过DNS服务商接口响应 dns-01 challenge
+type DNS01Solver struct {
+	// 设置 TXT 记录，fqdn 形如 _acme-challenge.example.com.
+	SetTXT func(fqdn, value string) error
+	// 删除 TXT 记录
+	DeleteTXT func(fqdn, value string) error
+	// 设置记录后等待DNS生效的时间
+	PropagationDelay time.Duration
+}
+
+func (s *DNS01Solver) Type() string {
+	return "dns-01"
+}
+
+func (s *DNS01Solver) Present(domain, token, value string) error {
+	if err := s.SetTXT(dns01Name(domain), value); err != nil {
+		return err
+	}
+	time.Sleep(s.PropagationDelay)
+	return nil
+}
+
+func (s *DNS01Solver) CleanUp(domain, token, value string) error {
+	if s.DeleteTXT == nil {
+		return nil
+	}
+	return s.DeleteTXT(dns01Name(domain), value)
+}
+
+func dns01Name(domain string) string {
+	return "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+}
+
+// ACMEManager 通过 ACME 协议（RFC 8555）自动申请和续期证书
+//
+// 私钥和证书链一起保存在 Dir/<第一个域名>/bundle.pem，
+// 和 CertManager 的目录格式一致，可以直接交给 CertManager 加载。
+// 启动时可以先调用 WritePlaceholder 写入自签名证书，再由 Run 在后台申请正式证书，
+// 不需要等待申请完成才能提供服务。
+type ACMEManager struct {
+	DirectoryURL string          // ACME 目录地址，默认 Let's Encrypt
+	Email        string          // 账号联系邮箱
+	Domains      []string        // 申请证书的域名
+	Dir          string          // 账号私钥和证书的保存目录
+	Solver       ChallengeSolver // challenge 处理
+	RenewBefore  time.Duration   // 证书过期前多久续期，默认30天
+	HTTPClient   *http.Client    // 访问ACME服务使用的客户端，例如信任 Pebble 的测试根证书
+	ErrorLog     Logger
+
+	// 证书更新后调用，通常用于重新加载 CertManager
+	OnRenew func() error
+
+	client *acme.Client
+}
+
+// ACMEHTTPClient 返回信任指定根证书的HTTP客户端，用于连接 Pebble 之类的测试ACME服务
+func ACMEHTTPClient(caFile string) (*http.Client, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("smtp: 无法解析根证书 %s", caFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+func (m *ACMEManager) certDir() string {
+	return filepath.Join(m.Dir, strings.TrimPrefix(m.Domains[0], "*."))
+}
+
+// CertFile 返回证书文件路径，证书和私钥是同一个文件
+func (m *ACMEManager) CertFile() CertFile {
+	p := filepath.Join(m.certDir(), "bundle.pem")
+	return CertFile{CertFile: p, KeyFile: p}
+}
+
+// NeedRenew 判断证书是否不存在、是自签名的临时证书或者即将过期
+func (m *ACMEManager) NeedRenew() bool {
+	renewBefore := m.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = 30 * 24 * time.Hour
+	}
+
+	f := m.CertFile()
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return true
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+	if isSelfSigned(leaf) {
+		return true
+	}
+	for _, domain := range m.Domains {
+		if leaf.VerifyHostname(strings.Replace(domain, "*", "wildcard", 1)) != nil {
+			return true
+		}
+	}
+	return time.Until(leaf.NotAfter) < renewBefore
+}
+
+// WritePlaceholder 证书文件不存在时写入自签名的临时证书
+//
+// CertManager 可以立即加载并提供TLS服务，Obtain 申请到正式证书之后替换这个文件。
+func (m *ACMEManager) WritePlaceholder() error {
+	if len(m.Domains) == 0 {
+		return errors.New("smtp: ACME 域名不能为空")
+	}
+	if fileExists(m.CertFile().CertFile) {
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: m.Domains[0]},
+		DNSNames:     m.Domains,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(7 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	return m.save([][]byte{der}, key)
+}
+
+// isSelfSigned 判断证书是否由自己签发，即 WritePlaceholder 写入的临时证书
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// Obtain 证书不存在或者即将过期时申请新证书
+func (m *ACMEManager) Obtain(ctx context.Context) error {
+	if len(m.Domains) == 0 {
+		return errors.New("smtp: ACME 域名不能为空")
+	}
+	if m.Solver == nil {
+		return errors.New("smtp: ACME challenge solver 不能为空")
+	}
+	if !m.NeedRenew() {
+		return nil
+	}
+
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.Domains...))
+	if err != nil {
+		return err
+	}
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, u); err != nil {
+			return err
+		}
+	}
+	// WaitOrder 的结果中没有订单地址，后面还要用到
+	orderURL := order.URI
+	order, err = client.WaitOrder(ctx, orderURL)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.Domains[0]},
+		DNSNames: m.Domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	der, err := m.finalize(ctx, client, orderURL, order.FinalizeURL, csr)
+	if err != nil {
+		return err
+	}
+
+	if err := m.save(der, key); err != nil {
+		return err
+	}
+	if m.OnRenew != nil {
+		return m.OnRenew()
+	}
+	return nil
+}
+
+// finalize 提交 CSR 并下载证书链
+//
+// 服务异步签发证书时（Let's Encrypt 和 Pebble 都是这样）finalize 的响应没有 Location，
+// CreateOrderCert 无法等待订单完成，这时按照订单地址重新等待并下载证书。
+func (m *ACMEManager) finalize(ctx context.Context, client *acme.Client, orderURL, finalizeURL string, csr []byte) ([][]byte, error) {
+	der, _, err := client.CreateOrderCert(ctx, finalizeURL, csr, true)
+	if err == nil {
+		return der, nil
+	}
+	o, werr := client.WaitOrder(ctx, orderURL)
+	if werr != nil || o.Status != acme.StatusValid || o.CertURL == "" {
+		return nil, err
+	}
+	return client.FetchCert(ctx, o.CertURL, true)
+}
+
+// authorize 完成单个域名的验证
+func (m *ACMEManager) authorize(ctx context.Context, client *acme.Client, u string) error {
+	authz, err := client.GetAuthorization(ctx, u)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == m.Solver.Type() {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("smtp: ACME 服务不支持 %s 验证 %s", m.Solver.Type(), authz.Identifier.Value)
+	}
+
+	var value string
+	switch chal.Type {
+	case "http-01":
+		value, err = client.HTTP01ChallengeResponse(chal.Token)
+	case "dns-01":
+		value, err = client.DNS01ChallengeRecord(chal.Token)
+	default:
+		err = fmt.Errorf("smtp: 不支持的 challenge 类型 %s", chal.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	domain := authz.Identifier.Value
+	if err := m.Solver.Present(domain, chal.Token, value); err != nil {
+		return err
+	}
+	defer m.Solver.CleanUp(domain, chal.Token, value)
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// acmeClient 加载或者创建账号私钥并注册账号
+func (m *ACMEManager) acmeClient(ctx context.Context) (*acme.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: m.DirectoryURL,
+		HTTPClient:   m.HTTPClient,
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = LetsEncryptURL
+	}
+
+	account := &acme.Account{}
+	if m.Email != "" {
+		account.Contact = []string{"mailto:" + m.Email}
+	}
+	_, err = client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+
+	m.client = client
+	return client, nil
+}
+
+func (m *ACMEManager) accountKey() (crypto.Signer, error) {
+	p := filepath.Join(m.Dir, "acme_account.key")
+	if data, err := os.ReadFile(p); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("smtp: 无法解析账号私钥 %s", p)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(p, data, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// save 把私钥和证书链写入同一个文件
+//
+// 先写临时文件再重命名，CertManager 不会读到不完整的文件，也不会读到新私钥和旧证书的组合。
+func (m *ACMEManager) save(der [][]byte, key *ecdsa.PrivateKey) error {
+	if err := os.MkdirAll(m.certDir(), 0700); err != nil {
+		return err
+	}
+
+	var chain []byte
+	for _, b := range der {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	p := m.CertFile().CertFile
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, append(keyPEM, chain...), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Run 立即检查一次证书，之后每12小时检查一次，需要时申请或者续期，直到 stop 被关闭
+//
+// 申请失败时1小时后重试。
+func (m *ACMEManager) Run(stop <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		go func() {
+			// stop 关闭时中断正在进行的申请
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := m.Obtain(ctx)
+		cancel()
+
+		next := 12 * time.Hour
+		if err != nil {
+			next = time.Hour
+			if m.ErrorLog != nil {
+				m.ErrorLog.Printf("ACME 申请证书失败: %s", err)
+			}
+		}
+		timer.Reset(next)
+	}
+}
@@ -0,0 +1,133 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestACMEPlaceholder(t *testing.T) {
+	m := &ACMEManager{Domains: []string{"mail.example.com"}, Dir: t.TempDir()}
+	if err := m.WritePlaceholder(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.NeedRenew() {
+		t.Error("NeedRenew = false for the self-signed placeholder")
+	}
+
+	cm, err := NewCertManager(m.Dir, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cm.GetCertificate(&tls.ClientHelloInfo{ServerName: "mail.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("mail.example.com"); err != nil {
+		t.Error(err)
+	}
+
+	// 已经存在证书时不覆盖
+	before, err := os.ReadFile(m.CertFile().CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WritePlaceholder(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadFile(m.CertFile().CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Error("WritePlaceholder replaced an existing certificate")
+	}
+}
+
+// TestACMEPebble 使用 Pebble 测试申请、续期和重新加载证书
+//
+// 需要先启动 Pebble，例如 pebble -config test/config/pebble-config.json，然后设置：
+//
+//	PEBBLE_DIRECTORY  目录地址，例如 https://localhost:14000/dir
+//	PEBBLE_CA         Pebble HTTPS 接口的根证书，例如 test/certs/pebble.minica.pem
+//	PEBBLE_DOMAIN     申请证书的域名，需要解析到本机，默认 localhost
+//	PEBBLE_HTTP_ADDR  响应 http-01 的地址，和 Pebble 的 httpPort 一致，默认 :5002
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY not set")
+	}
+	client, err := ACMEHTTPClient(os.Getenv("PEBBLE_CA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := os.Getenv("PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "localhost"
+	}
+	addr := os.Getenv("PEBBLE_HTTP_ADDR")
+	if addr == "" {
+		addr = ":5002"
+	}
+
+	var cm *CertManager
+	m := &ACMEManager{
+		DirectoryURL: directory,
+		Email:        "admin@example.com",
+		Domains:      []string{domain},
+		Dir:          t.TempDir(),
+		Solver:       &HTTP01Solver{Addr: addr},
+		HTTPClient:   client,
+		OnRenew:      func() error { return cm.Load() },
+	}
+	if err := m.WritePlaceholder(); err != nil {
+		t.Fatal(err)
+	}
+	cm, err = NewCertManager(m.Dir, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := func() *tls.Certificate {
+		cert, err := cm.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	placeholder := current()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	// Run 在后台申请正式证书，OnRenew 重新加载之前一直使用临时证书
+	stop := make(chan struct{})
+	go m.Run(stop)
+	issued := current()
+	for issued == placeholder || isSelfSigned(issued.Leaf) {
+		select {
+		case <-ctx.Done():
+			close(stop)
+			t.Fatal("certificate not replaced by Run")
+		case <-time.After(100 * time.Millisecond):
+		}
+		issued = current()
+	}
+	close(stop)
+	if m.NeedRenew() {
+		t.Error("NeedRenew = true right after Obtain")
+	}
+
+	// 续期窗口大于证书有效期时重新申请
+	m.RenewBefore = 10 * 365 * 24 * time.Hour
+	if !m.NeedRenew() {
+		t.Fatal("NeedRenew = false inside the renewal window")
+	}
+	if err := m.Obtain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if renewed := current(); renewed.Leaf.SerialNumber.Cmp(issued.Leaf.SerialNumber) == 0 {
+		t.Error("certificate not replaced after renewal")
+	}
+}
@@ -0,0 +1,264 @@
+package smtp
+
+import (
+	"crypto/x509"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
+)
+
+// errIdentityUnsupported 客户端指定了和用户名不同的授权身份
+var errIdentityUnsupported = &SMTPError{
+	Code:         454,
+	EnhancedCode: EnhancedCode{4, 7, 0},
+	Message:      "Identities not supported",
+}
+
+// errAuthCancelled 客户端在给出用户名之后取消了认证
+var errAuthCancelled = errors.New("smtp: authentication cancelled by client")
+
+// Credential 认证凭据
+//
+// 具体类型由认证方式决定：*PlainCredential、*LoginCredential、*BearerCredential、
+// *CertCredential、*AnonymousCredential，以及服务端已经完成校验的 *VerifiedCredential。
+// 自定义认证方式可以使用自己的凭据类型。
+type Credential interface {
+	// User 返回凭据对应的用户名
+	User() string
+}
+
+// PlainCredential PLAIN 认证的凭据
+type PlainCredential struct {
+	Identity string // 授权身份，为空时和 Username 相同
+	Username string
+	Password string
+}
+
+func (c *PlainCredential) User() string { return c.Username }
+
+// LoginCredential LOGIN 认证的凭据
+type LoginCredential struct {
+	Username string
+	Password string
+}
+
+func (c *LoginCredential) User() string { return c.Username }
+
+// BearerCredential OAUTHBEARER 和 XOAUTH2 认证的凭据，令牌由会话自己校验
+type BearerCredential struct {
+	Username string
+	Token    string
+	Host     string
+	Port     int
+}
+
+func (c *BearerCredential) User() string { return c.Username }
+
+// CertCredential EXTERNAL 认证的凭据，来自经过验证的TLS客户端证书
+type CertCredential struct {
+	Username    string // 证书映射出的用户名
+	Certificate *x509.Certificate
+}
+
+func (c *CertCredential) User() string { return c.Username }
+
+// AnonymousCredential ANONYMOUS 认证的凭据
+type AnonymousCredential struct {
+	Trace string
+}
+
+func (c *AnonymousCredential) User() string { return "" }
+
+// VerifiedCredential 服务端已经完成校验的凭据，用于 SCRAM、CRAM-MD5
+// 以及配置了令牌校验器的 OAUTHBEARER、XOAUTH2
+type VerifiedCredential struct {
+	Username string
+}
+
+func (c *VerifiedCredential) User() string { return c.Username }
+
+// AuthSession 支持多种认证方式的会话
+//
+// 服务根据 AuthMechanisms 宣告 AUTH 能力，内置的 PLAIN、LOGIN、ANONYMOUS、
+// OAUTHBEARER 和 XOAUTH2 不需要额外注册，其它认证方式需要先通过
+// EnableAuth、EnableScramAuth 等方法注册。
+type AuthSession interface {
+	AuthMechanisms() []string
+	Auth(mech string, cred Credential) error
+}
+
+// PlainSession 只实现 AuthPlain 的旧会话
+//
+// Session 接口原来包含 AuthPlain，现在认证统一由 AuthSession 处理。服务对没有实现 AuthSession
+// 的 PlainSession 自动使用 PlainAuthAdapter，这样的会话不需要修改。
+type PlainSession interface {
+	AuthPlain(username, password string) error
+}
+
+// PlainAuthAdapter 把只实现 AuthPlain 的旧会话适配为 AuthSession
+//
+// 宣告 PLAIN 认证，PLAIN 和 LOGIN 凭据交给 AuthPlain，其它凭据返回 ErrAuthUnsupported。
+// 包装会话的代码可以用它把旧会话当作 AuthSession 使用。
+type PlainAuthAdapter struct {
+	PlainSession
+}
+
+func (a PlainAuthAdapter) AuthMechanisms() []string {
+	return []string{sasl.Plain}
+}
+
+func (a PlainAuthAdapter) Auth(mech string, cred Credential) error {
+	switch cred := cred.(type) {
+	case *PlainCredential:
+		if cred.Identity != "" && cred.Identity != cred.Username {
+			return errIdentityUnsupported
+		}
+		return a.AuthPlain(cred.Username, cred.Password)
+	case *LoginCredential:
+		return a.AuthPlain(cred.Username, cred.Password)
+	}
+	return ErrAuthUnsupported
+}
+
+// authSession 返回会话的 AuthSession 实现，旧的 PlainSession 使用 PlainAuthAdapter
+func authSession(sess Session) (AuthSession, bool) {
+	switch sess := sess.(type) {
+	case AuthSession:
+		return sess, true
+	case PlainSession:
+		return PlainAuthAdapter{sess}, true
+	}
+	return nil, false
+}
+
+// builtinAuths 内置的认证方式，凭据交给会话校验
+var builtinAuths = map[string]SaslServerFactory{
+	sasl.Plain: func(conn *Conn) sasl.Server {
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return conn.Authenticate(sasl.Plain, &PlainCredential{
+				Identity: identity,
+				Username: username,
+				Password: password,
+			})
+		})
+	},
+	sasl.Login: func(conn *Conn) sasl.Server {
+		return sasl.NewLoginServer(func(username, password string) error {
+			return conn.Authenticate(sasl.Login, &LoginCredential{
+				Username: username,
+				Password: password,
+			})
+		})
+	},
+	sasl.Anonymous: func(conn *Conn) sasl.Server {
+		return sasl.NewAnonymousServer(func(trace string) error {
+			return conn.Authenticate(sasl.Anonymous, &AnonymousCredential{Trace: trace})
+		})
+	},
+	sasl.OAuthBearer: func(conn *Conn) sasl.Server {
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			err := conn.Authenticate(sasl.OAuthBearer, &BearerCredential{
+				Username: opts.Username,
+				Token:    opts.Token,
+				Host:     opts.Host,
+				Port:     opts.Port,
+			})
+			if err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			return nil
+		})
+	},
+	sasl.XOAuth2: func(conn *Conn) sasl.Server {
+		return sasl.NewXOAuth2Server(func(username, token string) *sasl.OAuthBearerError {
+			err := conn.Authenticate(sasl.XOAuth2, &BearerCredential{
+				Username: username,
+				Token:    token,
+			})
+			if err != nil {
+				return &sasl.OAuthBearerError{Status: "401", Schemes: "Bearer"}
+			}
+			return nil
+		})
+	},
+}
+
+// AuthMechanisms 返回会话支持的认证方式
+func AuthMechanisms(sess Session) []string {
+	if sess, ok := authSession(sess); ok {
+		return sess.AuthMechanisms()
+	}
+	return nil
+}
+
+// Authenticate 把凭据交给会话校验，会话不支持认证时返回 ErrAuthUnsupported
+func Authenticate(sess Session, mech string, cred Credential) error {
+	if sess, ok := authSession(sess); ok {
+		return sess.Auth(mech, cred)
+	}
+	return ErrAuthUnsupported
+}
+
+// Authenticate 把凭据交给当前会话校验，用于 EnableAuth 注册的自定义认证方式
+func (c *Conn) Authenticate(mech string, cred Credential) error {
+	sess := c.Session()
+	if sess == nil {
+		panic("No session when AUTH is called")
+	}
+	if err := c.authStart(cred.User()); err != nil {
+		return err
+	}
+	if err := Authenticate(sess, mech, cred); err != nil {
+		return err
+	}
+	if l := c.server.AuthLimiter; l != nil {
+		l.Success(remoteIP(c.conn.RemoteAddr()), c.authUser)
+	}
+	return nil
+}
+
+// authStart 记录客户端给出的用户名，IP或者该用户名已经被锁定时返回 ErrAuthLocked
+//
+// SCRAM、CRAM-MD5 和令牌认证在服务端校验凭据之前调用，失败时按照这个用户名计数。
+func (c *Conn) authStart(username string) error {
+	c.authUser = username
+	l := c.server.AuthLimiter
+	if l != nil && l.Locked(remoteIP(c.conn.RemoteAddr()), username) {
+		return ErrAuthLocked
+	}
+	return nil
+}
+
+// authFactory 查找认证方式，注册的认证方式优先于内置的认证方式
+func (c *Conn) authFactory(mech string) (SaslServerFactory, bool) {
+	if f, ok := c.server.auths[mech]; ok {
+		return f, true
+	}
+	f, ok := builtinAuths[mech]
+	return f, ok
+}
+
+// authMechanisms 返回当前连接可以宣告的认证方式
+func (c *Conn) authMechanisms() []string {
+	_, isTLS := c.TLSConnectionState()
+
+	names := make(map[string]bool)
+	for _, name := range AuthMechanisms(c.Session()) {
+		if _, ok := c.authFactory(name); ok {
+			names[name] = true
+		}
+	}
+
+	mechs := make([]string, 0, len(names))
+	for name := range names {
+		// 通道绑定机制只能在TLS连接中使用
+		if strings.HasSuffix(name, "-PLUS") && !isTLS {
+			continue
+		}
+		mechs = append(mechs, name)
+	}
+	sort.Strings(mechs)
+	return mechs
+}
@@ -0,0 +1,53 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
+)
+
+var errWrongPassword = errors.New("wrong password")
+
+// legacySession 只实现 AuthPlain 的旧会话
+type legacySession struct {
+	users map[string]string
+}
+
+func (s *legacySession) AuthPlain(username, password string) error {
+	if p, ok := s.users[username]; ok && p == password {
+		return nil
+	}
+	return errWrongPassword
+}
+
+func (s *legacySession) Reset()                          {}
+func (s *legacySession) Logout() error                   { return nil }
+func (s *legacySession) Mail(string, *MailOptions) error { return nil }
+func (s *legacySession) Rcpt(string) error               { return nil }
+func (s *legacySession) Data(io.Reader) error            { return nil }
+
+func TestPlainAuthAdapter(t *testing.T) {
+	sess := &legacySession{users: map[string]string{"alice": "secret"}}
+	if mechs := AuthMechanisms(sess); len(mechs) != 1 || mechs[0] != sasl.Plain {
+		t.Errorf("AuthMechanisms = %v, want [PLAIN]", mechs)
+	}
+
+	tests := []struct {
+		mech    string
+		cred    Credential
+		wantErr error
+	}{
+		{sasl.Plain, &PlainCredential{Username: "alice", Password: "secret"}, nil},
+		{sasl.Plain, &PlainCredential{Username: "alice", Password: "wrong"}, errWrongPassword},
+		{sasl.Plain, &PlainCredential{Identity: "bob", Username: "alice", Password: "secret"}, errIdentityUnsupported},
+		{sasl.Login, &LoginCredential{Username: "alice", Password: "secret"}, nil},
+		{sasl.External, &CertCredential{Username: "alice"}, ErrAuthUnsupported},
+	}
+	for _, tc := range tests {
+		if err := Authenticate(sess, tc.mech, tc.cred); err != tc.wantErr {
+			t.Errorf("Authenticate(%s, %+v) = %v, want %v", tc.mech, tc.cred, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrAuthLocked = &SMTPError{
+	Code:         454,
+	EnhancedCode: EnhancedCode{4, 7, 0},
+	Message:      "Too many failed authentication attempts, try again later",
+}
+
+// AuthEvent 认证失败的审计事件
+type AuthEvent struct {
+	Time       time.Time
+	RemoteAddr net.Addr
+	IP         string
+	Username   string // 客户端没有给出用户名时为空
+	Mechanism  string
+	Failures   int  // 该IP在统计窗口内的失败次数
+	Locked     bool // 本次失败之后IP或者用户名是否被锁定
+	Err        error
+}
+
+// authRecord 单个IP或者用户名的失败记录
+type authRecord struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// AuthLimiter 按照远程IP和用户名统计认证失败次数，失败后逐步增加回复延迟，
+// 超过次数后临时锁定。被锁定的IP在连接时就会被拒绝。可以被多个服务共享。
+//
+// 用户名的失败次数按照来源IP分别统计，其他地址的失败不会锁定该用户，
+// 否则任何人都可以持续锁定别人的账号。锁定期间的失败不计数，也不延长锁定。
+//
+// 数值参数为 0 时使用默认值，零值的 AuthLimiter 和 NewAuthLimiter 的返回值相同。
+type AuthLimiter struct {
+	// 锁定前允许的失败次数，默认 5
+	MaxFailures int
+	// 第一次失败的回复延迟，之后每次失败翻倍，默认 1 秒，负数表示不延迟
+	Delay time.Duration
+	// 回复延迟的上限，默认 10 秒
+	MaxDelay time.Duration
+	// 锁定时长，默认 15 分钟
+	LockoutDuration time.Duration
+	// 失败次数的统计窗口，超过该时间没有失败则清零，默认 15 分钟
+	Window time.Duration
+	// 最多保存的记录数量，超过时清理没有锁定的记录，默认 100000，负数表示不限制
+	MaxEntries int
+	// 每次认证失败都会调用，用于审计日志
+	OnFailure func(AuthEvent)
+
+	mu        sync.Mutex
+	ips       map[string]*authRecord
+	users     map[string]*authRecord
+	lastSweep time.Time
+}
+
+// 认证限制器参数的默认值
+const (
+	defaultAuthMaxFailures = 5
+	defaultAuthDelay       = time.Second
+	defaultAuthMaxDelay    = 10 * time.Second
+	defaultAuthLockout     = 15 * time.Minute
+	defaultAuthWindow      = 15 * time.Minute
+	defaultAuthMaxEntries  = 100000
+)
+
+// NewAuthLimiter 创建使用默认参数的认证限制器
+func NewAuthLimiter() *AuthLimiter {
+	return &AuthLimiter{
+		MaxFailures:     defaultAuthMaxFailures,
+		Delay:           defaultAuthDelay,
+		MaxDelay:        defaultAuthMaxDelay,
+		LockoutDuration: defaultAuthLockout,
+		Window:          defaultAuthWindow,
+		MaxEntries:      defaultAuthMaxEntries,
+	}
+}
+
+func (l *AuthLimiter) maxFailures() int {
+	if l.MaxFailures <= 0 {
+		return defaultAuthMaxFailures
+	}
+	return l.MaxFailures
+}
+
+func (l *AuthLimiter) delay() time.Duration {
+	if l.Delay == 0 {
+		return defaultAuthDelay
+	}
+	return l.Delay
+}
+
+func (l *AuthLimiter) maxDelay() time.Duration {
+	if l.MaxDelay <= 0 {
+		return defaultAuthMaxDelay
+	}
+	return l.MaxDelay
+}
+
+func (l *AuthLimiter) lockout() time.Duration {
+	if l.LockoutDuration <= 0 {
+		return defaultAuthLockout
+	}
+	return l.LockoutDuration
+}
+
+func (l *AuthLimiter) window() time.Duration {
+	if l.Window <= 0 {
+		return defaultAuthWindow
+	}
+	return l.Window
+}
+
+func (l *AuthLimiter) maxEntries() int {
+	if l.MaxEntries == 0 {
+		return defaultAuthMaxEntries
+	}
+	return l.MaxEntries
+}
+
+// userKey 用户名记录的键，同一个用户名在不同IP上的失败分开统计
+func userKey(ip, username string) string {
+	return strings.ToLower(username) + "\x00" + ip
+}
+
+// remoteIP 返回地址中的IP部分，非TCP地址原样返回
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
+
+// record 返回有效的记录，过期的记录会被清理，调用者必须持有锁
+func (l *AuthLimiter) record(m map[string]*authRecord, key string, now time.Time) *authRecord {
+	r := m[key]
+	if r == nil {
+		return nil
+	}
+	if l.expired(r, now) {
+		delete(m, key)
+		return nil
+	}
+	return r
+}
+
+func (r *authRecord) locked(now time.Time) bool {
+	return r != nil && now.Before(r.lockedUntil)
+}
+
+// expired 报告记录是否已经没有作用，可以删除
+func (l *AuthLimiter) expired(r *authRecord, now time.Time) bool {
+	return now.After(r.lockedUntil) && now.Sub(r.last) > l.window()
+}
+
+// sweep 删除过期的记录，记录数量仍然超过 MaxEntries 时删除没有锁定的记录，调用者必须持有锁
+//
+// 只在 record 中清理的话，不再出现的IP和用户名会一直留在内存中。
+func (l *AuthLimiter) sweep(now time.Time) {
+	maxEntries := l.maxEntries()
+	full := maxEntries > 0 && len(l.ips)+len(l.users) >= maxEntries
+	if !full && now.Sub(l.lastSweep) < l.window() {
+		return
+	}
+	l.lastSweep = now
+	for _, m := range []map[string]*authRecord{l.ips, l.users} {
+		for key, r := range m {
+			if l.expired(r, now) {
+				delete(m, key)
+			}
+		}
+	}
+	for _, m := range []map[string]*authRecord{l.users, l.ips} {
+		for key, r := range m {
+			if maxEntries <= 0 || len(l.ips)+len(l.users) < maxEntries {
+				return
+			}
+			if !r.locked(now) {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// Blocked 报告远程地址当前是否被锁定
+func (l *AuthLimiter) Blocked(addr net.Addr) bool {
+	return l.Locked(remoteIP(addr), "")
+}
+
+// Locked 报告IP或者该IP上的用户名当前是否被锁定，空的用户名会被忽略
+func (l *AuthLimiter) Locked(ip, username string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ip != "" && l.record(l.ips, ip, now).locked(now) {
+		return true
+	}
+	if username != "" && l.record(l.users, userKey(ip, username), now).locked(now) {
+		return true
+	}
+	return false
+}
+
+// Failure 记录一次认证失败，返回回复前需要等待的时间以及是否已经锁定
+func (l *AuthLimiter) Failure(ip, username string) (delay time.Duration, failures int, locked bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ips == nil {
+		l.ips = make(map[string]*authRecord)
+		l.users = make(map[string]*authRecord)
+	}
+	l.sweep(now)
+
+	add := func(m map[string]*authRecord, key string) *authRecord {
+		r := l.record(m, key, now)
+		if r == nil {
+			r = &authRecord{}
+			m[key] = r
+		}
+		if r.locked(now) {
+			locked = true
+			return r
+		}
+		r.failures++
+		r.last = now
+		if r.failures >= l.maxFailures() {
+			r.lockedUntil = now.Add(l.lockout())
+			locked = true
+		}
+		return r
+	}
+
+	var r *authRecord
+	if ip != "" {
+		r = add(l.ips, ip)
+		failures = r.failures
+	}
+	if username != "" {
+		ur := add(l.users, userKey(ip, username))
+		if r == nil || ur.failures > r.failures {
+			r = ur
+		}
+		if failures == 0 {
+			failures = ur.failures
+		}
+	}
+	if r == nil {
+		return 0, 0, false
+	}
+
+	delay = l.delay()
+	if delay < 0 {
+		return 0, failures, locked
+	}
+	maxDelay := l.maxDelay()
+	for i := 1; i < r.failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay, failures, locked
+}
+
+// Success 认证成功后清除IP和用户名的失败记录
+func (l *AuthLimiter) Success(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.ips, ip)
+	delete(l.users, userKey(ip, username))
+}
+
+// authFailed 记录认证失败，等待递增的延迟后回复错误，失败次数计入协议错误
+func (c *Conn) authFailed(mech string, err error, code int, ec EnhancedCode, msg string) {
+	locked := false
+	if l := c.server.AuthLimiter; l != nil {
+		ip := remoteIP(c.conn.RemoteAddr())
+		var delay time.Duration
+		var failures int
+		delay, failures, locked = l.Failure(ip, c.authUser)
+		if l.OnFailure != nil {
+			l.OnFailure(AuthEvent{
+				Time:       time.Now(),
+				RemoteAddr: c.conn.RemoteAddr(),
+				IP:         ip,
+				Username:   c.authUser,
+				Mechanism:  mech,
+				Failures:   failures,
+				Locked:     locked,
+				Err:        err,
+			})
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+
+	if locked {
+		c.reply(421, EnhancedCode{4, 7, 0}, ReplyAuthLocked)
+		c.Close()
+		return
+	}
+	c.protocolError(code, ec, msg)
+}
@@ -0,0 +1,166 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
+)
+
+// authTestBackend 接受任何通过服务端校验的凭据，记录会话收到的认证次数
+type authTestBackend struct {
+	mu    sync.Mutex
+	auths int
+}
+
+func (be *authTestBackend) NewSession(ConnectionState) (Session, error) {
+	return &authTestSession{be}, nil
+}
+
+func (be *authTestBackend) count() int {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	return be.auths
+}
+
+type authTestSession struct {
+	be *authTestBackend
+}
+
+func (s *authTestSession) AuthMechanisms() []string {
+	return []string{sasl.ScramSHA256, sasl.CramMD5, sasl.XOAuth2}
+}
+
+func (s *authTestSession) Auth(mech string, cred Credential) error {
+	s.be.mu.Lock()
+	s.be.auths++
+	s.be.mu.Unlock()
+	return nil
+}
+
+func (s *authTestSession) Reset()                          {}
+func (s *authTestSession) Logout() error                   { return nil }
+func (s *authTestSession) Mail(string, *MailOptions) error { return nil }
+func (s *authTestSession) Rcpt(string) error               { return nil }
+func (s *authTestSession) Data(r io.Reader) error          { return nil }
+
+type scramTestStore map[string]*sasl.ScramCredentials
+
+func (s scramTestStore) ScramCredentials(mech, username string) (*sasl.ScramCredentials, error) {
+	if creds, ok := s[username]; ok {
+		return creds, nil
+	}
+	return nil, errors.New("unknown user")
+}
+
+// tokenTestValidator 只接受令牌 "secret"
+type tokenTestValidator struct{}
+
+func (tokenTestValidator) ValidateToken(username, token string) (string, error) {
+	if token != "secret" {
+		return "", errors.New("invalid token")
+	}
+	return username, nil
+}
+
+func TestAuthLimiterMechanisms(t *testing.T) {
+	creds, err := sasl.NewScramCredentials(sasl.ScramSHA256, "secret", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mechs := []struct {
+		name   string
+		client func(username, password string) sasl.Client
+	}{
+		{sasl.ScramSHA256, func(username, password string) sasl.Client {
+			return sasl.NewScramClient(sasl.ScramSHA256, username, password, nil)
+		}},
+		{sasl.CramMD5, sasl.NewCramMD5Client},
+		{sasl.XOAuth2, sasl.NewXOAuth2Client},
+	}
+	for _, mech := range mechs {
+		t.Run(mech.name, func(t *testing.T) {
+			be := &authTestBackend{}
+			limiter := &AuthLimiter{MaxFailures: 3, Delay: -1}
+			var events []AuthEvent
+			limiter.OnFailure = func(e AuthEvent) { events = append(events, e) }
+
+			s := NewServer(be)
+			s.Domain = "localhost"
+			s.AllowInsecureAuth = true
+			s.AuthLimiter = limiter
+			s.EnableScramAuth(scramTestStore{"alice": creds})
+			s.EnableCramMD5Auth(func(username string) (*sasl.CramMD5Secret, error) {
+				if username != "alice" {
+					return nil, errors.New("unknown user")
+				}
+				return &sasl.CramMD5Secret{Password: "secret"}, nil
+			})
+			s.EnableOAuthAuth(tokenTestValidator{})
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.Serve(l)
+			defer s.Close()
+
+			auth := func(username, password string) error {
+				c, err := Dial(l.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				return c.Auth(mech.client(username, password))
+			}
+
+			if err := auth("alice", "secret"); err != nil {
+				t.Fatalf("Auth with valid credentials = %v", err)
+			}
+			if err := auth("alice", "wrong"); err == nil {
+				t.Fatal("Auth with wrong password succeeded")
+			}
+			if len(events) != 1 || events[0].Username != "alice" {
+				t.Fatalf("failure events = %+v, want one event for alice", events)
+			}
+
+			// 只锁定该IP上的 alice，密码正确也不能通过，会话不会收到凭据
+			for i := 0; i < limiter.MaxFailures; i++ {
+				limiter.Failure("127.0.0.1", "alice")
+			}
+			limiter.Success("127.0.0.1", "")
+			if !limiter.Locked("127.0.0.1", "alice") || limiter.Locked("127.0.0.1", "") {
+				t.Fatal("alice should be locked without locking the IP")
+			}
+			if err := auth("alice", "secret"); err == nil {
+				t.Fatal("Auth for locked user succeeded")
+			}
+			if n := be.count(); n != 1 {
+				t.Errorf("session received %d credentials, want 1", n)
+			}
+		})
+	}
+}
+
+func TestAuthLimiterZeroValue(t *testing.T) {
+	l := &AuthLimiter{}
+	for i := 1; i <= defaultAuthMaxFailures; i++ {
+		delay, failures, locked := l.Failure("192.0.2.1", "alice")
+		if failures != i {
+			t.Fatalf("failure %d: failures = %d", i, failures)
+		}
+		if locked != (i == defaultAuthMaxFailures) {
+			t.Fatalf("failure %d: locked = %v", i, locked)
+		}
+		if i == 1 && delay != defaultAuthDelay {
+			t.Errorf("first delay = %v, want %v", delay, defaultAuthDelay)
+		}
+	}
+	if !l.Locked("192.0.2.1", "") {
+		t.Error("IP not locked after default MaxFailures")
+	}
+}
@@ -6,9 +6,9 @@ import (
 
 var (
 	ErrAuthRequired = &SMTPError{
-		Code:         502,
+		Code:         530,
 		EnhancedCode: EnhancedCode{5, 7, 0},
-		Message:      "Please authenticate first",
+		Message:      "Authentication required",
 	}
 	ErrAuthUnsupported = &SMTPError{
 		Code:         502,
@@ -40,15 +40,26 @@ type MailOptions struct {
 }
 
 // Session 会话接口
+//
+// 需要认证的会话还要实现 AuthSession。
+//
+// 不兼容变更：AuthPlain 已经从 Session 中移除，只实现 AuthPlain 的会话通过 PlainAuthAdapter 继续使用。
 type Session interface {
 	Reset()                                    // 启用当前的消息
 	Logout() error                             // 注销
-	AuthPlain(username, password string) error // 权限校验
 	Mail(from string, opts *MailOptions) error // 发件人
 	Rcpt(to string) error                      // 收件人
 	Data(r io.Reader) error                    // 读取数据
 }
 
+// DataOptionsSession 会话可选实现的接口
+//
+// 服务在调用 Data 或者 LMTPData 之前调用 DataOptions，传入当前事务 MAIL 命令的参数，
+// 便于保存邮件时读取 REQUIRETLS 等标记，转发时把保存的参数传给 Relay.Deliver 继续遵守。
+type DataOptionsSession interface {
+	DataOptions(opts *MailOptions)
+}
+
 // LMTPSession 会话
 type LMTPSession interface {
 	LMTPData(r io.Reader, status StatusCollector) error
@@ -3,6 +3,7 @@ package backendutil
 import (
 	"io"
 
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
 	"github.com/zhangdapeng520/zdpgo_smtp/smtp"
 )
 
@@ -31,8 +32,17 @@ func (s *transformSession) Reset() {
 	s.Session.Reset()
 }
 
+func (s *transformSession) AuthMechanisms() []string {
+	return smtp.AuthMechanisms(s.Session)
+}
+
+func (s *transformSession) Auth(mech string, cred smtp.Credential) error {
+	return smtp.Authenticate(s.Session, mech, cred)
+}
+
+// AuthPlain 保留给直接调用 AuthPlain 的旧代码
 func (s *transformSession) AuthPlain(username, password string) error {
-	return s.Session.AuthPlain(username, password)
+	return smtp.Authenticate(s.Session, sasl.Plain, &smtp.PlainCredential{Username: username, Password: password})
 }
 
 func (s *transformSession) Mail(from string, opts *smtp.MailOptions) error {
@@ -68,6 +78,40 @@ func (s *transformSession) Data(r io.Reader) error {
 	return s.Session.Data(r)
 }
 
+func (s *transformSession) DataOptions(opts *smtp.MailOptions) {
+	if sess, ok := s.Session.(smtp.DataOptionsSession); ok {
+		sess.DataOptions(opts)
+	}
+}
+
+func (s *transformSession) SetAuthUser(username string) {
+	if sess, ok := s.Session.(smtp.AuthUserSession); ok {
+		sess.SetAuthUser(username)
+	}
+}
+
+func (s *transformSession) Verify(user string) (string, error) {
+	if sess, ok := s.Session.(smtp.VerifySession); ok {
+		return sess.Verify(user)
+	}
+	return "", &smtp.SMTPError{
+		Code:         252,
+		EnhancedCode: smtp.EnhancedCode{2, 5, 0},
+		Message:      "Cannot VRFY user, but will accept message",
+	}
+}
+
+func (s *transformSession) Expand(list string) ([]string, error) {
+	if sess, ok := s.Session.(smtp.ExpandSession); ok {
+		return sess.Expand(list)
+	}
+	return nil, &smtp.SMTPError{
+		Code:         502,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "EXPN not implemented",
+	}
+}
+
 func (s *transformSession) Logout() error {
 	return s.Session.Logout()
 }
@@ -0,0 +1,150 @@
+package smtp
+
+import (
+	"net/textproto"
+	"strconv"
+)
+
+const (
+	defaultChunkSize = 256 * 1024
+	// Maximum number of BDAT chunks sent before waiting for their replies
+	// when the server supports PIPELINING.
+	maxPendingChunks = 8
+)
+
+// chunking reports whether messages should be sent with BDAT.
+func (c *Client) chunking() bool {
+	_, ok := c.ext["CHUNKING"]
+	return ok
+}
+
+// bdatWriter sends the message as a sequence of BDAT chunks (RFC 3030).
+type bdatWriter struct {
+	c         *Client
+	buf       []byte
+	pending   int // chunks whose replies have not been read yet
+	pipelined bool
+	replyCb   replyFunc
+	err       error
+	closed    bool
+}
+
+func (c *Client) newBdatWriter(replyCb replyFunc) *bdatWriter {
+	size := c.ChunkSize
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	_, pipelined := c.ext["PIPELINING"]
+	return &bdatWriter{
+		c:         c,
+		buf:       make([]byte, 0, size),
+		pipelined: pipelined,
+		replyCb:   replyCb,
+	}
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.sendChunk(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close sends the last chunk and waits for the final reply, or for one reply
+// per recipient in LMTP mode.
+func (w *bdatWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.sendChunk(true); err != nil {
+		return err
+	}
+
+	// Replies to the previous chunks come before the final reply.
+	w.c.setDeadline(w.c.CommandTimeout)
+	defer w.c.clearDeadline()
+	for w.pending > 1 {
+		if err := w.readReply(); err != nil {
+			return err
+		}
+	}
+	w.pending = 0
+	return w.c.readDataReplies(w.replyCb)
+}
+
+func (w *bdatWriter) sendChunk(last bool) error {
+	w.c.setDeadline(w.c.CommandTimeout)
+	defer w.c.clearDeadline()
+
+	cmd := "BDAT " + strconv.Itoa(len(w.buf))
+	if last {
+		cmd += " LAST"
+	}
+	_, err := w.c.Text.W.WriteString(cmd + "\r\n")
+	if err == nil {
+		_, err = w.c.Text.W.Write(w.buf)
+	}
+	if err == nil {
+		err = w.c.Text.W.Flush()
+	}
+	w.buf = w.buf[:0]
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.pending++
+
+	if last {
+		return nil
+	}
+	max := 1
+	if w.pipelined {
+		max = maxPendingChunks
+	}
+	for w.pending >= max {
+		if err := w.readReply(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readReply reads the reply to the oldest pending chunk. Once a chunk has
+// been rejected the server discards the transaction, the replies to the
+// remaining pending chunks are read to keep the connection in sync.
+func (w *bdatWriter) readReply() error {
+	_, _, err := w.c.Text.ReadResponse(250)
+	w.pending--
+	if err == nil {
+		return nil
+	}
+	if protoErr, ok := err.(*textproto.Error); ok {
+		err = toSMTPErr(protoErr)
+		for w.pending > 0 {
+			w.pending--
+			if _, _, rerr := w.c.Text.ReadResponse(250); rerr != nil {
+				if _, ok := rerr.(*textproto.Error); !ok {
+					break
+				}
+			}
+		}
+	}
+	w.err = err
+	return err
+}
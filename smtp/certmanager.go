@@ -0,0 +1,325 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// CertFile 证书和私钥文件
+type CertFile struct {
+	Name     string // 主机名，为空时只使用证书中的名称
+	CertFile string
+	KeyFile  string
+}
+
+// 目录中可以识别的证书文件名，兼容 certbot 的 live 目录
+var certDirLayouts = []CertFile{
+	{CertFile: "bundle.pem", KeyFile: "bundle.pem"}, // 私钥和证书链在同一个文件中，ACMEManager 使用
+	{CertFile: "fullchain.pem", KeyFile: "privkey.pem"},
+	{CertFile: "cert.pem", KeyFile: "key.pem"},
+	{CertFile: "tls.crt", KeyFile: "tls.key"},
+}
+
+// CertManager 证书管理器
+//
+// 证书从目录或者 Files 中加载，握手时根据SNI选择证书，找不到匹配的证书时使用默认证书。
+// 文件发生变化或者收到 SIGHUP 信号时重新加载证书，已经建立的连接不受影响。
+// 重新加载时某一套证书无法加载的话记录日志，这套证书继续使用原来的内容，不影响其它证书。
+type CertManager struct {
+	// 证书目录，每个子目录包含一套证书（例如 fullchain.pem 和 privkey.pem），
+	// 或者直接在目录中放置 <name>.crt 和 <name>.key
+	Dir string
+	// 额外的证书文件，Name 和目录中的证书相同时替换目录中的证书
+	Files []CertFile
+	// 默认证书的主机名，为空时使用按名称排序后的第一个证书
+	Default string
+	// 检查文件变化的间隔，默认1分钟
+	Interval time.Duration
+	ErrorLog Logger
+
+	locker   sync.RWMutex
+	certs    map[string]*tls.Certificate
+	def      *tls.Certificate
+	modTimes map[string]time.Time
+	loaded   map[CertFile]*tls.Certificate // 上次加载成功的证书
+}
+
+// NewCertManager 创建证书管理器并加载证书，任意一套证书无法加载时返回错误
+func NewCertManager(dir string, files []CertFile, def string) (*CertManager, error) {
+	m := &CertManager{
+		Dir:     dir,
+		Files:   files,
+		Default: def,
+	}
+	if err := m.Load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// TLSConfig 返回通过 GetCertificate 选择证书的TLS配置
+func (m *CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+	}
+}
+
+// GetCertificate 根据SNI选择证书，可以直接用于 tls.Config.GetCertificate
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.locker.RLock()
+	defer m.locker.RUnlock()
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if name != "" {
+		if cert, ok := m.certs[name]; ok {
+			return cert, nil
+		}
+		// 通配符证书
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := m.certs["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	if m.def == nil {
+		return nil, errors.New("smtp: 没有可用的证书")
+	}
+	return m.def, nil
+}
+
+// Load 重新加载所有证书
+//
+// 第一次加载时任意一套证书无法加载都返回错误。之后重新加载时跳过无法加载的证书并记录日志，
+// 之前加载成功的同一套证书继续使用；没有找到任何证书或者默认证书时返回错误并保留原来的证书。
+func (m *CertManager) Load() error {
+	m.locker.RLock()
+	initial, loaded := m.certs == nil, m.loaded
+	m.locker.RUnlock()
+
+	certs := make(map[string]*tls.Certificate)
+	modTimes := make(map[string]time.Time)
+	newLoaded := make(map[CertFile]*tls.Certificate)
+	var first *tls.Certificate
+
+	add := func(f CertFile) error {
+		// 加载失败时同样记录修改时间，文件再次变化时才重新尝试
+		for _, p := range []string{f.CertFile, f.KeyFile} {
+			if fi, err := os.Stat(p); err == nil {
+				modTimes[p] = fi.ModTime()
+			}
+		}
+		cert, err := loadCertFile(f)
+		if err != nil {
+			if initial {
+				return err
+			}
+			prev, ok := loaded[f]
+			if !ok {
+				m.logf("%s，跳过这套证书", err)
+				return nil
+			}
+			m.logf("%s，继续使用原来的证书", err)
+			cert = prev
+		}
+		newLoaded[f] = cert
+
+		if f.Name != "" {
+			certs[strings.ToLower(f.Name)] = cert
+		}
+		for _, dnsName := range cert.Leaf.DNSNames {
+			dnsName = strings.ToLower(dnsName)
+			if _, ok := certs[dnsName]; !ok {
+				certs[dnsName] = cert
+			}
+		}
+		if first == nil {
+			first = cert
+		}
+		return nil
+	}
+
+	files, err := m.scanDir()
+	if err != nil {
+		return err
+	}
+	// Files 中的同名证书替换目录中的证书
+	for _, f := range m.Files {
+		if f.Name == "" {
+			continue
+		}
+		for i := range files {
+			if strings.EqualFold(files[i].Name, f.Name) {
+				files = append(files[:i], files[i+1:]...)
+				break
+			}
+		}
+	}
+	files = append(files, m.Files...)
+	// 按名称排序加载，默认证书和重复的证书名称不受配置顺序影响，没有名称的证书保持原来的顺序
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	for _, f := range files {
+		if err := add(f); err != nil {
+			return err
+		}
+	}
+	if len(certs) == 0 {
+		return errors.New("smtp: 没有找到证书")
+	}
+
+	def := first
+	if m.Default != "" {
+		cert, ok := certs[strings.ToLower(m.Default)]
+		if !ok {
+			return fmt.Errorf("smtp: 没有找到默认证书 %s", m.Default)
+		}
+		def = cert
+	}
+
+	m.locker.Lock()
+	m.certs = certs
+	m.def = def
+	m.modTimes = modTimes
+	m.loaded = newLoaded
+	m.locker.Unlock()
+	return nil
+}
+
+func (m *CertManager) logf(format string, v ...interface{}) {
+	if m.ErrorLog != nil {
+		m.ErrorLog.Printf(format, v...)
+	}
+}
+
+// loadCertFile 加载一套证书并解析叶子证书
+func loadCertFile(f CertFile) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: 加载证书 %s 失败: %w", f.CertFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("smtp: 解析证书 %s 失败: %w", f.CertFile, err)
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// scanDir 扫描证书目录，证书的名称为子目录名或者去掉扩展名的文件名
+func (m *CertManager) scanDir() ([]CertFile, error) {
+	var files []CertFile
+	if m.Dir == "" {
+		return files, nil
+	}
+	index := make(map[string]int)
+	add := func(f CertFile) {
+		if i, ok := index[f.Name]; ok {
+			files[i] = f
+			return
+		}
+		index[f.Name] = len(files)
+		files = append(files, f)
+	}
+
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		p := filepath.Join(m.Dir, entry.Name())
+		if entry.IsDir() {
+			for _, layout := range certDirLayouts {
+				f := CertFile{
+					Name:     entry.Name(),
+					CertFile: filepath.Join(p, layout.CertFile),
+					KeyFile:  filepath.Join(p, layout.KeyFile),
+				}
+				if fileExists(f.CertFile) && fileExists(f.KeyFile) {
+					add(f)
+					break
+				}
+			}
+			continue
+		}
+
+		ext := filepath.Ext(entry.Name())
+		if ext != ".crt" && ext != ".pem" {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ext)
+		keyFile := filepath.Join(m.Dir, name+".key")
+		if fileExists(keyFile) {
+			add(CertFile{Name: name, CertFile: p, KeyFile: keyFile})
+		}
+	}
+	return files, nil
+}
+
+// changed 判断证书文件是否发生了变化
+func (m *CertManager) changed() bool {
+	m.locker.RLock()
+	defer m.locker.RUnlock()
+
+	for p, modTime := range m.modTimes {
+		fi, err := os.Stat(p)
+		if err != nil || !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+
+	// 证书目录中新增了证书
+	if files, err := m.scanDir(); err == nil {
+		for _, f := range files {
+			if _, ok := m.modTimes[f.CertFile]; !ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Watch 监听文件变化和 SIGHUP 信号并重新加载证书，直到 stop 被关闭
+func (m *CertManager) Watch(stop <-chan struct{}) {
+	interval := m.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+		case <-ticker.C:
+			if !m.changed() {
+				continue
+			}
+		}
+
+		if err := m.Load(); err != nil {
+			if m.ErrorLog != nil {
+				m.ErrorLog.Printf("重新加载证书失败: %s", err)
+			}
+		}
+	}
+}
+
+func fileExists(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && !fi.IsDir()
+}
@@ -0,0 +1,97 @@
+package smtp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert 在 dir 中写入 host 的自签名证书和私钥
+func writeTestCert(t *testing.T, dir, host string) CertFile {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := CertFile{
+		CertFile: filepath.Join(dir, host+".crt"),
+		KeyFile:  filepath.Join(dir, host+".key"),
+	}
+	if err := os.WriteFile(f.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestCertManagerFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []CertFile{writeTestCert(t, dir, "a.example.com"), writeTestCert(t, dir, "b.example.com")}
+
+	// 没有名称的多套证书都会加载
+	m, err := NewCertManager("", files, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func(host string) *big.Int {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cert.Leaf.VerifyHostname(host); err != nil {
+			t.Fatalf("certificate for %s: %v", host, err)
+		}
+		return cert.Leaf.SerialNumber
+	}
+	oldA := serial("a.example.com")
+	oldB := serial("b.example.com")
+
+	// 重新加载时损坏的证书保留原来的内容，其它证书正常更新
+	if err := os.WriteFile(files[0].CertFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCert(t, dir, "b.example.com")
+	if err := m.Load(); err != nil {
+		t.Fatalf("Load with one broken pair = %v", err)
+	}
+	if serial("a.example.com").Cmp(oldA) != 0 {
+		t.Error("broken certificate was not kept")
+	}
+	if serial("b.example.com").Cmp(oldB) == 0 {
+		t.Error("healthy certificate was not reloaded")
+	}
+
+	// 第一次加载时任意证书损坏都返回错误
+	if _, err := NewCertManager("", files, ""); err == nil {
+		t.Error("NewCertManager with a broken pair succeeded")
+	}
+}
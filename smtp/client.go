@@ -5,6 +5,7 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -14,6 +15,7 @@ import (
 	"net/textproto"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
@@ -28,6 +30,10 @@ type Client struct {
 	// keep a reference to the connection so it can be used to create a TLS
 	// connection later
 	conn net.Conn
+	// deadline of the context of the running *Context call, protected by
+	// deadlineMu since it is changed when the context is cancelled
+	ctxDeadline time.Time
+	deadlineMu  sync.Mutex
 	// whether the Client is using TLS
 	tls        bool
 	serverName string
@@ -40,6 +46,7 @@ type Client struct {
 	didHello   bool     // whether we've said HELO/EHLO/LHLO
 	helloError error    // the error from the hello
 	rcpts      []string // recipients accumulated for the current session
+	utf8       bool     // whether the current transaction declared SMTPUTF8
 
 	// Time to wait for command responses (this includes 3xx reply to DATA).
 	CommandTimeout time.Duration
@@ -48,6 +55,10 @@ type Client struct {
 
 	// Logger for all network activity.
 	DebugWriter io.Writer
+
+	// Size of the chunks sent with BDAT when the server supports CHUNKING.
+	// Defaults to 256KiB.
+	ChunkSize int
 }
 
 // 30 seconds was chosen as it's the
@@ -57,12 +68,7 @@ var defaultTimeout = 30 * time.Second
 // Dial returns a new Client connected to an SMTP server at addr.
 // The addr must include a port, as in "mail.example.com:smtp".
 func Dial(addr string) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", addr, defaultTimeout)
-	if err != nil {
-		return nil, err
-	}
-	host, _, _ := net.SplitHostPort(addr)
-	return NewClient(conn, host)
+	return DialContext(context.Background(), addr)
 }
 
 // DialTLS returns a new Client connected to an SMTP server via TLS at addr.
@@ -70,23 +76,21 @@ func Dial(addr string) (*Client, error) {
 //
 // A nil tlsConfig is equivalent to a zero tls.Config.
 func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
-	tlsDialer := tls.Dialer{
-		NetDialer: &net.Dialer{
-			Timeout: defaultTimeout,
-		},
-		Config: tlsConfig,
-	}
-	conn, err := tlsDialer.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
-	host, _, _ := net.SplitHostPort(addr)
-	return NewClient(conn, host)
+	return DialTLSContext(context.Background(), addr, tlsConfig)
 }
 
 // NewClient returns a new Client using an existing connection and host as a
 // server name to be used when authenticating.
 func NewClient(conn net.Conn, host string) (*Client, error) {
+	c := newClient(conn, host)
+	if err := c.greet(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newClient returns a Client for conn without reading the server greeting.
+func newClient(conn net.Conn, host string) *Client {
 	c := &Client{
 		serverName: host,
 		localName:  "localhost",
@@ -100,21 +104,24 @@ func NewClient(conn net.Conn, host string) (*Client, error) {
 	}
 
 	c.setConn(conn)
+	return c
+}
 
+// greet reads the server greeting, the connection is closed on failure.
+func (c *Client) greet() error {
 	// Initial greeting timeout. RFC 5321 recommends 5 minutes.
-	c.conn.SetDeadline(time.Now().Add(5 * time.Minute))
-	defer c.conn.SetDeadline(time.Time{})
+	c.setDeadline(5 * time.Minute)
+	defer c.clearDeadline()
 
 	_, _, err := c.Text.ReadResponse(220)
 	if err != nil {
 		c.Text.Close()
 		if protoErr, ok := err.(*textproto.Error); ok {
-			return nil, toSMTPErr(protoErr)
+			return toSMTPErr(protoErr)
 		}
-		return nil, err
+		return err
 	}
-
-	return c, nil
+	return nil
 }
 
 // NewClientLMTP returns a new LMTP Client (as defined in RFC 2033) using an
@@ -197,8 +204,8 @@ func (c *Client) Hello(localName string) error {
 // cmd is a convenience function that sends a command and returns the response
 // textproto.Error returned by c.Text.ReadResponse is converted into SMTPError.
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
-	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
-	defer c.conn.SetDeadline(time.Time{})
+	c.setDeadline(c.CommandTimeout)
+	defer c.clearDeadline()
 
 	id, err := c.Text.Cmd(format, args...)
 	if err != nil {
@@ -339,7 +346,8 @@ func (c *Client) Auth(a sasl.Client) error {
 			// the last message isn't base64 because it isn't a challenge
 			msg = []byte(msg64)
 		default:
-			err = toSMTPErr(&textproto.Error{Code: code, Msg: msg64})
+			// the server already ended the exchange, there is nothing to abort
+			return toSMTPErr(&textproto.Error{Code: code, Msg: msg64})
 		}
 		if err == nil {
 			if code == 334 {
@@ -371,33 +379,89 @@ func (c *Client) Auth(a sasl.Client) error {
 // If opts is not nil, MAIL arguments provided in the structure will be added
 // to the command. Handling of unsupported options depends on the extension.
 //
+// A sender address containing non-ASCII characters implies SMTPUTF8 when the
+// server supports it. Otherwise internationalized domains are converted to
+// punycode, and addresses with a non-ASCII local part fail with
+// ErrUTF8Downgrade. Rcpt applies the same rules to recipients.
+//
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Mail(from string, opts *MailOptions) error {
-	if err := validateLine(from); err != nil {
+	cmdStr, err := c.mailCmd(from, opts)
+	if err != nil {
 		return err
 	}
-	if err := c.hello(); err != nil {
+	if _, _, err = c.cmd(250, "%s", cmdStr); err != nil {
 		return err
 	}
-	cmdStr := "MAIL FROM:<%s>"
-	if _, ok := c.ext["8BITMIME"]; ok {
+	c.rcpts = nil
+	return nil
+}
+
+// mailCmd builds the MAIL command line for the given sender and options.
+func (c *Client) mailCmd(from string, opts *MailOptions) (string, error) {
+	if err := validateLine(from); err != nil {
+		return "", err
+	}
+	if err := c.hello(); err != nil {
+		return "", err
+	}
+	opts = c.utf8Options(opts, from)
+	c.utf8 = opts != nil && opts.UTF8
+	from, err := c.envelopeAddress(from)
+	if err != nil {
+		return "", err
+	}
+	path, err := formatPath(from, true)
+	if err != nil {
+		return "", err
+	}
+	cmdStr := "MAIL FROM:" + path
+	var body BodyType
+	if opts != nil {
+		body = opts.Body
+	}
+	switch body {
+	case "":
+		if _, ok := c.ext["8BITMIME"]; ok {
+			cmdStr += " BODY=8BITMIME"
+		}
+	case Body7Bit:
+	case Body8BitMIME:
+		if _, ok := c.ext["8BITMIME"]; !ok {
+			return "", errors.New("smtp: server does not support 8BITMIME")
+		}
 		cmdStr += " BODY=8BITMIME"
+	case BodyBinaryMIME:
+		// BINARYMIME messages can only be sent with BDAT
+		_, binary := c.ext["BINARYMIME"]
+		_, chunking := c.ext["CHUNKING"]
+		if !binary || !chunking {
+			return "", errors.New("smtp: server does not support BINARYMIME")
+		}
+		cmdStr += " BODY=BINARYMIME"
+	default:
+		return "", fmt.Errorf("smtp: unknown BODY type %q", body)
 	}
 	if _, ok := c.ext["SIZE"]; ok && opts != nil && opts.Size != 0 {
 		cmdStr += " SIZE=" + strconv.Itoa(opts.Size)
 	}
 	if opts != nil && opts.RequireTLS {
-		if _, ok := c.ext["REQUIRETLS"]; ok {
-			cmdStr += " REQUIRETLS"
-		} else {
-			return errors.New("smtp: server does not support REQUIRETLS")
+		// Per RFC 8689 the message may only be relayed over a verified TLS
+		// session to a server that supports REQUIRETLS.
+		state, ok := c.TLSConnectionState()
+		if !ok || !verifiedTLS(state) {
+			return "", ErrRequireTLS
 		}
+		if _, ok := c.ext["REQUIRETLS"]; !ok {
+			return "", ErrRequireTLS
+		}
+		cmdStr += " REQUIRETLS"
 	}
 	if opts != nil && opts.UTF8 {
 		if _, ok := c.ext["SMTPUTF8"]; ok {
 			cmdStr += " SMTPUTF8"
 		} else {
-			return errors.New("smtp: server does not support SMTPUTF8")
+			return "", ErrSMTPUTF8Unsupported
 		}
 	}
 	if opts != nil && opts.Auth != nil {
@@ -406,8 +470,7 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 		}
 		// We can safely discard parameter if server does not support AUTH.
 	}
-	_, _, err := c.cmd(250, cmdStr, from)
-	return err
+	return cmdStr, nil
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
@@ -419,7 +482,15 @@ func (c *Client) Rcpt(to string) error {
 	if err := validateLine(to); err != nil {
 		return err
 	}
-	if _, _, err := c.cmd(25, "RCPT TO:<%s>", to); err != nil {
+	addr, err := c.envelopeAddress(to)
+	if err != nil {
+		return err
+	}
+	path, err := formatPath(addr, false)
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(25, "RCPT TO:%s", path); err != nil {
 		return err
 	}
 	c.rcpts = append(c.rcpts, to)
@@ -429,43 +500,70 @@ func (c *Client) Rcpt(to string) error {
 type dataCloser struct {
 	c *Client
 	io.WriteCloser
-	statusCb func(rcpt string, status *SMTPError)
+	replyCb replyFunc
 }
 
 func (d *dataCloser) Close() error {
 	d.WriteCloser.Close()
+	return d.c.readDataReplies(d.replyCb)
+}
 
-	d.c.conn.SetDeadline(time.Now().Add(d.c.SubmissionTimeout))
-	defer d.c.conn.SetDeadline(time.Time{})
-
-	expectedResponses := len(d.c.rcpts)
-	if d.c.lmtp {
-		for expectedResponses > 0 {
-			rcpt := d.c.rcpts[len(d.c.rcpts)-expectedResponses]
-			if _, _, err := d.c.Text.ReadResponse(250); err != nil {
-				if protoErr, ok := err.(*textproto.Error); ok {
-					if d.statusCb != nil {
-						d.statusCb(rcpt, toSMTPErr(protoErr))
-					}
-				} else {
-					return err
-				}
-			} else if d.statusCb != nil {
-				d.statusCb(rcpt, nil)
-			}
-			expectedResponses--
-		}
+// replyFunc receives the replies sent once the whole message has been
+// received. rcpt is empty for the single SMTP reply and set to the recipient
+// for each LMTP reply. reply is never nil, positive replies have a 2xx code.
+type replyFunc func(rcpt string, reply *SMTPError)
+
+// statusReplyFunc adapts an LMTP status callback to a replyFunc.
+func statusReplyFunc(statusCb func(rcpt string, status *SMTPError)) replyFunc {
+	if statusCb == nil {
 		return nil
-	} else {
-		_, _, err := d.c.Text.ReadResponse(250)
+	}
+	return func(rcpt string, reply *SMTPError) {
+		if rcpt == "" {
+			return
+		}
+		if reply.Code/100 == 2 {
+			reply = nil
+		}
+		statusCb(rcpt, reply)
+	}
+}
+
+// readDataReplies reads the replies sent once the whole message has been
+// received: one reply in SMTP mode, one reply per recipient in LMTP mode.
+func (c *Client) readDataReplies(replyCb replyFunc) error {
+	c.setDeadline(c.SubmissionTimeout)
+	defer c.clearDeadline()
+
+	expectedResponses := 1
+	if c.lmtp {
+		expectedResponses = len(c.rcpts)
+	}
+	for i := 0; i < expectedResponses; i++ {
+		code, msg, err := c.Text.ReadResponse(250)
+		var reply *SMTPError
 		if err != nil {
-			if protoErr, ok := err.(*textproto.Error); ok {
-				return toSMTPErr(protoErr)
+			protoErr, ok := err.(*textproto.Error)
+			if !ok {
+				return err
 			}
-			return err
+			reply = toSMTPErr(protoErr)
+		} else {
+			reply = toSMTPErr(&textproto.Error{Code: code, Msg: msg})
+		}
+
+		rcpt := ""
+		if c.lmtp {
+			rcpt = c.rcpts[i]
+		}
+		if replyCb != nil {
+			replyCb(rcpt, reply)
+		}
+		if err != nil && !c.lmtp {
+			return reply
 		}
-		return nil
 	}
+	return nil
 }
 
 // Data issues a DATA command to the server and returns a writer that
@@ -473,13 +571,23 @@ func (d *dataCloser) Close() error {
 // close the writer before calling any more methods on c. A call to
 // Data must be preceded by one or more calls to Rcpt.
 //
+// If the server advertises CHUNKING, the message is sent with BDAT instead
+// and is not dot-stuffed, which is required for BINARYMIME bodies.
+//
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Data() (io.WriteCloser, error) {
+	return c.data(nil)
+}
+
+func (c *Client) data(replyCb replyFunc) (io.WriteCloser, error) {
+	if c.chunking() {
+		return c.newBdatWriter(replyCb), nil
+	}
 	_, _, err := c.cmd(354, "DATA")
 	if err != nil {
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter(), nil}, nil
+	return &dataCloser{c, c.Text.DotWriter(), replyCb}, nil
 }
 
 // LMTPData is the LMTP-specific version of the Data method. It accepts a callback
@@ -494,42 +602,209 @@ func (c *Client) LMTPData(statusCb func(rcpt string, status *SMTPError)) (io.Wri
 	if !c.lmtp {
 		return nil, errors.New("smtp: not a LMTP client")
 	}
-
-	_, _, err := c.cmd(354, "DATA")
-	if err != nil {
-		return nil, err
-	}
-	return &dataCloser{c, c.Text.DotWriter(), statusCb}, nil
+	return c.data(statusReplyFunc(statusCb))
 }
 
 // SendMail 发送邮件
 // @param from 发件人
 // @param to 收件人
 // @param r 邮件内容
+//
+// 服务支持 PIPELINING 时，MAIL、RCPT 和 DATA 命令一次性发送。
 func (c *Client) SendMail(from string, to []string, r io.Reader) error {
-	var err error
-
-	if err = c.Mail(from, nil); err != nil {
+	if _, err := c.send(from, to, r); err != nil {
 		return err
 	}
+	return c.Quit()
+}
+
+// send runs one mail transaction and leaves the connection open. reuse
+// reports whether the connection can be used for another transaction.
+func (c *Client) send(from string, to []string, r io.Reader) (reuse bool, err error) {
+	w, closed, err := c.envelope(from, nil, to)
+	if err != nil {
+		_, isSMTPErr := err.(*SMTPError)
+		return isSMTPErr && !closed, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return false, err
+	}
+	err = w.Close()
+	_, isSMTPErr := err.(*SMTPError)
+	return err == nil || isSMTPErr, err
+}
+
+// envelope 发送 MAIL、RCPT 和 DATA 命令，返回写入消息内容的 Writer，任意收件人被拒绝时返回错误，
+// closed 表示为了中止事务已经关闭了连接
+func (c *Client) envelope(from string, opts *MailOptions, to []string) (w io.WriteCloser, closed bool, err error) {
+	opts = c.utf8Options(opts, append([]string{from}, to...)...)
+	if ok, _ := c.Extension("PIPELINING"); !ok {
+		if err := c.Mail(from, opts); err != nil {
+			return nil, false, err
+		}
+		for _, addr := range to {
+			if err := c.Rcpt(addr); err != nil {
+				return nil, false, err
+			}
+		}
+		w, err := c.Data()
+		return w, false, err
+	}
+
+	res := newSendResult(to)
+	w, err = c.pipelinedEnvelope(from, opts, to, res, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, rcpt := range res.Recipients {
+		if rcpt.Err != nil {
+			if _, ok := w.(*dataCloser); ok {
+				// The server is already waiting for the message, closing the
+				// connection is the only way to abort the transaction.
+				c.Close()
+				closed = true
+			}
+			return nil, closed, rcpt.Err
+		}
+	}
+	return w, false, nil
+}
+
+// resultEnvelope 发送 MAIL、RCPT 和 DATA 命令，被拒绝的收件人记录在 res 中，
+// 至少有一个收件人被接受时返回写入消息内容的 Writer
+func (c *Client) resultEnvelope(from string, opts *MailOptions, to []string, res *SendResult) (io.WriteCloser, error) {
+	opts = c.utf8Options(opts, append([]string{from}, to...)...)
+	if ok, _ := c.Extension("PIPELINING"); ok {
+		return c.pipelinedEnvelope(from, opts, to, res, res.replyFunc())
+	}
+
+	if err := c.Mail(from, opts); err != nil {
+		return nil, err
+	}
+	for i, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			smtpErr, ok := err.(*SMTPError)
+			if !ok {
+				return nil, err
+			}
+			res.Recipients[i].Err = smtpErr
+		}
+	}
+	if err := res.noneAccepted(); err != nil {
+		return nil, err
+	}
+	return c.data(res.replyFunc())
+}
+
+// pipelinedEnvelope 按照 RFC 2920 一次写入 MAIL、全部 RCPT 和 DATA，再按顺序读取响应，
+// 被拒绝的收件人记录在 res 中
+func (c *Client) pipelinedEnvelope(from string, opts *MailOptions, to []string, res *SendResult, replyCb replyFunc) (io.WriteCloser, error) {
+	mailCmd, err := c.mailCmd(from, opts)
+	if err != nil {
+		return nil, err
+	}
+	cmds := []string{mailCmd}
+	expectCodes := []int{250}
 	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			return err
+		if err := validateLine(addr); err != nil {
+			return nil, err
 		}
+		addr, err := c.envelopeAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		path, err := formatPath(addr, false)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, "RCPT TO:"+path)
+		expectCodes = append(expectCodes, 25)
+	}
+	chunking := c.chunking()
+	if !chunking {
+		cmds = append(cmds, "DATA")
+		expectCodes = append(expectCodes, 354)
 	}
-	w, err := c.Data()
+
+	errs, err := c.pipeline(cmds, expectCodes)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var dataErr error
+	if !chunking {
+		dataErr = errs[len(errs)-1]
+	}
+	c.rcpts = nil
+	for i, addr := range to {
+		if err := errs[i+1]; err != nil {
+			res.Recipients[i].Err = err.(*SMTPError)
+		} else {
+			c.rcpts = append(c.rcpts, addr)
+		}
+	}
+
+	err = errs[0]
+	if err == nil {
+		err = res.noneAccepted()
 	}
-	_, err = io.Copy(w, r)
 	if err != nil {
-		return err
+		if !chunking && dataErr == nil {
+			// Some servers accept DATA without any recipient, the empty
+			// message is sent to end the transaction and then discarded.
+			w := &dataCloser{c, c.Text.DotWriter(), nil}
+			if cerr := w.Close(); cerr != nil {
+				if _, ok := cerr.(*SMTPError); !ok {
+					return nil, cerr
+				}
+			}
+		}
+		return nil, err
 	}
-	err = w.Close()
+
+	if chunking {
+		return c.newBdatWriter(replyCb), nil
+	}
+	if dataErr != nil {
+		return nil, dataErr
+	}
+	return &dataCloser{c, c.Text.DotWriter(), replyCb}, nil
+}
+
+// pipeline writes all commands at once and then reads one reply per command.
+// Negative replies are returned as *SMTPError in errs, other errors abort the
+// exchange.
+func (c *Client) pipeline(cmds []string, expectCodes []int) (errs []error, err error) {
+	c.setDeadline(c.CommandTimeout)
+	defer c.clearDeadline()
+
+	id := c.Text.Next()
+	c.Text.StartRequest(id)
+	for _, cmd := range cmds {
+		if _, err := c.Text.W.WriteString(cmd + "\r\n"); err != nil {
+			c.Text.EndRequest(id)
+			return nil, err
+		}
+	}
+	err = c.Text.W.Flush()
+	c.Text.EndRequest(id)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return c.Quit()
+
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	errs = make([]error, len(cmds))
+	for i, expectCode := range expectCodes {
+		if _, _, err := c.Text.ReadResponse(expectCode); err != nil {
+			protoErr, ok := err.(*textproto.Error)
+			if !ok {
+				return nil, err
+			}
+			errs[i] = toSMTPErr(protoErr)
+		}
+	}
+	return errs, nil
 }
 
 var testHookStartTLS func(*tls.Config) // nil, except for tests
@@ -570,20 +845,26 @@ func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader)
 	}
 	defer c.Close()
 
-	if err = c.hello(); err != nil {
+	return c.startAndSend(a, from, to, r)
+}
+
+// startAndSend switches to TLS, authenticates with the optional SASL client
+// and sends the message, as done by the package-level SendMail.
+func (c *Client) startAndSend(a sasl.Client, from string, to []string, r io.Reader) error {
+	if err := c.hello(); err != nil {
 		return err
 	}
 	if ok, _ := c.Extension("STARTTLS"); !ok {
 		return errors.New("smtp: server doesn't support STARTTLS")
 	}
-	if err = c.StartTLS(nil); err != nil {
+	if err := c.StartTLS(nil); err != nil {
 		return err
 	}
 	if a != nil && c.ext != nil {
 		if _, ok := c.ext["AUTH"]; !ok {
 			return errors.New("smtp: server doesn't support AUTH")
 		}
-		if err = c.Auth(a); err != nil {
+		if err := c.Auth(a); err != nil {
 			return err
 		}
 	}
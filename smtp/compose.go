@@ -0,0 +1,582 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// 头部折行的目标长度（RFC 5322 2.1.1）
+	maxHeaderLine = 78
+	// base64 编码每行的长度（RFC 2045 6.8）
+	maxBase64Line = 76
+)
+
+// MessageBuilder 构造 RFC 5322 邮件，WriteTo 以流的方式写出，可以直接写入 Client.Data
+//
+// 同时设置 Text 和 HTML 时生成 multipart/alternative，内嵌资源放在 multipart/related 中，
+// 附件放在最外层的 multipart/mixed 中。附件和内嵌资源在写出时才从 io.Reader 读取。
+type MessageBuilder struct {
+	From    *mail.Address
+	ReplyTo []*mail.Address
+	To      []*mail.Address
+	Cc      []*mail.Address
+	Bcc     []*mail.Address // 只出现在 Recipients 中，不写入头部
+	Subject string
+
+	Date      time.Time // 为空时使用当前时间
+	MessageID string    // 为空时自动生成，不包含尖括号
+	Header    textproto.MIMEHeader
+
+	Text string
+	HTML string
+
+	inline      []*messagePart
+	attachments []*messagePart
+}
+
+// messagePart 内嵌资源或者附件
+type messagePart struct {
+	filename    string
+	contentType string
+	contentID   string
+	r           io.Reader
+}
+
+// NewMessageBuilder 创建邮件，from 和收件人使用 "名称 <地址>" 或者 "地址" 的格式
+func NewMessageBuilder(from string, to ...string) (*MessageBuilder, error) {
+	m := &MessageBuilder{}
+	if err := m.SetFrom(from); err != nil {
+		return nil, err
+	}
+	if err := m.AddTo(to...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseAddresses 解析地址列表，每一项可以包含多个以逗号分隔的地址
+func parseAddresses(list []string) ([]*mail.Address, error) {
+	var addrs []*mail.Address
+	for _, s := range list {
+		parsed, err := mail.ParseAddressList(s)
+		if err != nil {
+			return nil, fmt.Errorf("smtp: invalid address %q: %v", s, err)
+		}
+		addrs = append(addrs, parsed...)
+	}
+	return addrs, nil
+}
+
+// SetFrom 设置发件人
+func (m *MessageBuilder) SetFrom(from string) error {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("smtp: invalid address %q: %v", from, err)
+	}
+	m.From = addr
+	return nil
+}
+
+// AddTo 添加收件人
+func (m *MessageBuilder) AddTo(to ...string) error {
+	addrs, err := parseAddresses(to)
+	m.To = append(m.To, addrs...)
+	return err
+}
+
+// AddCc 添加抄送
+func (m *MessageBuilder) AddCc(cc ...string) error {
+	addrs, err := parseAddresses(cc)
+	m.Cc = append(m.Cc, addrs...)
+	return err
+}
+
+// AddBcc 添加密送
+func (m *MessageBuilder) AddBcc(bcc ...string) error {
+	addrs, err := parseAddresses(bcc)
+	m.Bcc = append(m.Bcc, addrs...)
+	return err
+}
+
+// AddReplyTo 添加回复地址
+func (m *MessageBuilder) AddReplyTo(replyTo ...string) error {
+	addrs, err := parseAddresses(replyTo)
+	m.ReplyTo = append(m.ReplyTo, addrs...)
+	return err
+}
+
+// Embed 添加内嵌资源，HTML 中使用 "cid:<contentID>" 引用，contentType 为空时根据文件名推断
+func (m *MessageBuilder) Embed(contentID, filename, contentType string, r io.Reader) {
+	m.inline = append(m.inline, &messagePart{
+		filename:    filename,
+		contentType: contentType,
+		contentID:   contentID,
+		r:           r,
+	})
+}
+
+// Attach 添加附件，contentType 为空时根据文件名推断
+func (m *MessageBuilder) Attach(filename, contentType string, r io.Reader) {
+	m.attachments = append(m.attachments, &messagePart{
+		filename:    filename,
+		contentType: contentType,
+		r:           r,
+	})
+}
+
+// Recipients 返回信封收件人，包括密送，域名已经转换为 ASCII 形式
+func (m *MessageBuilder) Recipients() ([]string, error) {
+	var rcpts []string
+	for _, list := range [][]*mail.Address{m.To, m.Cc, m.Bcc} {
+		for _, addr := range list {
+			rcpt, err := ToASCIIAddress(addr.Address)
+			if err != nil {
+				return nil, err
+			}
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	return rcpts, nil
+}
+
+// formatAddresses 格式化头部中的地址列表，名称按 RFC 2047 编码
+func formatAddresses(addrs []*mail.Address) (string, error) {
+	l := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ascii, err := ToASCIIAddress(addr.Address)
+		if err != nil {
+			return "", err
+		}
+		l = append(l, (&mail.Address{Name: addr.Name, Address: ascii}).String())
+	}
+	return strings.Join(l, ", "), nil
+}
+
+// generateMessageID 生成随机的 Message-ID，域名取自发件人
+func generateMessageID(from *mail.Address) (string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if from != nil {
+		if addr, err := ToASCIIAddress(from.Address); err == nil {
+			if _, d := splitAddress(addr); d != "" {
+				domain = d
+			}
+		}
+	}
+	return hex.EncodeToString(b[:]) + "@" + domain, nil
+}
+
+// validHeaderKey 报告字符串是否是 RFC 5322 的字段名，即除冒号以外的可打印 ASCII 字符
+func validHeaderKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if k[i] < 33 || k[i] > 126 || k[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHeaderValue 拒绝包含 CR 或者 LF 的值，否则可以注入其他头部字段或者正文
+func checkHeaderValue(key, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("smtp: header field %s contains CR or LF", key)
+	}
+	return nil
+}
+
+// encodeHeaderValue 对包含非 ASCII 字符的头部值按 RFC 2047 编码
+func encodeHeaderValue(s string) string {
+	if isASCII(s) {
+		return s
+	}
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// writeHeaderField 写出一个头部字段，超过 78 个字符时在空白处折行
+func writeHeaderField(w io.Writer, key, value string) error {
+	var b strings.Builder
+	b.WriteString(key)
+	b.WriteString(":")
+	lineLen := b.Len()
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && lineLen+1+len(word) > maxHeaderLine {
+			b.WriteString("\r\n")
+			lineLen = 0
+		}
+		b.WriteString(" ")
+		b.WriteString(word)
+		lineLen += 1 + len(word)
+	}
+	b.WriteString("\r\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeHeader 按照给定的顺序写出头部，最后写入空行
+func writeHeader(w io.Writer, keys []string, header textproto.MIMEHeader) error {
+	for _, k := range keys {
+		for _, v := range header[k] {
+			if err := writeHeaderField(w, k, v); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// header 生成邮件的顶层头部，不包括 Content-Type
+func (m *MessageBuilder) header() (keys []string, header textproto.MIMEHeader, err error) {
+	header = make(textproto.MIMEHeader)
+	add := func(k, v string) {
+		if _, ok := header[k]; !ok {
+			keys = append(keys, k)
+		}
+		header.Add(k, v)
+	}
+
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	add("Date", date.Format(time.RFC1123Z))
+
+	id := m.MessageID
+	if err := checkHeaderValue("Message-Id", id); err != nil {
+		return nil, nil, err
+	}
+	if id == "" {
+		if id, err = generateMessageID(m.From); err != nil {
+			return nil, nil, err
+		}
+	}
+	add("Message-Id", "<"+id+">")
+
+	if m.From == nil {
+		return nil, nil, errors.New("smtp: message has no From address")
+	}
+	lists := []struct {
+		key   string
+		addrs []*mail.Address
+	}{
+		{"From", []*mail.Address{m.From}},
+		{"Reply-To", m.ReplyTo},
+		{"To", m.To},
+		{"Cc", m.Cc},
+	}
+	for _, list := range lists {
+		if len(list.addrs) == 0 {
+			continue
+		}
+		v, err := formatAddresses(list.addrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		add(list.key, v)
+	}
+	if m.Subject != "" {
+		if err := checkHeaderValue("Subject", m.Subject); err != nil {
+			return nil, nil, err
+		}
+		add("Subject", encodeHeaderValue(m.Subject))
+	}
+
+	extra := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		if !validHeaderKey(k) {
+			return nil, nil, fmt.Errorf("smtp: invalid header field name %q", k)
+		}
+		if _, ok := header[textproto.CanonicalMIMEHeaderKey(k)]; !ok && !reservedHeader[textproto.CanonicalMIMEHeaderKey(k)] {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	for _, k := range extra {
+		for _, v := range m.Header[k] {
+			if err := checkHeaderValue(k, v); err != nil {
+				return nil, nil, err
+			}
+			add(textproto.CanonicalMIMEHeaderKey(k), encodeHeaderValue(v))
+		}
+	}
+	add("Mime-Version", "1.0")
+	return keys, header, nil
+}
+
+// reservedHeader 由 MessageBuilder 生成，不能通过 Header 设置的字段
+var reservedHeader = map[string]bool{
+	"Bcc":                       true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// countWriter 统计写出的字节数
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// WriteTo 写出完整的邮件，实现 io.WriterTo
+func (m *MessageBuilder) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	keys, header, err := m.header()
+	if err != nil {
+		return 0, err
+	}
+
+	// 顶层实体的头部与邮件头部合并
+	var body func(w io.Writer) error
+	var contentType string
+	switch {
+	case len(m.attachments) > 0:
+		contentType, body = m.multipart("mixed", m.writeMixed)
+	case len(m.inline) > 0:
+		contentType, body = m.multipart("related", m.writeRelated)
+	case m.Text != "" && m.HTML != "":
+		contentType, body = m.multipart("alternative", m.writeAlternative)
+	default:
+		contentType, body = m.singleBody()
+	}
+	keys = append(keys, "Content-Type")
+	header.Set("Content-Type", contentType)
+	if !strings.HasPrefix(contentType, "multipart/") {
+		keys = append(keys, "Content-Transfer-Encoding")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+	}
+	if err := writeHeader(cw, keys, header); err != nil {
+		return cw.n, err
+	}
+	err = body(cw)
+	return cw.n, err
+}
+
+// multipart 返回 multipart 实体的类型和写出函数，边界在写出之前确定
+func (m *MessageBuilder) multipart(subtype string, parts func(mw *multipart.Writer) error) (string, func(io.Writer) error) {
+	boundary, err := randomBoundary()
+	if err != nil {
+		return "", func(io.Writer) error { return err }
+	}
+	contentType := mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary})
+	return contentType, func(w io.Writer) error {
+		mw := multipart.NewWriter(w)
+		if err := mw.SetBoundary(boundary); err != nil {
+			return err
+		}
+		if err := parts(mw); err != nil {
+			return err
+		}
+		return mw.Close()
+	}
+}
+
+// randomBoundary 生成较短的边界，嵌套实体的 Content-Type 不折行也不会超过 78 个字符
+func randomBoundary() (string, error) {
+	var b [15]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// singleBody 只有一个正文时直接作为顶层实体
+func (m *MessageBuilder) singleBody() (string, func(io.Writer) error) {
+	subtype, text := "plain", m.Text
+	if m.HTML != "" {
+		subtype, text = "html", m.HTML
+	}
+	return "text/" + subtype + "; charset=utf-8", func(w io.Writer) error {
+		return writeQuotedPrintable(w, text)
+	}
+}
+
+func (m *MessageBuilder) writeMixed(mw *multipart.Writer) error {
+	if len(m.inline) > 0 {
+		if err := m.writeNested(mw, "related", m.writeRelated); err != nil {
+			return err
+		}
+	} else if err := m.writeBody(mw); err != nil {
+		return err
+	}
+	for _, part := range m.attachments {
+		if err := writeBinaryPart(mw, part, "attachment"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MessageBuilder) writeRelated(mw *multipart.Writer) error {
+	if err := m.writeBody(mw); err != nil {
+		return err
+	}
+	for _, part := range m.inline {
+		if err := writeBinaryPart(mw, part, "inline"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MessageBuilder) writeAlternative(mw *multipart.Writer) error {
+	if err := writeTextPart(mw, "plain", m.Text); err != nil {
+		return err
+	}
+	return writeTextPart(mw, "html", m.HTML)
+}
+
+// writeBody 写出正文，同时有纯文本和 HTML 时嵌套 multipart/alternative
+func (m *MessageBuilder) writeBody(mw *multipart.Writer) error {
+	if m.Text != "" && m.HTML != "" {
+		return m.writeNested(mw, "alternative", m.writeAlternative)
+	}
+	if m.HTML != "" {
+		return writeTextPart(mw, "html", m.HTML)
+	}
+	return writeTextPart(mw, "plain", m.Text)
+}
+
+// writeNested 写出嵌套的 multipart 实体
+func (m *MessageBuilder) writeNested(mw *multipart.Writer, subtype string, parts func(mw *multipart.Writer) error) error {
+	contentType, body := m.multipart(subtype, parts)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", contentType)
+	w, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	return body(w)
+}
+
+func writeTextPart(mw *multipart.Writer, subtype, text string) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "text/"+subtype+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	w, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	return writeQuotedPrintable(w, text)
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qw, text); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// writeBinaryPart 以 base64 编码写出内嵌资源或者附件，数据从 Reader 流式读取
+func writeBinaryPart(mw *multipart.Writer, part *messagePart, disposition string) error {
+	fields := [][2]string{
+		{"Content-Type", part.contentType},
+		{"Content-Disposition", part.filename},
+		{"Content-Id", part.contentID},
+	}
+	for _, f := range fields {
+		if err := checkHeaderValue(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+
+	contentType := part.contentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(part.filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+	params := map[string]string{}
+	if part.filename != "" {
+		params["filename"] = part.filename
+	}
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+	if part.contentID != "" {
+		h.Set("Content-Id", "<"+part.contentID+">")
+	}
+	w, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	lw := &lineWrapper{w: w}
+	enc := base64.NewEncoder(base64.StdEncoding, lw)
+	if _, err := io.Copy(enc, part.r); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return lw.Close()
+}
+
+// lineWrapper 每 76 个字符插入一个 CRLF
+type lineWrapper struct {
+	w   io.Writer
+	col int
+}
+
+func (lw *lineWrapper) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if lw.col == maxBase64Line {
+			if _, err := io.WriteString(lw.w, "\r\n"); err != nil {
+				return n, err
+			}
+			lw.col = 0
+		}
+		chunk := p
+		if len(chunk) > maxBase64Line-lw.col {
+			chunk = chunk[:maxBase64Line-lw.col]
+		}
+		m, err := lw.w.Write(chunk)
+		n += m
+		lw.col += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// Close 结束最后一行
+func (lw *lineWrapper) Close() error {
+	if lw.col == 0 {
+		return nil
+	}
+	lw.col = 0
+	_, err := io.WriteString(lw.w, "\r\n")
+	return err
+}
@@ -38,6 +38,7 @@ type Conn struct {
 
 	session    Session
 	locker     sync.Mutex
+	wlocker    sync.Mutex // 保护响应的写缓冲
 	binarymime bool
 
 	lineLimitReader *lineLimitReader
@@ -47,8 +48,10 @@ type Conn struct {
 	bytesReceived   int // counts total size of chunks when BDAT is used
 
 	fromReceived bool
+	mailOpts     *MailOptions
 	recipients   []string
 	didAuth      bool
+	authUser     string // 当前AUTH命令中客户端给出的用户名
 }
 
 func newConn(c net.Conn, s *Server) *Conn {
@@ -63,7 +66,7 @@ func newConn(c net.Conn, s *Server) *Conn {
 
 func (c *Conn) init() {
 	c.lineLimitReader = &lineLimitReader{
-		R:         c.conn,
+		R:         flushReader{c: c, r: c.conn},
 		LineLimit: c.server.MaxLineLength,
 	}
 	rwc := struct {
@@ -96,7 +99,7 @@ func (c *Conn) handle(cmd string, arg string) {
 	// 如果抛出了异常，返回421响应并关闭连接对象
 	defer func() {
 		if err := recover(); err != nil {
-			c.WriteResponse(421, EnhancedCode{4, 0, 0}, "服务器内容错误")
+			c.reply(421, EnhancedCode{4, 0, 0}, ReplyInternalError)
 			c.Close()
 
 			stack := debug.Stack()
@@ -106,24 +109,24 @@ func (c *Conn) handle(cmd string, arg string) {
 
 	// 命令为空
 	if cmd == "" {
-		c.protocolError(500, EnhancedCode{5, 5, 2}, "错误：cmd命令不能为空")
+		c.protocolError(500, EnhancedCode{5, 5, 2}, c.server.replyText(ReplyEmptyCommand))
 		return
 	}
 
 	// 处理不同的命令
 	cmd = strings.ToUpper(cmd)
 	switch cmd {
-	case "SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, fmt.Sprintf("%v 命令未实现", cmd))
+	case "SEND", "SOML", "SAML", "TURN":
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyNotImplemented, "Command", cmd)
 	case "HELO", "EHLO", "LHLO":
 		lmtp := cmd == "LHLO"
 		enhanced := lmtp || cmd == "EHLO"
 		if c.server.LMTP && !lmtp {
-			c.WriteResponse(500, EnhancedCode{5, 5, 1}, "这是一个 LMTP 服务, 使用 LHLO")
+			c.reply(500, EnhancedCode{5, 5, 1}, ReplyUseLHLO)
 			return
 		}
 		if !c.server.LMTP && lmtp {
-			c.WriteResponse(500, EnhancedCode{5, 5, 1}, "这不是一个 LMTP 服务")
+			c.reply(500, EnhancedCode{5, 5, 1}, ReplyNotLMTP)
 			return
 		}
 		c.handleGreet(enhanced, arg)
@@ -132,30 +135,35 @@ func (c *Conn) handle(cmd string, arg string) {
 	case "RCPT":
 		c.handleRcpt(arg)
 	case "VRFY":
-		c.WriteResponse(252, EnhancedCode{2, 5, 0}, "无法验证用户，但是会接收消息")
+		c.handleVrfy(arg)
+	case "EXPN":
+		c.handleExpn(arg)
+	case "HELP":
+		c.handleHelp(arg)
+	case "ETRN":
+		c.handleEtrn(arg)
 	case "NOOP":
-		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "成功的处理了NOOP命令")
+		c.reply(250, EnhancedCode{2, 0, 0}, ReplyNoop)
 	case "RSET": // Reset session
 		c.reset()
-		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "重置会话")
+		c.reply(250, EnhancedCode{2, 0, 0}, ReplyReset)
 	case "BDAT":
 		c.handleBdat(arg)
 	case "DATA":
 		c.handleData(arg)
 	case "QUIT":
-		c.WriteResponse(221, EnhancedCode{2, 0, 0}, "再见")
+		c.reply(221, EnhancedCode{2, 0, 0}, ReplyBye)
 		c.Close()
 	case "AUTH":
 		if c.server.AuthDisabled {
-			c.protocolError(500, EnhancedCode{5, 5, 2}, "语法错误, AUTH 命令不推荐")
+			c.protocolError(500, EnhancedCode{5, 5, 2}, c.server.replyText(ReplyAuthDisabled))
 		} else {
 			c.handleAuth(arg)
 		}
 	case "STARTTLS":
 		c.handleStartTLS()
 	default:
-		msg := fmt.Sprintf("语法错误, %v 命令不推荐", cmd)
-		c.protocolError(500, EnhancedCode{5, 5, 2}, msg)
+		c.protocolError(500, EnhancedCode{5, 5, 2}, c.server.replyText(ReplyUnknownCommand, "Command", cmd))
 	}
 }
 
@@ -190,9 +198,37 @@ func (c *Conn) Close() error {
 		c.session = nil
 	}
 
+	c.flush()
 	return c.conn.Close()
 }
 
+// flushReader 从网络读取之前先发送缓冲的响应
+//
+// 客户端使用 PIPELINING 时，多个命令已经在读缓冲中，处理这些命令不会从网络读取，
+// 它们的响应会一起发送，直到需要等待客户端的下一批输入。
+type flushReader struct {
+	c *Conn
+	r io.Reader
+}
+
+func (r flushReader) Read(p []byte) (int, error) {
+	if err := r.c.flush(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// flush 发送缓冲的响应
+func (c *Conn) flush() error {
+	c.wlocker.Lock()
+	defer c.wlocker.Unlock()
+
+	if c.text == nil {
+		return nil
+	}
+	return c.text.W.Flush()
+}
+
 // TLSConnectionState returns the connection's TLS connection state.
 // Zero values are returned if the connection doesn't use TLS.
 func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
@@ -203,6 +239,18 @@ func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 	return tc.ConnectionState(), true
 }
 
+// MailOptions 返回当前事务 MAIL 命令的参数，还没有收到 MAIL 命令时返回 nil
+func (c *Conn) MailOptions() *MailOptions {
+	return c.mailOpts
+}
+
+// dataOptions 在 Data 之前把 MAIL 参数传给会话
+func (c *Conn) dataOptions() {
+	if s, ok := c.Session().(DataOptionsSession); ok && c.mailOpts != nil {
+		s.DataOptions(c.mailOpts)
+	}
+}
+
 func (c *Conn) State() ConnectionState {
 	state := ConnectionState{}
 	tlsState, ok := c.TLSConnectionState()
@@ -229,7 +277,7 @@ func (c *Conn) protocolError(code int, ec EnhancedCode, msg string) {
 
 	c.errCount++
 	if c.errCount > errThreshold {
-		c.WriteResponse(500, EnhancedCode{5, 5, 1}, "Too many errors. Quiting now")
+		c.reply(500, EnhancedCode{5, 5, 1}, ReplyTooManyErrors)
 		c.Close()
 	}
 }
@@ -238,7 +286,7 @@ func (c *Conn) protocolError(code int, ec EnhancedCode, msg string) {
 func (c *Conn) handleGreet(enhanced bool, arg string) {
 	domain, err := parseHelloArgument(arg)
 	if err != nil {
-		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Domain/address argument required for HELO")
+		c.reply(501, EnhancedCode{5, 5, 2}, ReplyHelloArgRequired)
 		return
 	}
 	c.helo = domain
@@ -246,7 +294,7 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	sess, err := c.server.Backend.NewSession(c.State())
 	if err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
-			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, c.errorText(smtpErr))
 			return
 		}
 		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
@@ -255,7 +303,7 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	c.SetSession(sess)
 
 	if !enhanced {
-		c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Hello %s", domain))
+		c.reply(250, EnhancedCode{2, 0, 0}, ReplyHello, "Client", domain)
 		return
 	}
 
@@ -264,13 +312,8 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	if _, isTLS := c.TLSConnectionState(); c.server.TLSConfig != nil && !isTLS {
 		caps = append(caps, "STARTTLS")
 	}
-	if c.authAllowed() {
-		authCap := "AUTH"
-		for name := range c.server.auths {
-			authCap += " " + name
-		}
-
-		caps = append(caps, authCap)
+	if mechs := c.authMechanisms(); c.authAllowed() && len(mechs) > 0 {
+		caps = append(caps, "AUTH "+strings.Join(mechs, " "))
 	}
 	if c.server.EnableSMTPUTF8 {
 		caps = append(caps, "SMTPUTF8")
@@ -281,13 +324,16 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	if c.server.EnableBINARYMIME {
 		caps = append(caps, "BINARYMIME")
 	}
+	if _, ok := c.server.Backend.(QueueFlusher); ok {
+		caps = append(caps, "ETRN")
+	}
 	if c.server.MaxMessageBytes > 0 {
 		caps = append(caps, fmt.Sprintf("SIZE %v", c.server.MaxMessageBytes))
 	} else {
 		caps = append(caps, "SIZE")
 	}
 
-	args := []string{"Hello " + domain}
+	args := []string{c.server.replyText(ReplyHello, "Client", domain)}
 	args = append(args, caps...)
 	c.WriteResponse(250, NoEnhancedCode, args...)
 }
@@ -296,43 +342,44 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 func (c *Conn) handleMail(arg string) {
 	// 打招呼
 	if c.helo == "" {
-		c.WriteResponse(502, EnhancedCode{2, 5, 1}, "请先介绍您自己，hello内容不能为空")
+		c.reply(502, EnhancedCode{2, 5, 1}, ReplyHelloFirst)
 		return
 	}
 
 	// 管道为空
 	if c.bdatPipe != nil {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "MAIL 不允许数据传输")
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyMailInTransfer)
+		return
+	}
+
+	// 需要先 STARTTLS，提交模式需要先认证
+	if c.startTLSRequired() || c.submissionAuthRequired() {
 		return
 	}
 
 	// 发件人
 	if len(arg) < 6 || strings.ToUpper(arg[0:5]) != "FROM:" {
-		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "语法错误，期望的格式是 FROM:<address>")
+		c.reply(501, EnhancedCode{5, 5, 2}, ReplyMailSyntax)
 		return
 	}
-	fromArgs := strings.Split(strings.Trim(arg[5:], " "), " ")
-	if c.server.Strict {
-		if !strings.HasPrefix(fromArgs[0], "<") || !strings.HasSuffix(fromArgs[0], ">") {
-			c.WriteResponse(501, EnhancedCode{5, 5, 2}, "语法错误，期望的格式是 FROM:<address>")
-			return
-		}
+	from, fromArgs, err := parseCommandPath(arg, "FROM:", true, c.server.Strict)
+	if err != nil {
+		c.reply(501, EnhancedCode{5, 1, 7}, ReplyBadSender)
+		return
 	}
-	from := fromArgs[0]
-	if from == "" {
-		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "语法错误，期望的格式是 FROM:<address>")
+	if !c.senderOwned(from) {
+		c.reply(ErrSenderNotOwned.Code, ErrSenderNotOwned.EnhancedCode, ReplySenderNotOwned)
 		return
 	}
-	from = strings.Trim(from, "<>")
 
 	// 参数
 	opts := &MailOptions{}
 	c.binarymime = false
-	if len(fromArgs) > 1 {
+	if len(fromArgs) > 0 {
 		// 解析参数
-		args, err := parseArgs(fromArgs[1:])
+		args, err := parseArgs(fromArgs)
 		if err != nil {
-			c.WriteResponse(501, EnhancedCode{5, 5, 4}, "解析 MAIL ESMTP 参数失败")
+			c.reply(501, EnhancedCode{5, 5, 4}, ReplyMailParams)
 			return
 		}
 
@@ -342,23 +389,27 @@ func (c *Conn) handleMail(arg string) {
 			case "SIZE":
 				size, err := strconv.ParseInt(value, 10, 32)
 				if err != nil {
-					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "无法将SIZE解析为一个整数")
+					c.reply(501, EnhancedCode{5, 5, 4}, ReplySizeInvalid)
 					return
 				}
 				if c.server.MaxMessageBytes > 0 && int(size) > c.server.MaxMessageBytes {
-					c.WriteResponse(552, EnhancedCode{5, 3, 4}, "SIZE超过了最大消息容量限制")
+					c.reply(552, EnhancedCode{5, 3, 4}, ReplySizeExceeded)
 					return
 				}
 				opts.Size = int(size)
 			case "SMTPUTF8":
 				if !c.server.EnableSMTPUTF8 {
-					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "SMTPUTF8 未实现")
+					c.reply(504, EnhancedCode{5, 5, 4}, ReplyParamUnsupported, "Param", "SMTPUTF8")
 					return
 				}
 				opts.UTF8 = true
 			case "REQUIRETLS":
 				if !c.server.EnableREQUIRETLS {
-					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "REQUIRETLS 未实现")
+					c.reply(504, EnhancedCode{5, 5, 4}, ReplyParamUnsupported, "Param", "REQUIRETLS")
+					return
+				}
+				if _, isTLS := c.TLSConnectionState(); !isTLS {
+					c.reply(530, EnhancedCode{5, 7, 10}, ReplyRequireTLSNoTLS)
 					return
 				}
 				opts.RequireTLS = true
@@ -366,51 +417,57 @@ func (c *Conn) handleMail(arg string) {
 				switch value {
 				case "BINARYMIME":
 					if !c.server.EnableBINARYMIME {
-						c.WriteResponse(504, EnhancedCode{5, 5, 4}, "BINARYMIME 未实现")
+						c.reply(504, EnhancedCode{5, 5, 4}, ReplyParamUnsupported, "Param", "BINARYMIME")
 						return
 					}
 					c.binarymime = true
 				case "7BIT", "8BITMIME":
 				default:
-					c.WriteResponse(500, EnhancedCode{5, 5, 4}, "未知的 BODY 值")
+					c.reply(500, EnhancedCode{5, 5, 4}, ReplyUnknownBody)
 					return
 				}
 				opts.Body = BodyType(value)
 			case "AUTH":
 				value, err = decodeXtext(value)
 				if err != nil {
-					c.WriteResponse(500, EnhancedCode{5, 5, 4}, "解析权限参数失败")
+					c.reply(500, EnhancedCode{5, 5, 4}, ReplyAuthParam)
 					return
 				}
 				if !strings.HasPrefix(value, "<") {
-					c.WriteResponse(500, EnhancedCode{5, 5, 4}, "缺少<符号")
+					c.reply(500, EnhancedCode{5, 5, 4}, ReplyAuthParam)
 					return
 				}
 				if !strings.HasSuffix(value, ">") {
-					c.WriteResponse(500, EnhancedCode{5, 5, 4}, "缺少>符号")
+					c.reply(500, EnhancedCode{5, 5, 4}, ReplyAuthParam)
 					return
 				}
 				decodedMbox := value[1 : len(value)-1]
 				opts.Auth = &decodedMbox
 			default:
-				c.WriteResponse(500, EnhancedCode{5, 5, 4}, "未知是收件人信息")
+				c.reply(500, EnhancedCode{5, 5, 4}, ReplyUnknownMailParam)
 				return
 			}
 		}
 	}
 
+	// 非 ASCII 地址需要 SMTPUTF8
+	if c.checkUTF8Address(from, opts.UTF8, EnhancedCode{5, 1, 7}, ReplyInvalidSender) {
+		return
+	}
+
 	// 处理邮件
 	if err := c.Session().Mail(from, opts); err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
-			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, c.errorText(smtpErr))
 			return
 		}
 		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
 		return
 	}
 
-	c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("处理 <%v> 发送的邮件成功", from))
+	c.reply(250, EnhancedCode{2, 0, 0}, ReplyMailOK, "Address", from)
 	c.fromReceived = true
+	c.mailOpts = opts
 }
 
 // This regexp matches 'hexchar' token defined in
@@ -449,47 +506,64 @@ func encodeXtext(raw string) string {
 	var out strings.Builder
 	out.Grow(len(raw))
 
-	for _, ch := range raw {
-		if ch == '+' || ch == '=' {
-			out.WriteRune('+')
-			out.WriteString(strings.ToUpper(strconv.FormatInt(int64(ch), 16)))
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if ch >= '!' && ch <= '~' && ch != '+' && ch != '=' { // printable non-space US-ASCII
+			out.WriteByte(ch)
+			continue
 		}
-		if ch > '!' && ch < '~' { // printable non-space US-ASCII
-			out.WriteRune(ch)
-		}
-		// Non-ASCII.
-		out.WriteRune('+')
-		out.WriteString(strings.ToUpper(strconv.FormatInt(int64(ch), 16)))
+		// "+", "=", controls and each byte of non-ASCII characters.
+		out.WriteString(fmt.Sprintf("+%02X", ch))
 	}
 	return out.String()
 }
 
 // handleRcpt 处理接收到的消息
 func (c *Conn) handleRcpt(arg string) {
+	if c.startTLSRequired() || c.submissionAuthRequired() {
+		return
+	}
 	if !c.fromReceived {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "发件人不能为空")
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyMissingMail)
 		return
 	}
 	if c.bdatPipe != nil {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "RCPT 不允许数据传输")
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyRcptInTransfer)
 		return
 	}
 	if (len(arg) < 4) || (strings.ToUpper(arg[0:3]) != "TO:") {
-		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "语法错误，期望的格式是 TO:<address>")
+		c.reply(501, EnhancedCode{5, 5, 2}, ReplyRcptSyntax)
 		return
 	}
 
-	recipient := strings.Trim(arg[3:], "<> ")
+	recipient, rcptArgs, err := parseCommandPath(arg, "TO:", false, c.server.Strict)
+	if err != nil {
+		c.reply(501, EnhancedCode{5, 1, 3}, ReplyBadRecipient)
+		return
+	}
+	if len(rcptArgs) > 0 {
+		if _, err := parseArgs(rcptArgs); err != nil {
+			c.reply(501, EnhancedCode{5, 5, 4}, ReplyRcptParams)
+			return
+		}
+		// 目前没有支持的 RCPT 参数
+		c.reply(555, EnhancedCode{5, 5, 4}, ReplyRcptParamUnknown)
+		return
+	}
 	if c.server.MaxRecipients > 0 && len(c.recipients) >= c.server.MaxRecipients {
-		c.WriteResponse(552, EnhancedCode{5, 5, 3}, fmt.Sprintf("超过最大接收数量限制 %v",
-			c.server.MaxRecipients))
+		c.reply(552, EnhancedCode{5, 5, 3}, ReplyTooManyRecipients, "Limit", c.server.MaxRecipients)
+		return
+	}
+
+	// 非 ASCII 地址需要 MAIL 命令声明 SMTPUTF8
+	if c.checkUTF8Address(recipient, c.mailOpts != nil && c.mailOpts.UTF8, EnhancedCode{5, 1, 3}, ReplyInvalidRecipient) {
 		return
 	}
 
 	// 会话处理接收到的消息
 	if err := c.Session().Rcpt(recipient); err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
-			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, c.errorText(smtpErr))
 			return
 		}
 		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
@@ -498,33 +572,44 @@ func (c *Conn) handleRcpt(arg string) {
 	c.recipients = append(c.recipients, recipient)
 
 	// 正确的消息
-	c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("我会确保 <%v> 接收这条消息", recipient))
+	c.reply(250, EnhancedCode{2, 0, 0}, ReplyRcptOK, "Address", recipient)
 }
 
 // handleAuth 处理权限
 func (c *Conn) handleAuth(arg string) {
 	if c.helo == "" {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "请先介绍您自己")
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyHelloFirst)
 		return
 	}
 	if c.didAuth {
-		c.WriteResponse(503, EnhancedCode{5, 5, 1}, "权限已经校验过")
+		c.reply(503, EnhancedCode{5, 5, 1}, ReplyAlreadyAuth)
 		return
 	}
 
 	parts := strings.Fields(arg)
 	if len(parts) == 0 {
-		c.WriteResponse(502, EnhancedCode{5, 5, 4}, "缺少参数")
+		c.reply(502, EnhancedCode{5, 5, 4}, ReplyAuthArgRequired)
+		return
+	}
+
+	if c.startTLSRequired() {
 		return
 	}
 
 	if _, isTLS := c.TLSConnectionState(); !isTLS && !c.server.AllowInsecureAuth {
-		c.WriteResponse(523, EnhancedCode{5, 7, 10}, "需要TLS")
+		c.reply(523, EnhancedCode{5, 7, 10}, ReplyAuthTLSRequired)
 		return
 	}
 
 	mechanism := strings.ToUpper(parts[0])
 
+	c.authUser = ""
+	if l := c.server.AuthLimiter; l != nil && l.Blocked(c.conn.RemoteAddr()) {
+		c.reply(421, EnhancedCode{4, 7, 0}, ReplyAuthLocked)
+		c.Close()
+		return
+	}
+
 	// Parse client initial response if there is one
 	var ir []byte
 	if len(parts) > 1 {
@@ -535,9 +620,15 @@ func (c *Conn) handleAuth(arg string) {
 		}
 	}
 
-	newSasl, ok := c.server.auths[mechanism]
+	newSasl, ok := c.authFactory(mechanism)
+	if ok {
+		ok = false
+		for _, name := range c.authMechanisms() {
+			ok = ok || name == mechanism
+		}
+	}
 	if !ok {
-		c.WriteResponse(504, EnhancedCode{5, 7, 4}, "Unsupported authentication mechanism")
+		c.reply(504, EnhancedCode{5, 7, 4}, ReplyAuthMechanism)
 		return
 	}
 
@@ -548,10 +639,10 @@ func (c *Conn) handleAuth(arg string) {
 		challenge, done, err := sasl.Next(response)
 		if err != nil {
 			if smtpErr, ok := err.(*SMTPError); ok {
-				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+				c.authFailed(mechanism, err, smtpErr.Code, smtpErr.EnhancedCode, c.errorText(smtpErr))
 				return
 			}
-			c.WriteResponse(454, EnhancedCode{4, 7, 0}, err.Error())
+			c.authFailed(mechanism, err, 454, EnhancedCode{4, 7, 0}, err.Error())
 			return
 		}
 
@@ -572,40 +663,62 @@ func (c *Conn) handleAuth(arg string) {
 
 		if encoded == "*" {
 			// https://tools.ietf.org/html/rfc4954#page-4
-			c.WriteResponse(501, EnhancedCode{5, 0, 0}, "Negotiation cancelled")
+			if c.authUser != "" {
+				// 客户端已经给出了用户名，例如收到令牌错误之后取消，同样计为认证失败
+				c.authFailed(mechanism, errAuthCancelled, 501, EnhancedCode{5, 0, 0}, c.server.replyText(ReplyAuthCancelled))
+				return
+			}
+			c.reply(501, EnhancedCode{5, 0, 0}, ReplyAuthCancelled)
 			return
 		}
 
 		response, err = base64.StdEncoding.DecodeString(encoded)
 		if err != nil {
-			c.WriteResponse(454, EnhancedCode{4, 7, 0}, "Invalid base64 data")
+			c.reply(454, EnhancedCode{4, 7, 0}, ReplyAuthBase64)
 			return
 		}
 	}
 
-	c.WriteResponse(235, EnhancedCode{2, 0, 0}, "Authentication succeeded")
+	c.reply(235, EnhancedCode{2, 0, 0}, ReplyAuthOK)
 	c.didAuth = true
+	if sess, ok := c.Session().(AuthUserSession); ok {
+		sess.SetAuthUser(c.authUser)
+	}
 }
 
 // 处理TLS
 func (c *Conn) handleStartTLS() {
 	if _, isTLS := c.TLSConnectionState(); isTLS {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "Already running in TLS")
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyAlreadyTLS)
 		return
 	}
 
 	if c.server.TLSConfig == nil {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "TLS not supported")
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyTLSUnsupported)
 		return
 	}
 
-	c.WriteResponse(220, EnhancedCode{2, 0, 0}, "Ready to start TLS")
+	c.reply(220, EnhancedCode{2, 0, 0}, ReplyStartTLS)
+	c.flush()
 
 	// Upgrade to TLS
-	tlsConn := tls.Server(c.conn, c.server.TLSConfig)
+	tlsConn := tls.Server(c.conn, c.server.tlsConfig())
 
 	if err := tlsConn.Handshake(); err != nil {
-		c.WriteResponse(550, EnhancedCode{5, 0, 0}, "Handshake error")
+		c.server.logTLSHandshake(c.conn, false, nil, err)
+		c.reply(550, EnhancedCode{5, 0, 0}, ReplyTLSHandshake)
+		c.flush()
+		return
+	}
+
+	state := tlsConn.ConnectionState()
+	err := c.server.checkTLSPolicy(state)
+	c.server.logTLSHandshake(c.conn, false, &state, err)
+	if err != nil {
+		c.conn = tlsConn
+		c.init()
+		c.reply(421, EnhancedCode{4, 7, 0}, ReplyTLSPolicy)
+		c.Close()
 		return
 	}
 
@@ -628,34 +741,35 @@ func (c *Conn) handleStartTLS() {
 // 处理数据
 func (c *Conn) handleData(arg string) {
 	if arg != "" {
-		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "参数不能为空")
+		c.reply(501, EnhancedCode{5, 5, 4}, ReplyDataArg)
 		return
 	}
 	if c.bdatPipe != nil {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "不允许数据传输")
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyDataInTransfer)
 		return
 	}
 	if c.binarymime {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "不支持BINARYMIME类型的消息")
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyDataBinaryMIME)
 		return
 	}
 
 	if !c.fromReceived || len(c.recipients) == 0 {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "缺少 RCPT TO 命令")
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyMissingRcpt)
 		return
 	}
 
 	// We have recipients, go to accept data
-	c.WriteResponse(354, EnhancedCode{2, 0, 0}, "接收到数据。以以下方式结束数据 <CR><LF>.<CR><LF>")
+	c.reply(354, EnhancedCode{2, 0, 0}, ReplyDataStart)
 
 	defer c.reset()
+	c.dataOptions()
 	if c.server.LMTP {
 		c.handleDataLMTP()
 		return
 	}
 
 	r := newDataReader(c)
-	code, enhancedCode, msg := toSMTPStatus(c.Session().Data(r))
+	code, enhancedCode, msg := c.toSMTPStatus(c.sessionData(r))
 	r.limited = false
 	io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
 	c.WriteResponse(code, enhancedCode, msg)
@@ -664,23 +778,18 @@ func (c *Conn) handleData(arg string) {
 func (c *Conn) handleBdat(arg string) {
 	args := strings.Fields(arg)
 	if len(args) == 0 {
-		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "缺少chunk size参数")
+		c.reply(501, EnhancedCode{5, 5, 4}, ReplyBdatSizeRequired)
 		return
 	}
 	if len(args) > 2 {
-		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "参数过多")
-		return
-	}
-
-	if !c.fromReceived || len(c.recipients) == 0 {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "缺少RCPT TO命令")
+		c.reply(501, EnhancedCode{5, 5, 4}, ReplyBdatTooManyArgs)
 		return
 	}
 
 	last := false
 	if len(args) == 2 {
 		if !strings.EqualFold(args[1], "LAST") {
-			c.WriteResponse(501, EnhancedCode{5, 5, 4}, "未知的 BDAT 参数")
+			c.reply(501, EnhancedCode{5, 5, 4}, ReplyBdatUnknownArg)
 			return
 		}
 		last = true
@@ -689,12 +798,20 @@ func (c *Conn) handleBdat(arg string) {
 	// ParseUint instead of Atoi so we will not accept negative values.
 	size, err := strconv.ParseUint(args[0], 10, 32)
 	if err != nil {
-		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Malformed size argument")
+		c.reply(501, EnhancedCode{5, 5, 4}, ReplyBdatSizeInvalid)
+		return
+	}
+
+	if !c.fromReceived || len(c.recipients) == 0 {
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyMissingRcpt)
+
+		// The chunk still follows the command, it must not be read as commands.
+		io.Copy(ioutil.Discard, io.LimitReader(c.text.R, int64(size)))
 		return
 	}
 
 	if c.server.MaxMessageBytes != 0 && c.bytesReceived+int(size) > c.server.MaxMessageBytes {
-		c.WriteResponse(552, EnhancedCode{5, 3, 4}, "超过最大消息长度限制")
+		c.reply(552, EnhancedCode{5, 3, 4}, ReplySizeExceeded)
 
 		// Discard chunk itself without passing it to backend.
 		io.Copy(ioutil.Discard, io.LimitReader(c.text.R, int64(size)))
@@ -708,6 +825,8 @@ func (c *Conn) handleBdat(arg string) {
 	}
 
 	if c.bdatPipe == nil {
+		c.dataOptions()
+
 		var r *io.PipeReader
 		r, c.bdatPipe = io.Pipe()
 
@@ -725,7 +844,7 @@ func (c *Conn) handleBdat(arg string) {
 
 			var err error
 			if !c.server.LMTP {
-				err = c.Session().Data(r)
+				err = c.sessionData(r)
 			} else {
 				lmtpSession, ok := c.Session().(LMTPSession)
 				if !ok {
@@ -737,6 +856,11 @@ func (c *Conn) handleBdat(arg string) {
 					err = lmtpSession.LMTPData(r, c.bdatStatus)
 				}
 			}
+			if err == nil {
+				// The backend accepted the message without reading all of it,
+				// the remaining chunks are still on their way.
+				io.Copy(ioutil.Discard, r)
+			}
 
 			c.dataResult <- err
 			r.CloseWithError(err)
@@ -752,7 +876,7 @@ func (c *Conn) handleBdat(arg string) {
 		// the whole chunk.
 		io.Copy(ioutil.Discard, chunk)
 
-		c.WriteResponse(toSMTPStatus(err))
+		c.WriteResponse(c.toSMTPStatus(err))
 
 		if err == errPanic {
 			c.Close()
@@ -775,11 +899,11 @@ func (c *Conn) handleBdat(arg string) {
 		if c.server.LMTP {
 			c.bdatStatus.fillRemaining(err)
 			for i, rcpt := range c.recipients {
-				code, enchCode, msg := toSMTPStatus(<-c.bdatStatus.status[i])
+				code, enchCode, msg := c.toSMTPStatus(<-c.bdatStatus.status[i])
 				c.WriteResponse(code, enchCode, "<"+rcpt+"> "+msg)
 			}
 		} else {
-			c.WriteResponse(toSMTPStatus(err))
+			c.WriteResponse(c.toSMTPStatus(err))
 		}
 
 		if err == errPanic {
@@ -789,7 +913,7 @@ func (c *Conn) handleBdat(arg string) {
 
 		c.reset()
 	} else {
-		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "Continue")
+		c.reply(250, EnhancedCode{2, 0, 0}, ReplyBdatContinue)
 	}
 }
 
@@ -800,7 +924,7 @@ var ErrDataReset = errors.New("smtp: 消息传输失败")
 var errPanic = &SMTPError{
 	Code:         421,
 	EnhancedCode: EnhancedCode{4, 0, 0},
-	Message:      "服务器内部错误",
+	Message:      "Internal server error",
 }
 
 func (c *Conn) handlePanic(err interface{}, status *statusCollector) {
@@ -895,11 +1019,7 @@ func (c *Conn) handleDataLMTP() {
 		go func() {
 			defer func() {
 				if err := recover(); err != nil {
-					status.fillRemaining(&SMTPError{
-						Code:         421,
-						EnhancedCode: EnhancedCode{4, 0, 0},
-						Message:      "Internal server error",
-					})
+					status.fillRemaining(errPanic)
 
 					stack := debug.Stack()
 					c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.State().RemoteAddr, err, stack)
@@ -914,7 +1034,7 @@ func (c *Conn) handleDataLMTP() {
 	}
 
 	for i, rcpt := range c.recipients {
-		code, enchCode, msg := toSMTPStatus(<-status.status[i])
+		code, enchCode, msg := c.toSMTPStatus(<-status.status[i])
 		c.WriteResponse(code, enchCode, "<"+rcpt+"> "+msg)
 	}
 
@@ -925,26 +1045,26 @@ func (c *Conn) handleDataLMTP() {
 	}
 }
 
-func toSMTPStatus(err error) (code int, enchCode EnhancedCode, msg string) {
+func (c *Conn) toSMTPStatus(err error) (code int, enchCode EnhancedCode, msg string) {
 	if err != nil {
 		if smtperr, ok := err.(*SMTPError); ok {
-			return smtperr.Code, smtperr.EnhancedCode, smtperr.Message
+			return smtperr.Code, smtperr.EnhancedCode, c.errorText(smtperr)
 		} else {
-			return 554, EnhancedCode{5, 0, 0}, "Error: transaction failed, blame it on the weather: " + err.Error()
+			return 554, EnhancedCode{5, 0, 0}, c.server.replyText(ReplyDataFailed, "Error", err.Error())
 		}
 	}
 
-	return 250, EnhancedCode{2, 0, 0}, "OK: queued"
+	return 250, EnhancedCode{2, 0, 0}, c.server.replyText(ReplyQueued)
 }
 
 func (c *Conn) Reject() {
-	c.WriteResponse(421, EnhancedCode{4, 4, 5}, "Too busy. Try again later.")
+	c.reply(421, EnhancedCode{4, 4, 5}, ReplyTooBusy)
 	c.Close()
 }
 
 // greet 准备建立会话
 func (c *Conn) greet() {
-	c.WriteResponse(220, NoEnhancedCode, fmt.Sprintf("%v ESMTP 服务已准备就绪", c.server.Domain))
+	c.reply(220, NoEnhancedCode, ReplyGreeting)
 }
 
 // WriteResponse 写入响应
@@ -965,13 +1085,23 @@ func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
 		}
 	}
 
+	// 响应先写入缓冲，在下一次从网络读取或者关闭连接之前发送
+	c.wlocker.Lock()
+	defer c.wlocker.Unlock()
+
+	// 多行响应的每一行都带有增强状态码（RFC 2034）
+	w := c.text.W
 	for i := 0; i < len(text)-1; i++ {
-		c.text.PrintfLine("%d-%v", code, text[i])
+		if enhCode == NoEnhancedCode {
+			fmt.Fprintf(w, "%d-%v\r\n", code, text[i])
+		} else {
+			fmt.Fprintf(w, "%d-%v.%v.%v %v\r\n", code, enhCode[0], enhCode[1], enhCode[2], text[i])
+		}
 	}
 	if enhCode == NoEnhancedCode {
-		c.text.PrintfLine("%d %v", code, text[len(text)-1])
+		fmt.Fprintf(w, "%d %v\r\n", code, text[len(text)-1])
 	} else {
-		c.text.PrintfLine("%d %v.%v.%v %v", code, enhCode[0], enhCode[1], enhCode[2], text[len(text)-1])
+		fmt.Fprintf(w, "%d %v.%v.%v %v\r\n", code, enhCode[0], enhCode[1], enhCode[2], text[len(text)-1])
 	}
 }
 
@@ -1001,5 +1131,6 @@ func (c *Conn) reset() {
 	}
 
 	c.fromReceived = false
+	c.mailOpts = nil
 	c.recipients = nil
 }
@@ -0,0 +1,239 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
+)
+
+// aLongTimeAgo is a deadline in the past used to abort blocked network I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ContextDialer 建立网络连接，net.Dialer 和 SOCKS 代理都实现了该接口
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dialer 建立SMTP连接的参数
+type Dialer struct {
+	// 为空时使用超时时间为30秒的 net.Dialer，可以设置为绑定源地址的 net.Dialer 或者 SOCKS 代理
+	NetDialer ContextDialer
+	// DialTLSContext 使用的TLS配置，为空时根据地址设置 ServerName
+	TLSConfig *tls.Config
+}
+
+func (d *Dialer) netDialer() ContextDialer {
+	if d.NetDialer != nil {
+		return d.NetDialer
+	}
+	return &net.Dialer{Timeout: defaultTimeout}
+}
+
+// DialContext 连接SMTP服务并读取欢迎信息，取消 ctx 会立即中断连接过程
+func (d *Dialer) DialContext(ctx context.Context, addr string) (*Client, error) {
+	conn, err := d.netDialer().DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return newClientContext(ctx, conn, host)
+}
+
+// DialTLSContext 使用隐式TLS连接SMTP服务并读取欢迎信息
+func (d *Dialer) DialTLSContext(ctx context.Context, addr string) (*Client, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	config := d.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsDialer := tls.Dialer{Config: config}
+	if netDialer, ok := d.netDialer().(*net.Dialer); ok {
+		tlsDialer.NetDialer = netDialer
+	} else {
+		// 代理等其他连接方式，先建立连接再握手
+		conn, err := d.netDialer().DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return newClientContext(ctx, tlsConn, host)
+	}
+	conn, err := tlsDialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newClientContext(ctx, conn, host)
+}
+
+// DialContext 使用默认的 Dialer 连接SMTP服务
+func DialContext(ctx context.Context, addr string) (*Client, error) {
+	return (&Dialer{}).DialContext(ctx, addr)
+}
+
+// DialTLSContext 使用默认的 Dialer 通过隐式TLS连接SMTP服务
+func DialTLSContext(ctx context.Context, addr string, tlsConfig *tls.Config) (*Client, error) {
+	return (&Dialer{TLSConfig: tlsConfig}).DialTLSContext(ctx, addr)
+}
+
+func newClientContext(ctx context.Context, conn net.Conn, host string) (*Client, error) {
+	c := newClient(conn, host)
+	if err := c.withContext(ctx, c.greet); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// setDeadline sets the connection deadline to timeout from now, or to the
+// deadline of the current context if it is earlier.
+func (c *Client) setDeadline(timeout time.Duration) {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	if !c.ctxDeadline.IsZero() && c.ctxDeadline.Before(deadline) {
+		deadline = c.ctxDeadline
+	}
+	c.conn.SetDeadline(deadline)
+}
+
+// clearDeadline removes the per-command deadline, keeping the deadline of the
+// current context.
+func (c *Client) clearDeadline() {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.conn.SetDeadline(c.ctxDeadline)
+}
+
+// withContext runs f with the deadline of ctx applied to the connection.
+// Cancelling ctx aborts the network I/O immediately, after which the
+// connection is in an unknown state and should be closed.
+func (c *Client) withContext(ctx context.Context, f func() error) error {
+	if ctx.Done() == nil {
+		return f()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.deadlineMu.Lock()
+	c.ctxDeadline, _ = ctx.Deadline()
+	c.deadlineMu.Unlock()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			c.deadlineMu.Lock()
+			c.ctxDeadline = aLongTimeAgo
+			c.conn.SetDeadline(aLongTimeAgo)
+			c.deadlineMu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	err := f()
+	close(stop)
+	<-done
+
+	c.deadlineMu.Lock()
+	c.ctxDeadline = time.Time{}
+	c.conn.SetDeadline(time.Time{})
+	c.deadlineMu.Unlock()
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// MailContext 与 Mail 相同，取消 ctx 会中断命令
+func (c *Client) MailContext(ctx context.Context, from string, opts *MailOptions) error {
+	return c.withContext(ctx, func() error {
+		return c.Mail(from, opts)
+	})
+}
+
+// RcptContext 与 Rcpt 相同，取消 ctx 会中断命令
+func (c *Client) RcptContext(ctx context.Context, to string) error {
+	return c.withContext(ctx, func() error {
+		return c.Rcpt(to)
+	})
+}
+
+// DataContext 与 Data 相同，返回的 Writer 在写入和关闭时同样受 ctx 控制
+func (c *Client) DataContext(ctx context.Context) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	err := c.withContext(ctx, func() error {
+		var err error
+		w, err = c.Data()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ctxWriteCloser{ctx: ctx, c: c, w: w}, nil
+}
+
+// SendMailContext 与 SendMail 相同，取消 ctx 会中断发送
+func (c *Client) SendMailContext(ctx context.Context, from string, to []string, r io.Reader) error {
+	return c.withContext(ctx, func() error {
+		return c.SendMail(from, to, r)
+	})
+}
+
+// ctxWriteCloser applies a context to each Write and Close call.
+type ctxWriteCloser struct {
+	ctx context.Context
+	c   *Client
+	w   io.WriteCloser
+}
+
+func (w *ctxWriteCloser) Write(p []byte) (n int, err error) {
+	err = w.c.withContext(w.ctx, func() error {
+		n, err = w.w.Write(p)
+		return err
+	})
+	return n, err
+}
+
+func (w *ctxWriteCloser) Close() error {
+	return w.c.withContext(w.ctx, w.w.Close)
+}
+
+// SendMailContext 与包级别的 SendMail 相同，取消 ctx 会中断连接和发送
+func SendMailContext(ctx context.Context, addr string, a sasl.Client, from string, to []string, r io.Reader) error {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	for _, recp := range to {
+		if err := validateLine(recp); err != nil {
+			return err
+		}
+	}
+	c, err := DialContext(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.withContext(ctx, func() error {
+		return c.startAndSend(a, from, to, r)
+	})
+}
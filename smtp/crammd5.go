@@ -0,0 +1,24 @@
+package smtp
+
+import (
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
+)
+
+// EnableCramMD5Auth 开启 CRAM-MD5 认证，用于只支持 CRAM-MD5 的旧设备
+//
+// lookup 返回用户的明文密码或者 sasl.CramMD5Precompute 计算的密钥，
+// challenge 由随机数、时间戳和 Domain 组成，会话收到 *VerifiedCredential 凭据。
+// 和其它认证方式一样，只有在TLS连接中或者设置了 AllowInsecureAuth 时才会宣告。
+func (s *Server) EnableCramMD5Auth(lookup sasl.CramMD5Lookup) {
+	s.EnableAuth(sasl.CramMD5, func(conn *Conn) sasl.Server {
+		check := func(username string) (*sasl.CramMD5Secret, error) {
+			if err := conn.authStart(username); err != nil {
+				return nil, err
+			}
+			return lookup(username)
+		}
+		return sasl.NewCramMD5Server(s.Domain, check, func(username string) error {
+			return conn.Authenticate(sasl.CramMD5, &VerifiedCredential{Username: username})
+		})
+	})
+}
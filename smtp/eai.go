@@ -0,0 +1,137 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+var ErrSMTPUTF8Required = &SMTPError{
+	Code:         553,
+	EnhancedCode: EnhancedCode{5, 6, 7},
+	Message:      "Non-ASCII addresses require SMTPUTF8",
+}
+
+var (
+	ErrSMTPUTF8Unsupported = errors.New("smtp: server does not support SMTPUTF8")
+	// ErrUTF8Downgrade 服务不支持 SMTPUTF8，地址的本地部分包含非 ASCII 字符，无法降级
+	ErrUTF8Downgrade = errors.New("smtp: cannot downgrade address with non-ASCII local part, server does not support SMTPUTF8")
+)
+
+// isASCII 报告字符串是否只包含 ASCII 字符
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// splitAddress 在最后一个 @ 处拆分地址，没有 @ 时域名为空
+func splitAddress(addr string) (local, domain string) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return addr, ""
+	}
+	return addr[:i], addr[i+1:]
+}
+
+// ToASCIIAddress 把地址中的国际化域名转换为 punycode（RFC 5891），本地部分保持不变
+//
+// ASCII 域名和地址字面量（例如 [192.0.2.1]）原样返回。
+func ToASCIIAddress(addr string) (string, error) {
+	local, domain := splitAddress(addr)
+	if domain == "" || isASCII(domain) {
+		return addr, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("smtp: invalid domain in address %q: %v", addr, err)
+	}
+	return local + "@" + ascii, nil
+}
+
+// ToUnicodeAddress 把地址中 punycode 形式的域名转换为 Unicode，本地部分保持不变
+func ToUnicodeAddress(addr string) (string, error) {
+	local, domain := splitAddress(addr)
+	if domain == "" || strings.HasPrefix(domain, "[") {
+		return addr, nil
+	}
+	unicode, err := idna.Lookup.ToUnicode(domain)
+	if err != nil {
+		return "", fmt.Errorf("smtp: invalid domain in address %q: %v", addr, err)
+	}
+	return local + "@" + unicode, nil
+}
+
+// validAddressDomain 检查地址中的国际化域名是否符合 IDNA 规则，ASCII 域名不检查
+func validAddressDomain(addr string) bool {
+	_, err := ToASCIIAddress(addr)
+	return err == nil
+}
+
+// downgradeAddress 服务不支持 SMTPUTF8 时把地址转换为 ASCII 形式，本地部分不是 ASCII 时无法转换
+func downgradeAddress(addr string) (string, error) {
+	if isASCII(addr) {
+		return addr, nil
+	}
+	local, _ := splitAddress(addr)
+	if !isASCII(local) {
+		return "", ErrUTF8Downgrade
+	}
+	return ToASCIIAddress(addr)
+}
+
+// utf8Options 信封地址包含非 ASCII 字符并且服务支持 SMTPUTF8 时返回带有 UTF8 的参数副本
+func (c *Client) utf8Options(opts *MailOptions, addrs ...string) *MailOptions {
+	if opts != nil && opts.UTF8 {
+		return opts
+	}
+	// hello 的错误会被缓存，由随后的 MAIL 命令返回
+	if err := c.hello(); err != nil {
+		return opts
+	}
+	if _, ok := c.ext["SMTPUTF8"]; !ok {
+		return opts
+	}
+	for _, addr := range addrs {
+		if !isASCII(addr) {
+			utf8Opts := &MailOptions{}
+			if opts != nil {
+				*utf8Opts = *opts
+			}
+			utf8Opts.UTF8 = true
+			return utf8Opts
+		}
+	}
+	return opts
+}
+
+// envelopeAddress 返回 MAIL 或者 RCPT 命令中使用的地址，当前事务没有声明 SMTPUTF8 时降级为 ASCII
+func (c *Client) envelopeAddress(addr string) (string, error) {
+	if c.utf8 {
+		return addr, nil
+	}
+	return downgradeAddress(addr)
+}
+
+// checkUTF8Address 检查 MAIL 或者 RCPT 命令中的地址，返回是否已经拒绝
+//
+// 域名不是合法的 IDN 时使用 553、ec 和 invalid 对应的文本回复
+func (c *Conn) checkUTF8Address(addr string, utf8 bool, ec EnhancedCode, invalid ReplyID) bool {
+	if isASCII(addr) {
+		return false
+	}
+	if !utf8 {
+		c.reply(ErrSMTPUTF8Required.Code, ErrSMTPUTF8Required.EnhancedCode, ReplySMTPUTF8Required)
+		return true
+	}
+	if !validAddressDomain(addr) {
+		c.reply(553, ec, invalid)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package smtp
+
+import (
+	"fmt"
+)
+
+// ETRNRequest ETRN 命令的参数（RFC 1985）
+type ETRNRequest struct {
+	Node       string // 域名，或者 Queue 为 true 时的队列名称
+	Subdomains bool   // "@example.com"，包括所有子域名
+	Queue      bool   // "#name"，Node 是服务自定义的队列名称
+}
+
+func (r *ETRNRequest) String() string {
+	switch {
+	case r.Subdomains:
+		return "@" + r.Node
+	case r.Queue:
+		return "#" + r.Node
+	}
+	return r.Node
+}
+
+// QueueFlusher 后端可选实现的接口，用于备用 MX 在主服务上线后投递排队的邮件
+//
+// 后端实现之后服务在 EHLO 中声明 ETRN 并处理 ETRN 命令。FlushQueue 应该只启动投递，
+// 不等待投递完成；返回排队的邮件数量，没有邮件时返回 0，不知道数量时返回 -1。
+// 不允许的节点返回 459 的 SMTPError。
+type QueueFlusher interface {
+	FlushQueue(state ConnectionState, req *ETRNRequest) (pending int, err error)
+}
+
+// parseETRNArgument 解析 ETRN 的参数，"@" 和 "#" 前缀分别表示子域名和队列名称
+func parseETRNArgument(arg string) (*ETRNRequest, error) {
+	req := &ETRNRequest{}
+	switch {
+	case len(arg) > 0 && arg[0] == '@':
+		req.Subdomains = true
+		arg = arg[1:]
+	case len(arg) > 0 && arg[0] == '#':
+		req.Queue = true
+		arg = arg[1:]
+	}
+	if arg == "" {
+		return nil, fmt.Errorf("smtp: ETRN requires a node name")
+	}
+	if !req.Queue {
+		p := pathParser{s: arg}
+		if err := p.domain(); err != nil || p.i != len(arg) {
+			return nil, fmt.Errorf("smtp: invalid ETRN node %q", arg)
+		}
+	} else if !isESMTPValue(arg) {
+		return nil, fmt.Errorf("smtp: invalid ETRN queue name %q", arg)
+	}
+	req.Node = arg
+	return req, nil
+}
+
+// handleEtrn 处理 ETRN 命令
+func (c *Conn) handleEtrn(arg string) {
+	flusher, ok := c.server.Backend.(QueueFlusher)
+	if !ok {
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyNotImplemented, "Command", "ETRN")
+		return
+	}
+	if c.helo == "" {
+		c.reply(503, EnhancedCode{5, 5, 1}, ReplyHelloFirst)
+		return
+	}
+	// RFC 1985 第 5 节：邮件事务中不能使用 ETRN
+	if c.fromReceived {
+		c.reply(503, EnhancedCode{5, 5, 1}, ReplyEtrnTransaction)
+		return
+	}
+	if c.startTLSRequired() || c.submissionAuthRequired() {
+		return
+	}
+	req, err := parseETRNArgument(arg)
+	if err != nil {
+		c.reply(501, EnhancedCode{5, 5, 4}, ReplyEtrnSyntax)
+		return
+	}
+
+	pending, err := flusher.FlushQueue(c.State(), req)
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, c.errorText(smtpErr))
+			return
+		}
+		c.reply(458, EnhancedCode{4, 0, 0}, ReplyEtrnFailed, "Node", req)
+		return
+	}
+	switch {
+	case pending == 0:
+		c.reply(251, EnhancedCode{2, 0, 0}, ReplyEtrnEmpty, "Node", req)
+	case pending < 0:
+		c.reply(250, EnhancedCode{2, 0, 0}, ReplyEtrnStarted, "Node", req)
+	default:
+		c.reply(253, EnhancedCode{2, 0, 0}, ReplyEtrnPending, "Node", req, "Pending", pending)
+	}
+}
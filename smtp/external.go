@@ -0,0 +1,89 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
+)
+
+var ErrNoClientCert = &SMTPError{
+	Code:         535,
+	EnhancedCode: EnhancedCode{5, 7, 8},
+	Message:      "No verified client certificate",
+}
+
+// CertMapper 把经过验证的TLS客户端证书映射为用户名
+type CertMapper interface {
+	MapCert(cert *x509.Certificate) (string, error)
+}
+
+// CertMapping 默认的证书映射规则，按照 指纹表、SAN邮箱、CN 的顺序查找用户名
+type CertMapping struct {
+	// 证书SHA-256指纹到用户名的映射，指纹为十六进制，不区分大小写，可以包含冒号
+	Fingerprints map[string]string
+	// 使用证书 SAN 中的第一个邮箱作为用户名
+	EmailSAN bool
+	// 使用证书 Subject 的 CN 作为用户名
+	CommonName bool
+}
+
+// CertFingerprint 计算证书的SHA-256指纹
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *CertMapping) MapCert(cert *x509.Certificate) (string, error) {
+	if len(m.Fingerprints) > 0 {
+		fingerprint := CertFingerprint(cert)
+		for k, username := range m.Fingerprints {
+			if strings.EqualFold(strings.ReplaceAll(k, ":", ""), fingerprint) {
+				return username, nil
+			}
+		}
+	}
+	if m.EmailSAN && len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0], nil
+	}
+	if m.CommonName && cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, nil
+	}
+	return "", errors.New("smtp: 无法从客户端证书中获取用户名")
+}
+
+// EnableExternalAuth 开启 SASL EXTERNAL 认证，用户身份来自经过验证的TLS客户端证书
+//
+// TLSConfig 需要设置 ClientCAs，并且 ClientAuth 至少为 tls.VerifyClientCertIfGiven，
+// 会话收到 *CertCredential 凭据。
+func (s *Server) EnableExternalAuth(mapper CertMapper) {
+	s.EnableAuth(sasl.External, func(conn *Conn) sasl.Server {
+		return sasl.NewExternalServer(func(identity string) error {
+			state, ok := conn.TLSConnectionState()
+			if !ok || len(state.VerifiedChains) == 0 {
+				return ErrNoClientCert
+			}
+
+			cert := state.VerifiedChains[0][0]
+			username, err := mapper.MapCert(cert)
+			if err != nil {
+				return &SMTPError{
+					Code:         535,
+					EnhancedCode: EnhancedCode{5, 7, 8},
+					Message:      conn.server.replyText(ReplyCertNotMapped, "Error", err.Error()),
+				}
+			}
+			if identity != "" && identity != username {
+				return errIdentityUnsupported
+			}
+
+			return conn.Authenticate(sasl.External, &CertCredential{
+				Username:    username,
+				Certificate: cert,
+			})
+		})
+	})
+}
@@ -0,0 +1,48 @@
+package smtp
+
+import (
+	"strings"
+)
+
+// DefaultHelpText Server.HelpText 为空时使用的帮助文本
+//
+// 键为大写的主题，"" 对应不带参数的 HELP。需要其他语言时复制一份并替换文本，
+// 设置到 Server.HelpText 即可。
+var DefaultHelpText = map[string][]string{
+	"": {
+		"Commands supported:",
+		"HELO EHLO MAIL RCPT DATA BDAT RSET NOOP QUIT",
+		"VRFY EXPN AUTH STARTTLS ETRN HELP",
+		"Use HELP <command> for more information",
+	},
+	"HELO":     {"HELO <domain>", "Identify yourself to the server"},
+	"EHLO":     {"EHLO <domain>", "Identify yourself and list the supported extensions"},
+	"MAIL":     {"MAIL FROM:<sender> [parameters]", "Start a mail transaction"},
+	"RCPT":     {"RCPT TO:<recipient>", "Add a recipient to the current transaction"},
+	"DATA":     {"DATA", "Send the message, end it with a line containing a single \".\""},
+	"BDAT":     {"BDAT <size> [LAST]", "Send a chunk of the message (RFC 3030)"},
+	"RSET":     {"RSET", "Abort the current transaction"},
+	"NOOP":     {"NOOP", "Do nothing"},
+	"QUIT":     {"QUIT", "Close the connection"},
+	"VRFY":     {"VRFY <user>", "Verify a mailbox, if enabled by the server"},
+	"EXPN":     {"EXPN <list>", "Expand a mailing list, if enabled by the server"},
+	"AUTH":     {"AUTH <mechanism> [initial-response]", "Authenticate (RFC 4954)"},
+	"STARTTLS": {"STARTTLS", "Start a TLS session (RFC 3207)"},
+	"ETRN":     {"ETRN [@|#]<node>", "Start delivery of queued mail for a node (RFC 1985)"},
+	"HELP":     {"HELP [topic]", "Show help for a command"},
+}
+
+// handleHelp 处理 HELP 命令，使用 214 的多行响应返回帮助文本
+func (c *Conn) handleHelp(arg string) {
+	help := c.server.HelpText
+	if help == nil {
+		help = DefaultHelpText
+	}
+	topic := strings.ToUpper(strings.TrimSpace(arg))
+	text, ok := help[topic]
+	if !ok || len(text) == 0 {
+		c.reply(504, EnhancedCode{5, 5, 4}, ReplyHelpUnknown)
+		return
+	}
+	c.WriteResponse(214, EnhancedCode{2, 0, 0}, text...)
+}
@@ -0,0 +1,34 @@
+package smtp
+
+import (
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
+)
+
+// EnableOAuthAuth 开启 OAUTHBEARER 和 XOAUTH2 认证，使用 validator 校验访问令牌
+//
+// 会替换内置的 OAUTHBEARER 和 XOAUTH2，会话收到 *VerifiedCredential 凭据。
+func (s *Server) EnableOAuthAuth(validator sasl.TokenValidator) {
+	s.EnableAuth(sasl.OAuthBearer, func(conn *Conn) sasl.Server {
+		check := sasl.OAuthBearerValidator(validator, func(username string) error {
+			return conn.Authenticate(sasl.OAuthBearer, &VerifiedCredential{Username: username})
+		})
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			// 校验令牌之前检查客户端给出的用户名是否被锁定
+			if err := conn.authStart(opts.Username); err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			return check(opts)
+		})
+	})
+	s.EnableAuth(sasl.XOAuth2, func(conn *Conn) sasl.Server {
+		check := sasl.XOAuth2Validator(validator, func(username string) error {
+			return conn.Authenticate(sasl.XOAuth2, &VerifiedCredential{Username: username})
+		})
+		return sasl.NewXOAuth2Server(func(username, token string) *sasl.OAuthBearerError {
+			if err := conn.authStart(username); err != nil {
+				return &sasl.OAuthBearerError{Status: "401", Schemes: "Bearer"}
+			}
+			return check(username, token)
+		})
+	})
+}
@@ -1,56 +1,64 @@
 package smtp
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"strings"
 )
 
-// 解析命令
+// 解析命令，命令名是第一个空格之前的部分，不限制长度
 func parseCmd(line string) (cmd string, arg string, err error) {
 	line = strings.TrimRight(line, "\r\n")
 
-	l := len(line)
 	switch {
 	case strings.HasPrefix(strings.ToUpper(line), "STARTTLS"):
 		return "STARTTLS", "", nil
-	case l == 0:
+	case line == "":
 		return "", "", nil
-	case l < 4:
-		return "", "", fmt.Errorf("命令太短了: %q", line)
-	case l == 4:
-		return strings.ToUpper(line), "", nil
-	case l == 5:
-		// Too long to be only command, too short to have args
-		return "", "", fmt.Errorf("Mangled command: %q", line)
 	}
 
-	// If we made it here, command is long enough to have args
-	if line[4] != ' ' {
-		// There wasn't a space after the command?
-		return "", "", fmt.Errorf("Mangled command: %q", line)
+	name, arg := line, ""
+	if idx := strings.IndexByte(line, ' '); idx >= 0 {
+		name, arg = line[:idx], line[idx+1:]
 	}
-
-	// I'm not sure if we should trim the args or not, but we will for now
-	//return strings.ToUpper(line[0:4]), strings.Trim(line[5:], " "), nil
-	return strings.ToUpper(line[0:4]), strings.Trim(line[5:], " \n\r"), nil
+	if len(name) < 4 {
+		return "", "", fmt.Errorf("命令太短了: %q", line)
+	}
+	for i := 0; i < len(name); i++ {
+		if !isAlpha(name[i]) {
+			return "", "", fmt.Errorf("Mangled command: %q", line)
+		}
+	}
+	return strings.ToUpper(name), strings.Trim(arg, " \n\r"), nil
 }
 
-// 解析参数
+// 解析 esmtp 参数（RFC 5321 4.1.2），关键字转换为大写
+//
+// 值在第一个 = 之后，为了兼容没有使用 xtext 编码的客户端，值中允许出现 =。
+// 非 ASCII 字符在 SMTPUTF8 中是合法的（RFC 6531）。
 func parseArgs(args []string) (map[string]string, error) {
 	argMap := map[string]string{}
 	for _, arg := range args {
 		if arg == "" {
 			continue
 		}
-		m := strings.Split(arg, "=")
-		switch len(m) {
-		case 2:
-			argMap[strings.ToUpper(m[0])] = m[1]
-		case 1:
-			argMap[strings.ToUpper(m[0])] = ""
-		default:
+		key, value := arg, ""
+		hasValue := false
+		if idx := strings.IndexByte(arg, '='); idx >= 0 {
+			key, value, hasValue = arg[:idx], arg[idx+1:], true
+		}
+		if !isESMTPKeyword(key) {
+			return nil, fmt.Errorf("解析参数字符串失败: %q", arg)
+		}
+		if hasValue && !isESMTPValue(value) {
 			return nil, fmt.Errorf("解析参数字符串失败: %q", arg)
 		}
+		key = strings.ToUpper(key)
+		if _, ok := argMap[key]; ok {
+			return nil, fmt.Errorf("重复的参数: %q", key)
+		}
+		argMap[key] = value
 	}
 	return argMap, nil
 }
@@ -65,3 +73,324 @@ func parseHelloArgument(arg string) (string, error) {
 	}
 	return domain, nil
 }
+
+// parseCommandPath 解析 MAIL 和 RCPT 命令的参数，例如 "FROM:<a@example.com> SIZE=100"
+//
+// prefix 是 "FROM:" 或者 "TO:"，返回去掉尖括号和源路由之后的地址，以及剩余的 esmtp 参数。
+// 非严格模式下允许冒号之后有空格以及没有尖括号的地址。
+func parseCommandPath(arg, prefix string, null, strict bool) (addr string, args []string, err error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, errors.New("smtp: missing " + prefix)
+	}
+	s := arg[len(prefix):]
+	if !strict {
+		s = strings.TrimLeft(s, " ")
+	}
+
+	p := pathParser{s: s}
+	if strings.HasPrefix(s, "<") || strict {
+		addr, err = p.path(null, !null)
+	} else {
+		addr, err = p.mailbox(!null)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	rest := s[p.i:]
+	if rest == "" {
+		return addr, nil, nil
+	}
+	if rest[0] != ' ' {
+		return "", nil, fmt.Errorf("smtp: unexpected %q after path", rest)
+	}
+	if strict {
+		args = strings.Split(rest[1:], " ")
+		for _, a := range args {
+			if a == "" {
+				return "", nil, errors.New("smtp: empty parameter")
+			}
+		}
+	} else {
+		args = strings.Fields(rest)
+	}
+	return addr, args, nil
+}
+
+// formatPath 返回客户端命令中使用的路径，空地址表示空的 reverse-path
+//
+// 本地部分不是合法的 Dot-string 时使用 Quoted-string，无法表示的地址返回错误。
+func formatPath(addr string, null bool) (string, error) {
+	if addr == "" && null {
+		return "<>", nil
+	}
+	if validMailbox(addr, !null) {
+		return "<" + addr + ">", nil
+	}
+	local, domain := splitAddress(addr)
+	if domain != "" {
+		if quoted, ok := quoteLocalPart(local); ok && validMailbox(quoted+"@"+domain, false) {
+			return "<" + quoted + "@" + domain + ">", nil
+		}
+	}
+	return "", fmt.Errorf("smtp: invalid address %q", addr)
+}
+
+// validMailbox 报告字符串是否是一个完整的 Mailbox
+func validMailbox(addr string, postmaster bool) bool {
+	p := pathParser{s: addr}
+	_, err := p.mailbox(postmaster)
+	return err == nil && p.i == len(addr)
+}
+
+// quoteLocalPart 把本地部分表示为 Quoted-string，包含控制字符时无法表示
+func quoteLocalPart(local string) (string, bool) {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(local); i++ {
+		ch := local[i]
+		switch {
+		case ch == '"' || ch == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case ch >= 32 && ch != 127:
+			b.WriteByte(ch)
+		default:
+			return "", false
+		}
+	}
+	b.WriteByte('"')
+	return b.String(), true
+}
+
+// pathParser 按照 RFC 5321 4.1.2 的语法解析路径
+//
+// 本地部分和域名中允许 RFC 6531 的非 ASCII 字符，是否声明了 SMTPUTF8 由调用者检查。
+type pathParser struct {
+	s string
+	i int
+}
+
+func (p *pathParser) peek() byte {
+	if p.i >= len(p.s) {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *pathParser) consume(ch byte) bool {
+	if p.peek() != ch {
+		return false
+	}
+	p.i++
+	return true
+}
+
+func (p *pathParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("smtp: invalid path at offset %d: %s", p.i, fmt.Sprintf(format, args...))
+}
+
+// path 解析 Path = "<" [ A-d-l ":" ] Mailbox ">"，null 为 true 时允许 "<>"，
+// postmaster 为 true 时允许没有域名的 "<Postmaster>"
+func (p *pathParser) path(null, postmaster bool) (string, error) {
+	if !p.consume('<') {
+		return "", p.errorf("expected '<'")
+	}
+	if null && p.consume('>') {
+		return "", nil
+	}
+
+	// 源路由会被忽略（RFC 5321 4.1.2）
+	if p.peek() == '@' {
+		for {
+			if !p.consume('@') {
+				return "", p.errorf("expected '@' in source route")
+			}
+			if err := p.domain(); err != nil {
+				return "", err
+			}
+			if !p.consume(',') {
+				break
+			}
+		}
+		if !p.consume(':') {
+			return "", p.errorf("expected ':' after source route")
+		}
+	}
+
+	mailbox, err := p.mailbox(postmaster)
+	if err != nil {
+		return "", err
+	}
+	if !p.consume('>') {
+		return "", p.errorf("expected '>'")
+	}
+	return mailbox, nil
+}
+
+// mailbox 解析 Mailbox = Local-part "@" ( Domain / address-literal )
+func (p *pathParser) mailbox(postmaster bool) (string, error) {
+	start := p.i
+	if p.peek() == '"' {
+		if err := p.quotedString(); err != nil {
+			return "", err
+		}
+	} else if err := p.dotString(); err != nil {
+		return "", err
+	}
+
+	if !p.consume('@') {
+		if postmaster && strings.EqualFold(p.s[start:p.i], "postmaster") {
+			return p.s[start:p.i], nil
+		}
+		return "", p.errorf("expected '@'")
+	}
+	if p.peek() == '[' {
+		if err := p.addressLiteral(); err != nil {
+			return "", err
+		}
+	} else if err := p.domain(); err != nil {
+		return "", err
+	}
+	return p.s[start:p.i], nil
+}
+
+// dotString 解析 Dot-string = Atom *("." Atom)
+func (p *pathParser) dotString() error {
+	for {
+		start := p.i
+		for p.i < len(p.s) && (isAtext(p.s[p.i]) || p.s[p.i] >= 0x80) {
+			p.i++
+		}
+		if p.i == start {
+			return p.errorf("expected atom")
+		}
+		if !p.consume('.') {
+			return nil
+		}
+	}
+}
+
+// quotedString 解析 Quoted-string = DQUOTE *QcontentSMTP DQUOTE
+func (p *pathParser) quotedString() error {
+	p.consume('"')
+	for p.i < len(p.s) {
+		ch := p.s[p.i]
+		p.i++
+		switch {
+		case ch == '"':
+			return nil
+		case ch == '\\':
+			if p.i >= len(p.s) || p.s[p.i] < 32 || p.s[p.i] > 126 {
+				return p.errorf("invalid quoted-pair")
+			}
+			p.i++
+		case ch >= 32 && ch <= 126, ch >= 0x80:
+		default:
+			return p.errorf("invalid character in quoted string")
+		}
+	}
+	return p.errorf("unterminated quoted string")
+}
+
+// domain 解析 Domain = sub-domain *("." sub-domain)，sub-domain = Let-dig [Ldh-str]
+func (p *pathParser) domain() error {
+	start := p.i
+	for {
+		labelStart := p.i
+		for p.i < len(p.s) && (isLetDig(p.s[p.i]) || p.s[p.i] == '-' || p.s[p.i] >= 0x80) {
+			p.i++
+		}
+		label := p.s[labelStart:p.i]
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return p.errorf("invalid domain label %q", label)
+		}
+		if !p.consume('.') {
+			break
+		}
+	}
+	if p.i-start > 255 {
+		return p.errorf("domain too long")
+	}
+	return nil
+}
+
+// addressLiteral 解析 "[" ( IPv4 / "IPv6:" IPv6 / General-address-literal ) "]"
+func (p *pathParser) addressLiteral() error {
+	p.consume('[')
+	end := strings.IndexByte(p.s[p.i:], ']')
+	if end < 0 {
+		return p.errorf("unterminated address literal")
+	}
+	literal := p.s[p.i : p.i+end]
+	p.i += end + 1
+
+	if idx := strings.IndexByte(literal, ':'); idx >= 0 {
+		tag, value := literal[:idx], literal[idx+1:]
+		if strings.EqualFold(tag, "IPv6") {
+			if ip := net.ParseIP(value); ip == nil || !strings.Contains(value, ":") {
+				return p.errorf("invalid IPv6 address literal")
+			}
+			return nil
+		}
+		// General-address-literal = Standardized-tag ":" 1*dcontent
+		if tag == "" || !isLetDig(tag[len(tag)-1]) || value == "" {
+			return p.errorf("invalid address literal")
+		}
+		for i := 0; i < len(tag); i++ {
+			if !isLetDig(tag[i]) && tag[i] != '-' {
+				return p.errorf("invalid address literal tag")
+			}
+		}
+		for i := 0; i < len(value); i++ {
+			if ch := value[i]; ch < 33 || ch > 126 || ch == '[' || ch == '\\' || ch == ']' {
+				return p.errorf("invalid address literal")
+			}
+		}
+		return nil
+	}
+
+	if ip := net.ParseIP(literal); ip == nil || ip.To4() == nil || strings.Contains(literal, ":") {
+		return p.errorf("invalid IPv4 address literal")
+	}
+	return nil
+}
+
+func isAlpha(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isLetDig(ch byte) bool {
+	return isAlpha(ch) || (ch >= '0' && ch <= '9')
+}
+
+// isAtext 报告字符是否是 RFC 5322 atext
+func isAtext(ch byte) bool {
+	return isLetDig(ch) || strings.IndexByte("!#$%&'*+-/=?^_`{|}~", ch) >= 0
+}
+
+// isESMTPKeyword esmtp-keyword = (ALPHA / DIGIT) *(ALPHA / DIGIT / "-")
+func isESMTPKeyword(s string) bool {
+	if s == "" || !isLetDig(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isLetDig(s[i]) && s[i] != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// isESMTPValue 值不能为空，不能包含空格和控制字符
+func isESMTPValue(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] == 127 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,224 @@
+package smtp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCmd(t *testing.T) {
+	tests := []struct {
+		line    string
+		cmd     string
+		arg     string
+		wantErr bool
+	}{
+		{"", "", "", false},
+		{"HELO localhost", "HELO", "localhost", false},
+		{"ehlo localhost\r\n", "EHLO", "localhost", false},
+		{"MAIL FROM:<a@example.com>", "MAIL", "FROM:<a@example.com>", false},
+		{"rcpt TO:<b@example.com>  ", "RCPT", "TO:<b@example.com>", false},
+		{"QUIT", "QUIT", "", false},
+		{"STARTTLS", "STARTTLS", "", false},
+		{"starttls\r\n", "STARTTLS", "", false},
+		{"XCLIENTLONGNAME arg", "XCLIENTLONGNAME", "arg", false},
+		{"HI there", "", "", true},
+		{"MA1L FROM:<a@example.com>", "", "", true},
+		{"MAIL:FROM:<a@example.com>", "", "", true},
+	}
+	for _, tc := range tests {
+		cmd, arg, err := parseCmd(tc.line)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseCmd(%q) error = %v, want error %v", tc.line, err, tc.wantErr)
+			continue
+		}
+		if cmd != tc.cmd || arg != tc.arg {
+			t.Errorf("parseCmd(%q) = %q, %q, want %q, %q", tc.line, cmd, arg, tc.cmd, tc.arg)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{nil, map[string]string{}, false},
+		{[]string{"SIZE=1000"}, map[string]string{"SIZE": "1000"}, false},
+		{[]string{"body=8BITMIME", "smtputf8"}, map[string]string{"BODY": "8BITMIME", "SMTPUTF8": ""}, false},
+		{[]string{"AUTH=<a=b@example.com>"}, map[string]string{"AUTH": "<a=b@example.com>"}, false},
+		{[]string{"ENVID=a+3Db=c"}, map[string]string{"ENVID": "a+3Db=c"}, false},
+		{[]string{"X-FOO=bar", ""}, map[string]string{"X-FOO": "bar"}, false},
+		{[]string{"SIZE=1", "size=2"}, nil, true},
+		{[]string{"SIZE="}, nil, true},
+		{[]string{"-SIZE=1"}, nil, true},
+		{[]string{"SI_ZE=1"}, nil, true},
+		{[]string{"=1"}, nil, true},
+		{[]string{"SIZE=1\x7f"}, nil, true},
+	}
+	for _, tc := range tests {
+		got, err := parseArgs(tc.args)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseArgs(%q) error = %v, want error %v", tc.args, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseArgs(%q) = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestParseCommandPath(t *testing.T) {
+	tests := []struct {
+		arg     string
+		prefix  string
+		strict  bool
+		addr    string
+		args    []string
+		wantErr bool
+	}{
+		// 基本形式
+		{"FROM:<a@example.com>", "FROM:", true, "a@example.com", nil, false},
+		{"from:<a@example.com>", "FROM:", true, "a@example.com", nil, false},
+		{"TO:<b@example.com>", "TO:", true, "b@example.com", nil, false},
+		{"FROM:<a@example.com> SIZE=100 BODY=8BITMIME", "FROM:", true, "a@example.com", []string{"SIZE=100", "BODY=8BITMIME"}, false},
+		{"FROM:<a@example.com>SIZE=100", "FROM:", true, "", nil, true},
+		{"MAIL:<a@example.com>", "FROM:", true, "", nil, true},
+		{"FROM:", "FROM:", true, "", nil, true},
+
+		// 空地址和 Postmaster
+		{"FROM:<>", "FROM:", true, "", nil, false},
+		{"FROM:<> SIZE=10", "FROM:", true, "", []string{"SIZE=10"}, false},
+		{"TO:<>", "TO:", true, "", nil, true},
+		{"TO:<Postmaster>", "TO:", true, "Postmaster", nil, false},
+		{"TO:<postmaster>", "TO:", true, "postmaster", nil, false},
+		{"FROM:<Postmaster>", "FROM:", true, "", nil, true},
+		{"TO:<admin>", "TO:", true, "", nil, true},
+
+		// 源路由被忽略
+		{"TO:<@relay.example.com:b@example.com>", "TO:", true, "b@example.com", nil, false},
+		{"TO:<@a.example,@b.example:b@example.com>", "TO:", true, "b@example.com", nil, false},
+		{"TO:<@a.example,b.example:b@example.com>", "TO:", true, "", nil, true},
+		{"TO:<@a.example b@example.com>", "TO:", true, "", nil, true},
+
+		// Quoted-string 本地部分
+		{`FROM:<"john smith"@example.com>`, "FROM:", true, `"john smith"@example.com`, nil, false},
+		{`FROM:<"a\"b"@example.com>`, "FROM:", true, `"a\"b"@example.com`, nil, false},
+		{`FROM:<"a\\b"@example.com>`, "FROM:", true, `"a\\b"@example.com`, nil, false},
+		{`FROM:<"unterminated@example.com>`, "FROM:", true, "", nil, true},
+		{"FROM:<\"a\x01b\"@example.com>", "FROM:", true, "", nil, true},
+		{"FROM:<a b@example.com>", "FROM:", true, "", nil, true},
+		{"FROM:<a..b@example.com>", "FROM:", true, "", nil, true},
+		{"FROM:<.a@example.com>", "FROM:", true, "", nil, true},
+
+		// 地址字面量
+		{"TO:<a@[192.0.2.1]>", "TO:", true, "a@[192.0.2.1]", nil, false},
+		{"TO:<a@[IPv6:2001:db8::1]>", "TO:", true, "a@[IPv6:2001:db8::1]", nil, false},
+		{"TO:<a@[ipv6:::1]>", "TO:", true, "a@[ipv6:::1]", nil, false},
+		{"TO:<a@[x-tag:some-address]>", "TO:", true, "a@[x-tag:some-address]", nil, false},
+		{"TO:<a@[192.0.2.256]>", "TO:", true, "", nil, true},
+		{"TO:<a@[2001:db8::1]>", "TO:", true, "a@[2001:db8::1]", nil, false}, // General-address-literal，标签是 "2001"
+		{"TO:<a@[IPv6:192.0.2.1]>", "TO:", true, "", nil, true},
+		{"TO:<a@[tag-:x]>", "TO:", true, "", nil, true},
+		{"TO:<a@[tag:]>", "TO:", true, "", nil, true},
+		{"TO:<a@[192.0.2.1>", "TO:", true, "", nil, true},
+
+		// 域名
+		{"TO:<a@-example.com>", "TO:", true, "", nil, true},
+		{"TO:<a@example-.com>", "TO:", true, "", nil, true},
+		{"TO:<a@example..com>", "TO:", true, "", nil, true},
+		{"TO:<a@>", "TO:", true, "", nil, true},
+		{"TO:<用户@例子.测试>", "TO:", true, "用户@例子.测试", nil, false},
+
+		// 严格模式和宽松模式
+		{"FROM: <a@example.com>", "FROM:", true, "", nil, true},
+		{"FROM: <a@example.com>", "FROM:", false, "a@example.com", nil, false},
+		{"FROM:a@example.com", "FROM:", true, "", nil, true},
+		{"FROM:a@example.com", "FROM:", false, "a@example.com", nil, false},
+		{"FROM: a@example.com SIZE=1", "FROM:", false, "a@example.com", []string{"SIZE=1"}, false},
+		{"FROM:<a@example.com>  SIZE=1", "FROM:", true, "", nil, true},
+		{"FROM:<a@example.com>  SIZE=1", "FROM:", false, "a@example.com", []string{"SIZE=1"}, false},
+		{"FROM:<a@example.com> ", "FROM:", true, "", nil, true},
+		{"FROM:<a@example.com> ", "FROM:", false, "a@example.com", []string{}, false},
+	}
+	for _, tc := range tests {
+		null := tc.prefix == "FROM:"
+		addr, args, err := parseCommandPath(tc.arg, tc.prefix, null, tc.strict)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseCommandPath(%q, strict=%v) error = %v, want error %v", tc.arg, tc.strict, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		if addr != tc.addr {
+			t.Errorf("parseCommandPath(%q, strict=%v) addr = %q, want %q", tc.arg, tc.strict, addr, tc.addr)
+		}
+		if len(args) != len(tc.args) || (len(args) > 0 && !reflect.DeepEqual(args, tc.args)) {
+			t.Errorf("parseCommandPath(%q, strict=%v) args = %q, want %q", tc.arg, tc.strict, args, tc.args)
+		}
+	}
+}
+
+func TestFormatPath(t *testing.T) {
+	tests := []struct {
+		addr    string
+		null    bool
+		want    string
+		wantErr bool
+	}{
+		{"", true, "<>", false},
+		{"", false, "", true},
+		{"a@example.com", false, "<a@example.com>", false},
+		{"Postmaster", false, "<Postmaster>", false},
+		{"Postmaster", true, "", true},
+		{"john smith@example.com", false, `<"john smith"@example.com>`, false},
+		{`a"b@example.com`, false, `<"a\"b"@example.com>`, false},
+		{`a\b@example.com`, false, `<"a\\b"@example.com>`, false},
+		{"a..b@example.com", false, `<"a..b"@example.com>`, false},
+		{`"john smith"@example.com`, false, `<"john smith"@example.com>`, false},
+		{"a@[192.0.2.1]", false, "<a@[192.0.2.1]>", false},
+		{"a@[IPv6:2001:db8::1]", false, "<a@[IPv6:2001:db8::1]>", false},
+		{"用户@例子.测试", false, "<用户@例子.测试>", false},
+		{"a\x01b@example.com", false, "", true},
+		{"a@b@example.com", false, `<"a@b"@example.com>`, false},
+		{"a@exa mple.com", false, "", true},
+		{"nodomain", false, "", true},
+	}
+	for _, tc := range tests {
+		got, err := formatPath(tc.addr, tc.null)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("formatPath(%q, %v) error = %v, want error %v", tc.addr, tc.null, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("formatPath(%q, %v) = %q, want %q", tc.addr, tc.null, got, tc.want)
+		}
+	}
+}
+
+// FuzzParseCommandPath 解析成功的路径经过 formatPath 之后应该解析出相同的地址，
+// 种子语料在 testdata/fuzz/FuzzParseCommandPath
+func FuzzParseCommandPath(f *testing.F) {
+	f.Fuzz(func(t *testing.T, arg string, strict bool) {
+		prefix, null := "FROM:", true
+		if len(arg) >= 3 && (arg[0] == 'T' || arg[0] == 't') {
+			prefix, null = "TO:", false
+		}
+		addr, _, err := parseCommandPath(arg, prefix, null, strict)
+		if err != nil {
+			return
+		}
+		path, err := formatPath(addr, null)
+		if err != nil {
+			t.Fatalf("formatPath(%q) failed for parsed %q: %v", addr, arg, err)
+		}
+		again, args, err := parseCommandPath(prefix+path, prefix, null, true)
+		if err != nil {
+			t.Fatalf("parseCommandPath(%q) failed after round trip of %q: %v", prefix+path, arg, err)
+		}
+		if again != addr || len(args) != 0 {
+			t.Fatalf("round trip of %q: got %q %q, want %q", arg, again, args, addr)
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
+)
+
+var ErrPoolClosed = errors.New("smtp: pool closed")
+
+// Pool 连接池，为每个目标地址保持多个已经认证的连接，可以被多个协程同时使用
+//
+// 连接在两封邮件之间使用 RSET 重置，空闲一段时间的连接使用前先用 NOOP 检查，
+// 发送的邮件数量或者连接时间超过限制时关闭并重新连接。
+type Pool struct {
+	// 创建连接，为空时依次执行 Dial、EHLO、STARTTLS（服务支持时）和 AUTH（Auth 不为空时），
+	// ctx 为 SendMailContext 的参数，取消时应当停止连接
+	Dial func(ctx context.Context, addr string) (*Client, error)
+	// 默认 Dial 使用的参数
+	NetDialer ContextDialer // 为空时使用 net.Dialer
+	LocalName string
+	TLSConfig *tls.Config
+	Auth      func() sasl.Client // 每个连接调用一次，返回新的认证客户端
+
+	// 以下参数为 0 时使用默认值，MaxMessages 和 MaxAge 为负数时不限制
+	MaxConns    int           // 每个目标地址的最大连接数，默认 4
+	MaxMessages int           // 每个连接最多发送的邮件数，默认 100
+	MaxAge      time.Duration // 连接的最长使用时间，默认 5 分钟
+	IdleCheck   time.Duration // 空闲超过该时间的连接使用前先发送 NOOP，默认 30 秒，负数时不检查
+
+	mu     sync.Mutex
+	dests  map[string]*poolDest
+	closed bool
+}
+
+// poolDest 单个目标地址的连接
+type poolDest struct {
+	idle  []*pooledClient
+	slots chan struct{} // 限制同时打开的连接数
+}
+
+// pooledClient 连接池中的连接
+type pooledClient struct {
+	c        *Client
+	created  time.Time
+	lastUsed time.Time
+	messages int
+}
+
+// 连接池参数的默认值
+const (
+	defaultPoolMaxConns    = 4
+	defaultPoolMaxMessages = 100
+	defaultPoolMaxAge      = 5 * time.Minute
+	defaultPoolIdleCheck   = 30 * time.Second
+)
+
+// NewPool 创建使用默认参数的连接池，零值的 Pool 同样使用默认参数
+func NewPool() *Pool {
+	return &Pool{
+		MaxConns:    defaultPoolMaxConns,
+		MaxMessages: defaultPoolMaxMessages,
+		MaxAge:      defaultPoolMaxAge,
+		IdleCheck:   defaultPoolIdleCheck,
+	}
+}
+
+// dial 创建到目标地址的新连接
+func (p *Pool) dial(ctx context.Context, addr string) (*Client, error) {
+	if p.Dial != nil {
+		return p.Dial(ctx, addr)
+	}
+
+	c, err := (&Dialer{NetDialer: p.NetDialer}).DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	err = c.withContext(ctx, func() error {
+		if p.LocalName != "" {
+			if err := c.Hello(p.LocalName); err != nil {
+				return err
+			}
+		}
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			config := p.TLSConfig
+			if config == nil {
+				host, _, _ := net.SplitHostPort(addr)
+				config = &tls.Config{ServerName: host}
+			}
+			if err := c.StartTLS(config); err != nil {
+				return err
+			}
+		}
+		if p.Auth != nil {
+			return c.Auth(p.Auth())
+		}
+		return nil
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dest 返回目标地址的连接信息
+func (p *Pool) dest(addr string) (*poolDest, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	if p.dests == nil {
+		p.dests = make(map[string]*poolDest)
+	}
+	d := p.dests[addr]
+	if d == nil {
+		n := p.MaxConns
+		if n <= 0 {
+			n = defaultPoolMaxConns
+		}
+		d = &poolDest{slots: make(chan struct{}, n)}
+		p.dests[addr] = d
+	}
+	return d, nil
+}
+
+// expired 报告连接是否已经达到邮件数量或者使用时间的限制
+func (p *Pool) expired(pc *pooledClient, now time.Time) bool {
+	maxMessages := p.MaxMessages
+	if maxMessages == 0 {
+		maxMessages = defaultPoolMaxMessages
+	}
+	if maxMessages > 0 && pc.messages >= maxMessages {
+		return true
+	}
+	maxAge := p.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultPoolMaxAge
+	}
+	return maxAge > 0 && now.Sub(pc.created) >= maxAge
+}
+
+// get 取出一个可以使用的连接，没有空闲连接时创建新连接，调用者必须已经占用了 slot
+func (p *Pool) get(ctx context.Context, addr string, d *poolDest) (*pooledClient, error) {
+	for {
+		p.mu.Lock()
+		var pc *pooledClient
+		if n := len(d.idle); n > 0 {
+			pc = d.idle[n-1]
+			d.idle = d.idle[:n-1]
+		}
+		p.mu.Unlock()
+
+		if pc == nil {
+			c, err := p.dial(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			now := time.Now()
+			return &pooledClient{c: c, created: now, lastUsed: now}, nil
+		}
+
+		now := time.Now()
+		if p.expired(pc, now) {
+			pc.c.Quit()
+			pc.c.Close()
+			continue
+		}
+		err := pc.c.withContext(ctx, func() error {
+			idleCheck := p.IdleCheck
+			if idleCheck == 0 {
+				idleCheck = defaultPoolIdleCheck
+			}
+			if idleCheck > 0 && now.Sub(pc.lastUsed) >= idleCheck {
+				if err := pc.c.Noop(); err != nil {
+					return err
+				}
+			}
+			return pc.c.Reset()
+		})
+		if err != nil {
+			pc.c.Close()
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			continue
+		}
+		return pc, nil
+	}
+}
+
+// put 把连接放回连接池，连接已经失效或者连接池已经关闭时关闭连接
+func (p *Pool) put(d *poolDest, pc *pooledClient, reuse bool) {
+	pc.lastUsed = time.Now()
+
+	p.mu.Lock()
+	reuse = reuse && !p.closed && !p.expired(pc, pc.lastUsed)
+	if reuse {
+		d.idle = append(d.idle, pc)
+	}
+	p.mu.Unlock()
+
+	if !reuse {
+		pc.c.Quit()
+		pc.c.Close()
+	}
+}
+
+// SendMail 使用连接池中的连接发送邮件，连接数达到上限时等待其他发送完成
+func (p *Pool) SendMail(addr string, from string, to []string, r io.Reader) error {
+	return p.SendMailContext(context.Background(), addr, from, to, r)
+}
+
+// SendMailContext 与 SendMail 相同，取消 ctx 会停止等待连接并中断发送
+func (p *Pool) SendMailContext(ctx context.Context, addr string, from string, to []string, r io.Reader) error {
+	d, err := p.dest(addr)
+	if err != nil {
+		return err
+	}
+	select {
+	case d.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-d.slots }()
+
+	pc, err := p.get(ctx, addr, d)
+	if err != nil {
+		return err
+	}
+
+	// 服务返回的错误一般不影响连接，但是中止事务时会关闭连接，网络错误或者取消之后连接也不能继续使用
+	reuse := false
+	err = pc.c.withContext(ctx, func() error {
+		var err error
+		reuse, err = pc.c.send(from, to, r)
+		return err
+	})
+	if err == nil {
+		pc.messages++
+	}
+	p.put(d, pc, reuse && ctx.Err() == nil)
+	return err
+}
+
+// Close 关闭所有空闲连接，正在使用的连接在发送完成后关闭
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrPoolClosed
+	}
+	p.closed = true
+	var idle []*pooledClient
+	for _, d := range p.dests {
+		idle = append(idle, d.idle...)
+		d.idle = nil
+	}
+	p.dests = nil
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		pc.c.Quit()
+		pc.c.Close()
+	}
+	return nil
+}
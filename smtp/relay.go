@@ -0,0 +1,287 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// ErrSTARTTLSUnavailable 对方服务器没有提供 STARTTLS
+var ErrSTARTTLSUnavailable = errors.New("smtp: server doesn't support STARTTLS")
+
+// RelayTLSResult 转发时与一个MX主机协商TLS的结果，用于 TLS-RPT 等统计
+type RelayTLSResult struct {
+	Domain     string   // 收件人域名，即TLS策略域名
+	MX         string   // MX主机名
+	LocalAddr  net.Addr // 本地地址
+	RemoteAddr net.Addr // MX主机地址
+	// 为空表示建立了证书有效的TLS会话，否则为 ErrSTARTTLSUnavailable、握手错误或者证书验证错误
+	Err error
+}
+
+// Relay 根据MX记录把邮件转发到收件人域名的服务器
+//
+// 服务器提供 STARTTLS 时总是使用TLS，握手失败时重新连接使用明文投递。VerifyTLS 为 true（例如域名发布了 MTA-STS 策略）时，
+// 只使用证书有效的TLS会话，不满足的MX会被跳过；邮件头为 "TLS-Required: No" 时忽略这个要求，
+// 证书无效或者不支持 STARTTLS 时仍然投递。MAIL 命令带有 REQUIRETLS 时以 REQUIRETLS 为准，
+// 只能通过证书有效并且支持 REQUIRETLS 的会话投递，否则返回 ErrRequireTLS（5.7.10），
+// 调用者应当据此退信。
+type Relay struct {
+	LocalName string        // EHLO 使用的名称，为空时使用 localhost
+	NetDialer ContextDialer // 为空时使用 net.Dialer
+	Port      string        // 默认 "25"
+	TLSConfig *tls.Config   // STARTTLS 使用的配置，ServerName 会设置为MX主机名
+	VerifyTLS bool          // 要求证书有效的TLS会话
+
+	// 查询MX记录，默认 net.DefaultResolver.LookupMX
+	LookupMX func(ctx context.Context, domain string) ([]*net.MX, error)
+	// 每次TLS协商之后调用，可以设置为 tlsrpt.Collector.RelayHook 的返回值
+	TLSReport func(*RelayTLSResult)
+}
+
+// Deliver 把邮件投递给同一个域名的收件人，按照优先级依次尝试MX主机
+//
+// 某个MX主机接收或者永久拒绝（5xx）邮件之后不再尝试其他主机。返回的结果中记录了每个收件人的状态。
+func (r *Relay) Deliver(ctx context.Context, from string, opts *MailOptions, to []string, msg []byte) (*SendResult, error) {
+	if len(to) == 0 {
+		return nil, errors.New("smtp: no recipients")
+	}
+	domain := addrDomain(to[0])
+	for _, addr := range to[1:] {
+		if !strings.EqualFold(addrDomain(addr), domain) {
+			return nil, errors.New("smtp: recipients must share the same domain")
+		}
+	}
+
+	requireTLS := opts != nil && opts.RequireTLS
+	verify := requireTLS || (r.VerifyTLS && !tlsRequiredNo(msg))
+
+	hosts, err := r.lookupMX(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		res       *SendResult
+		lastErr   error
+		tlsFailed bool
+	)
+	for _, host := range hosts {
+		res, err = r.deliverTo(ctx, domain, host, verify, from, opts, to, msg)
+		if err == nil {
+			return res, nil
+		}
+		lastErr = err
+		var tlsErr *relayTLSError
+		if errors.As(err, &tlsErr) || errors.Is(err, ErrRequireTLS) {
+			tlsFailed = true
+			continue
+		}
+		if smtpErr, ok := err.(*SMTPError); ok && smtpErr.Code/100 == 5 {
+			return res, err
+		}
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+	}
+	if requireTLS && tlsFailed {
+		return res, ErrRequireTLS
+	}
+	return res, lastErr
+}
+
+// relayTLSError MX主机不满足TLS要求
+type relayTLSError struct {
+	host string
+	err  error
+}
+
+func (e *relayTLSError) Error() string {
+	return "smtp: no valid TLS session with " + e.host + ": " + e.err.Error()
+}
+
+func (e *relayTLSError) Unwrap() error {
+	return e.err
+}
+
+// relayHandshakeError 不要求证书有效时 STARTTLS 握手失败，需要重新连接使用明文投递
+type relayHandshakeError struct {
+	err error
+}
+
+func (e *relayHandshakeError) Error() string {
+	return "smtp: STARTTLS handshake failed: " + e.err.Error()
+}
+
+func (e *relayHandshakeError) Unwrap() error {
+	return e.err
+}
+
+// deliverTo 通过一个MX主机投递邮件，TLS不满足要求时返回 *relayTLSError
+//
+// 不要求证书有效时 STARTTLS 只是尽量使用，握手失败之后记录TLS结果，重新连接同一个主机使用明文投递。
+func (r *Relay) deliverTo(ctx context.Context, domain, host string, verify bool, from string, opts *MailOptions, to []string, msg []byte) (*SendResult, error) {
+	res, err := r.deliverConn(ctx, domain, host, verify, true, from, opts, to, msg)
+	var hsErr *relayHandshakeError
+	if errors.As(err, &hsErr) {
+		res, err = r.deliverConn(ctx, domain, host, verify, false, from, opts, to, msg)
+	}
+	return res, err
+}
+
+// deliverConn 建立一个连接投递邮件，startTLS 为 false 时不使用 STARTTLS，也不再记录TLS结果
+func (r *Relay) deliverConn(ctx context.Context, domain, host string, verify, startTLS bool, from string, opts *MailOptions, to []string, msg []byte) (*SendResult, error) {
+	port := r.Port
+	if port == "" {
+		port = "25"
+	}
+	c, err := (&Dialer{NetDialer: r.NetDialer}).DialContext(ctx, net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var res *SendResult
+	err = c.withContext(ctx, func() error {
+		if r.LocalName != "" {
+			if err := c.Hello(r.LocalName); err != nil {
+				return err
+			}
+		}
+
+		if startTLS {
+			tlsErr := ErrSTARTTLSUnavailable
+			if ok, _ := c.Extension("STARTTLS"); ok {
+				var verifyErr error
+				config := r.tlsConfig(host, verify, &verifyErr)
+				if err := c.StartTLS(config); err != nil {
+					// 握手失败之后连接不能继续使用
+					r.report(c, domain, host, err)
+					if verify {
+						return &relayTLSError{host, err}
+					}
+					return &relayHandshakeError{err}
+				}
+				tlsErr = verifyErr
+			}
+			r.report(c, domain, host, tlsErr)
+			if tlsErr != nil && verify {
+				return &relayTLSError{host, tlsErr}
+			}
+		}
+
+		var err error
+		res, err = c.Send(from, opts, to, bytes.NewReader(msg))
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	c.Quit()
+	return res, nil
+}
+
+// tlsConfig 返回连接MX主机使用的TLS配置
+//
+// 不要求证书有效时跳过握手中的验证，验证结果保存在 verifyErr 中，只用于统计。
+func (r *Relay) tlsConfig(host string, verify bool, verifyErr *error) *tls.Config {
+	config := r.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	config.ServerName = host
+	if !verify {
+		roots := config.RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			*verifyErr = verifyPeer(cs, roots, host)
+			return nil
+		}
+	}
+	return config
+}
+
+func (r *Relay) report(c *Client, domain, host string, err error) {
+	if r.TLSReport == nil {
+		return
+	}
+	r.TLSReport(&RelayTLSResult{
+		Domain:     domain,
+		MX:         host,
+		LocalAddr:  c.conn.LocalAddr(),
+		RemoteAddr: c.conn.RemoteAddr(),
+		Err:        err,
+	})
+}
+
+// lookupMX 返回按照优先级排序的MX主机，没有MX记录时使用域名本身（RFC 5321 第5.1节）
+func (r *Relay) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	lookup := r.LookupMX
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupMX
+	}
+	mxs, err := lookup(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// Null MX（RFC 7505），域名不接收邮件
+			return nil, &SMTPError{
+				Code:         556,
+				EnhancedCode: EnhancedCode{5, 1, 10},
+				Message:      "Recipient address has null MX",
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// verifyPeer 按照 host 验证对方的证书链
+func verifyPeer(cs tls.ConnectionState, roots *x509.CertPool, host string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("smtp: no peer certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// tlsRequiredNo 判断邮件头是否包含 "TLS-Required: No"
+func tlsRequiredNo(msg []byte) bool {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return false
+	}
+	return TLSRequiredNo(header)
+}
+
+func addrDomain(addr string) string {
+	return addr[strings.LastIndexByte(addr, '@')+1:]
+}
@@ -0,0 +1,106 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// relayTestBackend 接收所有邮件，记录每封邮件是否通过TLS连接收到
+type relayTestBackend struct {
+	mu   sync.Mutex
+	tls  []bool
+	data []string
+}
+
+func (be *relayTestBackend) NewSession(state ConnectionState) (Session, error) {
+	return &relayTestSession{be: be, state: state}, nil
+}
+
+type relayTestSession struct {
+	be    *relayTestBackend
+	state ConnectionState
+}
+
+func (s *relayTestSession) Reset()                          {}
+func (s *relayTestSession) Logout() error                   { return nil }
+func (s *relayTestSession) Mail(string, *MailOptions) error { return nil }
+func (s *relayTestSession) Rcpt(string) error               { return nil }
+
+func (s *relayTestSession) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.be.mu.Lock()
+	defer s.be.mu.Unlock()
+	s.be.tls = append(s.be.tls, s.state.TLS.HandshakeComplete)
+	s.be.data = append(s.be.data, string(b))
+	return nil
+}
+
+func TestRelaySTARTTLSFallback(t *testing.T) {
+	f := writeTestCert(t, t.TempDir(), "mx.example.com")
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be := &relayTestBackend{}
+	s := NewServer(be)
+	s.Domain = "mx.example.com"
+	// 只接受 TLS 1.3，和只支持 TLS 1.2 的客户端握手失败
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	var results []*RelayTLSResult
+	relay := func(verify bool) *Relay {
+		return &Relay{
+			LocalName: "relay.example.net",
+			Port:      port,
+			TLSConfig: &tls.Config{MaxVersion: tls.VersionTLS12},
+			VerifyTLS: verify,
+			LookupMX: func(ctx context.Context, domain string) ([]*net.MX, error) {
+				return []*net.MX{{Host: "127.0.0.1", Pref: 10}}, nil
+			},
+			TLSReport: func(res *RelayTLSResult) { results = append(results, res) },
+		}
+	}
+	msg := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	// 不要求证书有效时记录握手失败，然后重新连接使用明文投递
+	if _, err := relay(false).Deliver(context.Background(), "a@example.net", nil, []string{"b@example.com"}, msg); err != nil {
+		t.Fatalf("Deliver = %v, want plaintext fallback", err)
+	}
+	if len(results) != 1 || results[0].Err == nil {
+		t.Errorf("TLS results = %+v, want one handshake failure", results)
+	}
+	be.mu.Lock()
+	if len(be.tls) != 1 || be.tls[0] {
+		t.Errorf("deliveries over TLS = %v, want one plaintext delivery", be.tls)
+	}
+	be.mu.Unlock()
+
+	// 要求证书有效时不回退到明文
+	results = nil
+	if _, err := relay(true).Deliver(context.Background(), "a@example.net", nil, []string{"b@example.com"}, msg); err == nil {
+		t.Fatal("Deliver with VerifyTLS succeeded after a failed handshake")
+	}
+	if len(results) != 1 || results[0].Err == nil {
+		t.Errorf("TLS results = %+v, want one handshake failure", results)
+	}
+	be.mu.Lock()
+	if len(be.data) != 1 {
+		t.Errorf("got %d deliveries, want 1", len(be.data))
+	}
+	be.mu.Unlock()
+}
@@ -0,0 +1,374 @@
+package smtp
+
+import (
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ReplyID 服务响应文本的编号，Server.Replies 中使用它替换响应文本
+type ReplyID string
+
+// 服务响应的编号，注释中是响应自己的模板参数
+const (
+	ReplyGreeting          ReplyID = "greeting"            // 连接建立
+	ReplyTooBusy           ReplyID = "too_busy"            // 连接数过多
+	ReplyInternalError     ReplyID = "internal_error"      // 处理命令时出现异常
+	ReplyBadCommand        ReplyID = "bad_command"         // 无法解析的命令行
+	ReplyEmptyCommand      ReplyID = "empty_command"       // 空命令
+	ReplyUnknownCommand    ReplyID = "unknown_command"     // {{.Command}}
+	ReplyNotImplemented    ReplyID = "not_implemented"     // {{.Command}}
+	ReplyTooManyErrors     ReplyID = "too_many_errors"     // 协议错误太多，关闭连接
+	ReplyLineTooLong       ReplyID = "line_too_long"       // 命令行超过 MaxLineLength
+	ReplyIdleTimeout       ReplyID = "idle_timeout"        // 读取超时
+	ReplyConnError         ReplyID = "conn_error"          // 读取命令失败
+	ReplyUseLHLO           ReplyID = "use_lhlo"            // LMTP 服务收到 HELO 或者 EHLO
+	ReplyNotLMTP           ReplyID = "not_lmtp"            // SMTP 服务收到 LHLO
+	ReplyHelloArgRequired  ReplyID = "hello_arg_required"  // HELO 没有参数
+	ReplyHello             ReplyID = "hello"               // HELO 和 EHLO 的第一行，{{.Client}}
+	ReplyHelloFirst        ReplyID = "hello_first"         // HELO 之前的 MAIL、AUTH 和 ETRN
+	ReplyNoop              ReplyID = "noop"                // NOOP
+	ReplyReset             ReplyID = "reset"               // RSET
+	ReplyBye               ReplyID = "bye"                 // QUIT
+	ReplyMailSyntax        ReplyID = "mail_syntax"         // MAIL 没有 FROM:
+	ReplyBadSender         ReplyID = "bad_sender"          // 发件人地址语法错误
+	ReplyInvalidSender     ReplyID = "invalid_sender"      // 发件人域名不是合法的 IDN
+	ReplyMailParams        ReplyID = "mail_params"         // 无法解析 MAIL 参数
+	ReplyUnknownMailParam  ReplyID = "unknown_mail_param"  // 不认识的 MAIL 参数
+	ReplyParamUnsupported  ReplyID = "param_unsupported"   // 服务没有开启的扩展，{{.Param}}
+	ReplySizeInvalid       ReplyID = "size_invalid"        // SIZE 不是整数
+	ReplySizeExceeded      ReplyID = "size_exceeded"       // SIZE 或者 BDAT 超过 MaxMessageBytes
+	ReplyRequireTLSNoTLS   ReplyID = "requiretls_no_tls"   // 明文连接上的 REQUIRETLS
+	ReplyUnknownBody       ReplyID = "unknown_body"        // 不认识的 BODY 值
+	ReplyAuthParam         ReplyID = "auth_param"          // AUTH= 参数格式错误
+	ReplyMailOK            ReplyID = "mail_ok"             // {{.Address}}
+	ReplyMailInTransfer    ReplyID = "mail_in_transfer"    // BDAT 传输中的 MAIL
+	ReplyMissingMail       ReplyID = "missing_mail"        // MAIL 之前的 RCPT
+	ReplyRcptSyntax        ReplyID = "rcpt_syntax"         // RCPT 没有 TO:
+	ReplyBadRecipient      ReplyID = "bad_recipient"       // 收件人地址语法错误
+	ReplyInvalidRecipient  ReplyID = "invalid_recipient"   // 收件人域名不是合法的 IDN
+	ReplyRcptParams        ReplyID = "rcpt_params"         // 无法解析 RCPT 参数
+	ReplyRcptParamUnknown  ReplyID = "rcpt_param_unknown"  // RCPT 参数
+	ReplyTooManyRecipients ReplyID = "too_many_recipients" // {{.Limit}}
+	ReplyRcptOK            ReplyID = "rcpt_ok"             // {{.Address}}
+	ReplyRcptInTransfer    ReplyID = "rcpt_in_transfer"    // BDAT 传输中的 RCPT
+	ReplyMalformedHeader   ReplyID = "malformed_header"    // 提交模式下无法解析的消息头部
+	ReplyMalformedFrom     ReplyID = "malformed_from"      // 提交模式下无法解析的 From 头部
+	ReplySMTPUTF8Required  ReplyID = "smtputf8_required"   // 没有声明 SMTPUTF8 的非 ASCII 地址
+	ReplySenderNotOwned    ReplyID = "sender_not_owned"    // 发件地址不属于认证用户
+	ReplyAuthDisabled      ReplyID = "auth_disabled"       // AuthDisabled 时的 AUTH
+	ReplyAlreadyAuth       ReplyID = "already_auth"        // 重复认证
+	ReplyAuthArgRequired   ReplyID = "auth_arg_required"   // AUTH 没有参数
+	ReplyAuthTLSRequired   ReplyID = "auth_tls_required"   // 明文连接上的 AUTH
+	ReplyAuthRequired      ReplyID = "auth_required"       // 需要先认证
+	ReplyAuthMechanism     ReplyID = "auth_mechanism"      // 不支持的认证方式
+	ReplyAuthUnsupported   ReplyID = "auth_unsupported"    // 会话不支持收到的凭据，ErrAuthUnsupported
+	ReplyAuthIdentity      ReplyID = "auth_identity"       // 授权身份和用户名不同
+	ReplyNoClientCert      ReplyID = "no_client_cert"      // EXTERNAL 认证没有经过验证的客户端证书
+	ReplyCertNotMapped     ReplyID = "cert_not_mapped"     // 客户端证书无法映射为用户名，{{.Error}}
+	ReplyAuthCancelled     ReplyID = "auth_cancelled"      // 客户端取消认证
+	ReplyAuthBase64        ReplyID = "auth_base64"         // 认证数据不是 base64
+	ReplyAuthOK            ReplyID = "auth_ok"             // 认证成功
+	ReplyAuthLocked        ReplyID = "auth_locked"         // 认证失败次数太多，关闭连接
+	ReplyAuthBlocked       ReplyID = "auth_blocked"        // 被锁定的地址建立连接
+	ReplyStartTLS          ReplyID = "starttls"            // STARTTLS
+	ReplyAlreadyTLS        ReplyID = "already_tls"         // 重复 STARTTLS
+	ReplyTLSUnsupported    ReplyID = "tls_unsupported"     // 没有 TLSConfig
+	ReplyTLSHandshake      ReplyID = "tls_handshake"       // 握手失败
+	ReplyTLSPolicy         ReplyID = "tls_policy"          // 不满足 MinTLSVersion 或者 TLSCipherSuites
+	ReplySTARTTLSRequired  ReplyID = "starttls_required"   // RequireSTARTTLS
+	ReplyDataArg           ReplyID = "data_arg"            // DATA 带有参数
+	ReplyDataInTransfer    ReplyID = "data_in_transfer"    // BDAT 传输中的 DATA
+	ReplyDataBinaryMIME    ReplyID = "data_binarymime"     // BODY=BINARYMIME 的 DATA
+	ReplyMissingRcpt       ReplyID = "missing_rcpt"        // RCPT 之前的 DATA 或者 BDAT
+	ReplyDataStart         ReplyID = "data_start"          // DATA
+	ReplyQueued            ReplyID = "queued"              // 接收邮件成功
+	ReplyDataFailed        ReplyID = "data_failed"         // 后端返回的不是 SMTPError，{{.Error}}
+	ReplyDataTooLarge      ReplyID = "data_too_large"      // 消息内容超过 MaxMessageBytes
+	ReplyBdatSizeRequired  ReplyID = "bdat_size_required"  // BDAT 没有参数
+	ReplyBdatTooManyArgs   ReplyID = "bdat_too_many_args"  // BDAT 参数过多
+	ReplyBdatUnknownArg    ReplyID = "bdat_unknown_arg"    // 不是 LAST 的 BDAT 参数
+	ReplyBdatSizeInvalid   ReplyID = "bdat_size_invalid"   // BDAT 大小不是整数
+	ReplyBdatContinue      ReplyID = "bdat_continue"       // 收到不是 LAST 的数据块
+	ReplyVrfyCannot        ReplyID = "vrfy_cannot"         // 没有开启 VRFY
+	ReplyVrfySyntax        ReplyID = "vrfy_syntax"         // VRFY 没有参数
+	ReplyExpnSyntax        ReplyID = "expn_syntax"         // EXPN 没有参数
+	ReplyExpnEmpty         ReplyID = "expn_empty"          // 邮件列表没有成员
+	ReplyVerifyFailed      ReplyID = "verify_failed"       // VRFY、EXPN 的后端返回的不是 SMTPError
+	ReplyHelpUnknown       ReplyID = "help_unknown"        // HELP 主题不存在
+	ReplyEtrnTransaction   ReplyID = "etrn_transaction"    // 邮件事务中的 ETRN
+	ReplyEtrnSyntax        ReplyID = "etrn_syntax"         // ETRN 参数错误
+	ReplyEtrnFailed        ReplyID = "etrn_failed"         // {{.Node}}
+	ReplyEtrnEmpty         ReplyID = "etrn_empty"          // {{.Node}}
+	ReplyEtrnStarted       ReplyID = "etrn_started"        // {{.Node}}
+	ReplyEtrnPending       ReplyID = "etrn_pending"        // {{.Node}} {{.Pending}}
+)
+
+// DefaultReplies 服务默认使用的英文响应文本
+//
+// 文本是 text/template 模板，所有响应都可以使用 {{.Domain}} 和 {{.Time}}（RFC 1123 格式的当前时间），
+// 部分响应还有自己的参数，见 ReplyID 常量的注释。响应码和增强状态码由服务决定，不会随文本改变。
+var DefaultReplies = map[ReplyID]string{
+	ReplyGreeting:          "{{.Domain}} ESMTP Service Ready",
+	ReplyTooBusy:           "Too busy. Try again later.",
+	ReplyInternalError:     "Internal server error",
+	ReplyBadCommand:        "Bad command",
+	ReplyEmptyCommand:      "Error: bad syntax",
+	ReplyUnknownCommand:    "Syntax error, {{.Command}} command unrecognized",
+	ReplyNotImplemented:    "{{.Command}} command not implemented",
+	ReplyTooManyErrors:     "Too many errors. Quitting now",
+	ReplyLineTooLong:       "Line too long, closing connection",
+	ReplyIdleTimeout:       "Idle timeout, bye bye",
+	ReplyConnError:         "Connection error, sorry",
+	ReplyUseLHLO:           "This is a LMTP server, use LHLO",
+	ReplyNotLMTP:           "This is not a LMTP server",
+	ReplyHelloArgRequired:  "Domain/address argument required for HELO",
+	ReplyHello:             "Hello {{.Client}}",
+	ReplyHelloFirst:        "Please introduce yourself first.",
+	ReplyNoop:              "I have successfully done nothing",
+	ReplyReset:             "Session reset",
+	ReplyBye:               "Goodbye",
+	ReplyMailSyntax:        "Was expecting MAIL arg syntax of FROM:<address>",
+	ReplyBadSender:         "Bad sender address syntax",
+	ReplyInvalidSender:     "Invalid sender address",
+	ReplyMailParams:        "Unable to parse MAIL ESMTP parameters",
+	ReplyUnknownMailParam:  "Unknown MAIL FROM argument",
+	ReplyParamUnsupported:  "{{.Param}} is not implemented",
+	ReplySizeInvalid:       "Unable to parse SIZE as an integer",
+	ReplySizeExceeded:      "Max message size exceeded",
+	ReplyRequireTLSNoTLS:   "REQUIRETLS needs TLS connection",
+	ReplyUnknownBody:       "Unknown BODY value",
+	ReplyAuthParam:         "Malformed AUTH parameter value",
+	ReplyMailOK:            "Roger, accepting mail from <{{.Address}}>",
+	ReplyMailInTransfer:    "MAIL not allowed during message transfer",
+	ReplyMissingMail:       "Missing MAIL FROM command.",
+	ReplyRcptSyntax:        "Was expecting RCPT arg syntax of TO:<address>",
+	ReplyBadRecipient:      "Bad recipient address syntax",
+	ReplyInvalidRecipient:  "Invalid recipient address",
+	ReplyRcptParams:        "Unable to parse RCPT ESMTP parameters",
+	ReplyRcptParamUnknown:  "RCPT parameters are not supported",
+	ReplyTooManyRecipients: "Maximum limit of {{.Limit}} recipients reached",
+	ReplyRcptOK:            "I'll make sure <{{.Address}}> gets this",
+	ReplyRcptInTransfer:    "RCPT not allowed during message transfer",
+	ReplyMalformedHeader:   "Malformed message header",
+	ReplyMalformedFrom:     "Malformed From header",
+	ReplySMTPUTF8Required:  ErrSMTPUTF8Required.Message,
+	ReplySenderNotOwned:    ErrSenderNotOwned.Message,
+	ReplyAuthDisabled:      "Syntax error, AUTH command unrecognized",
+	ReplyAlreadyAuth:       "Already authenticated",
+	ReplyAuthArgRequired:   "Missing parameter",
+	ReplyAuthTLSRequired:   "TLS is required",
+	ReplyAuthRequired:      ErrAuthRequired.Message,
+	ReplyAuthMechanism:     "Unsupported authentication mechanism",
+	ReplyAuthUnsupported:   ErrAuthUnsupported.Message,
+	ReplyAuthIdentity:      errIdentityUnsupported.Message,
+	ReplyNoClientCert:      ErrNoClientCert.Message,
+	ReplyCertNotMapped:     "Cannot map client certificate to a user: {{.Error}}",
+	ReplyAuthCancelled:     "Negotiation cancelled",
+	ReplyAuthBase64:        "Invalid base64 data",
+	ReplyAuthOK:            "Authentication succeeded",
+	ReplyAuthLocked:        "Too many failed authentication attempts, closing connection",
+	ReplyAuthBlocked:       ErrAuthLocked.Message,
+	ReplyStartTLS:          "Ready to start TLS",
+	ReplyAlreadyTLS:        "Already running in TLS",
+	ReplyTLSUnsupported:    "TLS not supported",
+	ReplyTLSHandshake:      "Handshake error",
+	ReplyTLSPolicy:         "TLS parameters do not meet server policy",
+	ReplySTARTTLSRequired:  ErrSTARTTLSRequired.Message,
+	ReplyDataArg:           "DATA command should not have any arguments",
+	ReplyDataInTransfer:    "DATA not allowed during message transfer",
+	ReplyDataBinaryMIME:    "DATA not allowed for BINARYMIME messages",
+	ReplyMissingRcpt:       "Missing RCPT TO command.",
+	ReplyDataStart:         "Go ahead. End your data with <CR><LF>.<CR><LF>",
+	ReplyQueued:            "OK: queued",
+	ReplyDataFailed:        "Error: transaction failed, blame it on the weather: {{.Error}}",
+	ReplyDataTooLarge:      ErrDataTooLarge.Message,
+	ReplyBdatSizeRequired:  "Missing chunk size argument",
+	ReplyBdatTooManyArgs:   "Too many arguments",
+	ReplyBdatUnknownArg:    "Unknown BDAT argument",
+	ReplyBdatSizeInvalid:   "Malformed size argument",
+	ReplyBdatContinue:      "Continue",
+	ReplyVrfyCannot:        "Cannot VRFY user, but will accept message",
+	ReplyVrfySyntax:        "Was expecting VRFY arg syntax of <user>",
+	ReplyExpnSyntax:        "Was expecting EXPN arg syntax of <list>",
+	ReplyExpnEmpty:         "Mailing list has no members",
+	ReplyVerifyFailed:      "Unable to verify address, try again later",
+	ReplyHelpUnknown:       "HELP topic unknown",
+	ReplyEtrnTransaction:   "ETRN not allowed during a mail transaction",
+	ReplyEtrnSyntax:        "Was expecting ETRN arg syntax of [@|#]<node>",
+	ReplyEtrnFailed:        "Unable to queue messages for node {{.Node}}",
+	ReplyEtrnEmpty:         "OK, no messages waiting for node {{.Node}}",
+	ReplyEtrnStarted:       "OK, queuing for node {{.Node}} started",
+	ReplyEtrnPending:       "OK, {{.Pending}} pending messages for node {{.Node}} started",
+}
+
+// ChineseReplies DefaultReplies 的中文翻译
+//
+// 设置为 Server.Replies 即可使用中文响应，只需要修改部分文本时可以复制一份再替换。
+var ChineseReplies = map[ReplyID]string{
+	ReplyGreeting:          "{{.Domain}} ESMTP 服务已准备就绪",
+	ReplyTooBusy:           "服务繁忙，请稍后重试",
+	ReplyInternalError:     "服务器内部错误",
+	ReplyBadCommand:        "命令错误",
+	ReplyEmptyCommand:      "错误：命令不能为空",
+	ReplyUnknownCommand:    "语法错误，无法识别 {{.Command}} 命令",
+	ReplyNotImplemented:    "{{.Command}} 命令未实现",
+	ReplyTooManyErrors:     "错误太多，关闭连接",
+	ReplyLineTooLong:       "一行太长了，关闭连接",
+	ReplyIdleTimeout:       "Idle超时，再见",
+	ReplyConnError:         "连接错误，抱歉",
+	ReplyUseLHLO:           "这是一个 LMTP 服务，使用 LHLO",
+	ReplyNotLMTP:           "这不是一个 LMTP 服务",
+	ReplyHelloArgRequired:  "HELO 需要域名或者地址参数",
+	ReplyHello:             "你好 {{.Client}}",
+	ReplyHelloFirst:        "请先介绍您自己",
+	ReplyNoop:              "成功的处理了NOOP命令",
+	ReplyReset:             "重置会话",
+	ReplyBye:               "再见",
+	ReplyMailSyntax:        "语法错误，期望的格式是 FROM:<address>",
+	ReplyBadSender:         "发件人地址语法错误",
+	ReplyInvalidSender:     "无效的发件人地址",
+	ReplyMailParams:        "解析 MAIL ESMTP 参数失败",
+	ReplyUnknownMailParam:  "未知的 MAIL 参数",
+	ReplyParamUnsupported:  "{{.Param}} 未实现",
+	ReplySizeInvalid:       "无法将SIZE解析为一个整数",
+	ReplySizeExceeded:      "超过最大消息长度限制",
+	ReplyRequireTLSNoTLS:   "REQUIRETLS 只能在TLS会话中使用",
+	ReplyUnknownBody:       "未知的 BODY 值",
+	ReplyAuthParam:         "AUTH 参数格式错误",
+	ReplyMailOK:            "处理 <{{.Address}}> 发送的邮件成功",
+	ReplyMailInTransfer:    "数据传输中不允许使用 MAIL",
+	ReplyMissingMail:       "缺少 MAIL FROM 命令",
+	ReplyRcptSyntax:        "语法错误，期望的格式是 TO:<address>",
+	ReplyBadRecipient:      "收件人地址语法错误",
+	ReplyInvalidRecipient:  "无效的收件人地址",
+	ReplyRcptParams:        "解析 RCPT ESMTP 参数失败",
+	ReplyRcptParamUnknown:  "不支持的 RCPT 参数",
+	ReplyTooManyRecipients: "超过最大接收数量限制 {{.Limit}}",
+	ReplyRcptOK:            "我会确保 <{{.Address}}> 接收这条消息",
+	ReplyRcptInTransfer:    "数据传输中不允许使用 RCPT",
+	ReplyMalformedHeader:   "消息头部格式错误",
+	ReplyMalformedFrom:     "From 头部格式错误",
+	ReplySMTPUTF8Required:  "国际化邮件地址需要 SMTPUTF8",
+	ReplySenderNotOwned:    "发件地址不属于认证用户",
+	ReplyAuthDisabled:      "语法错误，不支持 AUTH 命令",
+	ReplyAlreadyAuth:       "权限已经校验过",
+	ReplyAuthArgRequired:   "缺少参数",
+	ReplyAuthTLSRequired:   "需要TLS",
+	ReplyAuthRequired:      "需要认证",
+	ReplyAuthMechanism:     "不支持的认证方式",
+	ReplyAuthUnsupported:   "不支持认证",
+	ReplyAuthIdentity:      "不支持授权身份",
+	ReplyNoClientCert:      "没有经过验证的客户端证书",
+	ReplyCertNotMapped:     "无法把客户端证书映射为用户: {{.Error}}",
+	ReplyAuthCancelled:     "认证已取消",
+	ReplyAuthBase64:        "无效的 base64 数据",
+	ReplyAuthOK:            "认证成功",
+	ReplyAuthLocked:        "认证失败次数太多，关闭连接",
+	ReplyAuthBlocked:       "认证失败次数太多，请稍后重试",
+	ReplyStartTLS:          "准备开始TLS",
+	ReplyAlreadyTLS:        "已经在使用TLS",
+	ReplyTLSUnsupported:    "不支持TLS",
+	ReplyTLSHandshake:      "TLS握手失败",
+	ReplyTLSPolicy:         "TLS参数不符合服务的要求",
+	ReplySTARTTLSRequired:  "请先使用 STARTTLS",
+	ReplyDataArg:           "DATA 命令不能有参数",
+	ReplyDataInTransfer:    "数据传输中不允许使用 DATA",
+	ReplyDataBinaryMIME:    "BINARYMIME 类型的消息不能使用 DATA",
+	ReplyMissingRcpt:       "缺少 RCPT TO 命令",
+	ReplyDataStart:         "开始接收数据，以 <CR><LF>.<CR><LF> 结束",
+	ReplyQueued:            "OK: 邮件已进入队列",
+	ReplyDataFailed:        "错误：处理邮件失败: {{.Error}}",
+	ReplyDataTooLarge:      "超过最大消息长度限制",
+	ReplyBdatSizeRequired:  "缺少chunk size参数",
+	ReplyBdatTooManyArgs:   "参数过多",
+	ReplyBdatUnknownArg:    "未知的 BDAT 参数",
+	ReplyBdatSizeInvalid:   "chunk size参数格式错误",
+	ReplyBdatContinue:      "继续",
+	ReplyVrfyCannot:        "无法验证用户，但是会接收消息",
+	ReplyVrfySyntax:        "语法错误，期望的格式是 VRFY <user>",
+	ReplyExpnSyntax:        "语法错误，期望的格式是 EXPN <list>",
+	ReplyExpnEmpty:         "邮件列表没有成员",
+	ReplyVerifyFailed:      "暂时无法验证地址，请稍后再试",
+	ReplyHelpUnknown:       "HELP 主题不存在",
+	ReplyEtrnTransaction:   "ETRN 不能在邮件事务中使用",
+	ReplyEtrnSyntax:        "语法错误，期望的格式是 ETRN [@|#]<node>",
+	ReplyEtrnFailed:        "无法投递节点 {{.Node}} 的邮件",
+	ReplyEtrnEmpty:         "节点 {{.Node}} 没有等待投递的邮件",
+	ReplyEtrnStarted:       "开始投递节点 {{.Node}} 的邮件",
+	ReplyEtrnPending:       "开始投递节点 {{.Node}} 的 {{.Pending}} 封邮件",
+}
+
+// 解析过的响应模板，键为模板文本
+var replyTemplates sync.Map
+
+// 响应只能有一行，模板中的换行替换为空格
+var replyLineReplacer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// replyText 返回响应的文本，args 是模板参数的名称和值，例如 "Address", addr
+//
+// Server.Replies 中没有的响应使用 DefaultReplies。模板错误时记录日志并使用模板原文。
+func (s *Server) replyText(id ReplyID, args ...interface{}) string {
+	text, ok := s.Replies[id]
+	if !ok {
+		text = DefaultReplies[id]
+	}
+	if !strings.Contains(text, "{{") {
+		return replyLineReplacer.Replace(text)
+	}
+
+	var tmpl *template.Template
+	if v, ok := replyTemplates.Load(text); ok {
+		tmpl = v.(*template.Template)
+	} else {
+		var err error
+		tmpl, err = template.New(string(id)).Parse(text)
+		if err != nil {
+			s.ErrorLog.Printf("解析响应模板 %s 失败: %v", id, err)
+			return replyLineReplacer.Replace(text)
+		}
+		replyTemplates.Store(text, tmpl)
+	}
+
+	data := map[string]interface{}{
+		"Domain": s.Domain,
+		"Time":   time.Now().Format(time.RFC1123Z),
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		data[args[i].(string)] = args[i+1]
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		s.ErrorLog.Printf("生成响应 %s 失败: %v", id, err)
+		return replyLineReplacer.Replace(text)
+	}
+	return replyLineReplacer.Replace(b.String())
+}
+
+// errorReplies 包中预定义的错误对应的响应编号，会话或者认证返回这些错误时同样使用 Server.Replies 中的文本
+var errorReplies = map[*SMTPError]ReplyID{
+	errPanic:               ReplyInternalError,
+	errIdentityUnsupported: ReplyAuthIdentity,
+	ErrAuthRequired:        ReplyAuthRequired,
+	ErrAuthUnsupported:     ReplyAuthUnsupported,
+	ErrAuthLocked:          ReplyAuthBlocked,
+	ErrNoClientCert:        ReplyNoClientCert,
+	ErrDataTooLarge:        ReplyDataTooLarge,
+	ErrSenderNotOwned:      ReplySenderNotOwned,
+	ErrSMTPUTF8Required:    ReplySMTPUTF8Required,
+	ErrSTARTTLSRequired:    ReplySTARTTLSRequired,
+}
+
+// errorText 返回错误响应的文本，预定义的错误使用对应响应编号的文本，其他错误使用 Message
+func (c *Conn) errorText(err *SMTPError) string {
+	if id, ok := errorReplies[err]; ok {
+		return c.server.replyText(id)
+	}
+	return err.Message
+}
+
+// reply 使用响应编号对应的文本写入响应
+func (c *Conn) reply(code int, ec EnhancedCode, id ReplyID, args ...interface{}) {
+	c.WriteResponse(code, ec, c.server.replyText(id, args...))
+}
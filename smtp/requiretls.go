@@ -0,0 +1,35 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"net/textproto"
+	"strings"
+)
+
+// ErrRequireTLS 邮件要求 REQUIRETLS，但是没有可用的经过验证的TLS通道（RFC 8689 第5节）
+var ErrRequireTLS = &SMTPError{
+	Code:         550,
+	EnhancedCode: EnhancedCode{5, 7, 10},
+	Message:      "REQUIRETLS support required",
+}
+
+// TLSRequiredHeader 用于放宽TLS策略的邮件头（RFC 8689 第4.2节）
+const TLSRequiredHeader = "TLS-Required"
+
+// TLSRequiredNo 判断邮件头中是否包含 "TLS-Required: No"
+//
+// 包含该邮件头时，转发时应当尝试TLS，但是可以忽略 MTA-STS、DANE 等策略失败。
+// 如果同时指定了 REQUIRETLS 参数，以 REQUIRETLS 为准。
+func TLSRequiredNo(header textproto.MIMEHeader) bool {
+	for _, v := range header.Values(TLSRequiredHeader) {
+		if strings.EqualFold(strings.TrimSpace(v), "No") {
+			return true
+		}
+	}
+	return false
+}
+
+// verifiedTLS 判断TLS连接是否完成了证书验证
+func verifiedTLS(state tls.ConnectionState) bool {
+	return state.HandshakeComplete && len(state.VerifiedChains) > 0
+}
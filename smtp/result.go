@@ -0,0 +1,129 @@
+package smtp
+
+import (
+	"context"
+	"io"
+)
+
+// RecipientResult 单个收件人的发送结果
+type RecipientResult struct {
+	Address string
+	// RCPT 被拒绝，或者 LMTP 模式下投递失败时不为空
+	Err *SMTPError
+}
+
+// SendResult Client.Send 的发送结果
+type SendResult struct {
+	// 每个收件人的结果，顺序与传入的收件人相同
+	Recipients []RecipientResult
+
+	// 消息发送完成后服务的最终响应，通常包含队列ID；LMTP 模式下每个收件人单独响应，这里为空
+	Code         int
+	EnhancedCode EnhancedCode
+	Message      string
+
+	next int // LMTP 模式下下一个响应对应的收件人
+}
+
+func newSendResult(to []string) *SendResult {
+	res := &SendResult{Recipients: make([]RecipientResult, len(to))}
+	for i, addr := range to {
+		res.Recipients[i].Address = addr
+	}
+	return res
+}
+
+// Accepted 返回投递成功的收件人
+func (res *SendResult) Accepted() []string {
+	var accepted []string
+	for _, rcpt := range res.Recipients {
+		if rcpt.Err == nil {
+			accepted = append(accepted, rcpt.Address)
+		}
+	}
+	return accepted
+}
+
+// Failed 返回被拒绝或者投递失败的收件人
+func (res *SendResult) Failed() []RecipientResult {
+	var failed []RecipientResult
+	for _, rcpt := range res.Recipients {
+		if rcpt.Err != nil {
+			failed = append(failed, rcpt)
+		}
+	}
+	return failed
+}
+
+// noneAccepted 所有收件人都被拒绝时返回第一个错误
+func (res *SendResult) noneAccepted() error {
+	var first *SMTPError
+	for _, rcpt := range res.Recipients {
+		if rcpt.Err == nil {
+			return nil
+		}
+		if first == nil {
+			first = rcpt.Err
+		}
+	}
+	if first == nil {
+		return &SMTPError{
+			Code:         554,
+			EnhancedCode: EnhancedCode{5, 5, 1},
+			Message:      "No valid recipients",
+		}
+	}
+	return first
+}
+
+// replyFunc 把消息发送完成后的响应记录到结果中
+func (res *SendResult) replyFunc() replyFunc {
+	return func(rcpt string, reply *SMTPError) {
+		if rcpt == "" {
+			res.Code = reply.Code
+			res.EnhancedCode = reply.EnhancedCode
+			res.Message = reply.Message
+			return
+		}
+
+		// LMTP 的响应顺序与被接受的收件人顺序相同
+		for res.next < len(res.Recipients) && res.Recipients[res.next].Err != nil {
+			res.next++
+		}
+		if res.next == len(res.Recipients) {
+			return
+		}
+		if reply.Code/100 != 2 {
+			res.Recipients[res.next].Err = reply
+		}
+		res.next++
+	}
+}
+
+// Send 发送一封邮件，尝试所有的收件人，至少有一个收件人被接受时发送消息内容
+//
+// 被拒绝的收件人不会导致发送失败，它们记录在返回结果中。MAIL 命令失败、所有收件人
+// 都被拒绝、消息被拒绝或者网络错误时返回错误，此时结果中仍然包含已知的收件人状态。
+// 与 SendMail 不同，Send 不会发送 QUIT，连接可以继续使用。
+func (c *Client) Send(from string, opts *MailOptions, to []string, r io.Reader) (*SendResult, error) {
+	res := newSendResult(to)
+	w, err := c.resultEnvelope(from, opts, to, res)
+	if err != nil {
+		return res, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return res, err
+	}
+	return res, w.Close()
+}
+
+// SendContext 与 Send 相同，取消 ctx 会中断发送
+func (c *Client) SendContext(ctx context.Context, from string, opts *MailOptions, to []string, r io.Reader) (*SendResult, error) {
+	var res *SendResult
+	err := c.withContext(ctx, func() error {
+		var err error
+		res, err = c.Send(from, opts, to, r)
+		return err
+	})
+	return res, err
+}
@@ -0,0 +1,42 @@
+package smtp
+
+import (
+	"github.com/zhangdapeng520/zdpgo_smtp/sasl"
+)
+
+// scramStoreFunc 函数形式的 sasl.ScramCredentialStore
+type scramStoreFunc func(mech, username string) (*sasl.ScramCredentials, error)
+
+func (f scramStoreFunc) ScramCredentials(mech, username string) (*sasl.ScramCredentials, error) {
+	return f(mech, username)
+}
+
+// EnableScramAuth 开启 SCRAM-SHA-1、SCRAM-SHA-256 以及对应的 -PLUS 认证
+//
+// store 只需要保存加盐后的密钥，不需要明文密码，会话收到 *VerifiedCredential 凭据。
+// -PLUS 使用当前连接的 tls-unique 或者 tls-exporter 通道绑定，只在TLS连接中宣告。
+func (s *Server) EnableScramAuth(store sasl.ScramCredentialStore) {
+	mechs := []string{sasl.ScramSHA1, sasl.ScramSHA1Plus, sasl.ScramSHA256, sasl.ScramSHA256Plus}
+	for _, mech := range mechs {
+		mech := mech
+		s.EnableAuth(mech, func(conn *Conn) sasl.Server {
+			var cb *sasl.ChannelBinding
+			if state, ok := conn.TLSConnectionState(); ok {
+				cb = sasl.TLSChannelBinding(state)
+			}
+			lookup := scramStoreFunc(func(mech, username string) (*sasl.ScramCredentials, error) {
+				if err := conn.authStart(username); err != nil {
+					return nil, err
+				}
+				return store.ScramCredentials(mech, username)
+			})
+			return sasl.NewScramServer(mech, lookup, cb, func(username, identity string) error {
+				if identity != "" && identity != username {
+					return errIdentityUnsupported
+				}
+
+				return conn.Authenticate(mech, &VerifiedCredential{Username: username})
+			})
+		})
+	}
+}
@@ -51,6 +51,35 @@ type Server struct {
 	AuthDisabled      bool
 	Backend           Backend
 
+	// 提交模式（RFC 6409），AUTH 成功之前拒绝 MAIL 和 RCPT
+	Submission bool
+	// 不为空时检查 MAIL FROM 和头部 From 的地址是否属于认证用户
+	SenderOwner AddressOwner
+
+	// 认证失败限制，为空时不限制；被锁定的IP在连接时就会被拒绝
+	AuthLimiter *AuthLimiter
+
+	// STARTTLS 之前拒绝 MAIL、RCPT 和 AUTH，TLSExemptNetworks 中的客户端除外
+	RequireSTARTTLS   bool
+	TLSExemptNetworks []*net.IPNet
+	// 握手之后要求的最低TLS版本和允许的加密套件，为空时不限制
+	MinTLSVersion   uint16
+	TLSCipherSuites []uint16
+	// 不为空时记录每次TLS握手的结果
+	TLSLog Logger
+
+	// 开启 VRFY 和 EXPN，会话还需要实现 VerifySession 和 ExpandSession，默认关闭
+	EnableVRFY bool
+	EnableEXPN bool
+	// VRFY 和 EXPN 只允许认证用户以及 VerifyTrustedNetworks 中的客户端使用
+	VerifyRequireAuth     bool
+	VerifyTrustedNetworks []*net.IPNet
+
+	// HELP 命令的帮助文本，为空时使用 DefaultHelpText
+	HelpText map[string][]string
+	// 响应文本，键不存在时使用 DefaultReplies；设置为 ChineseReplies 使用中文响应
+	Replies map[ReplyID]string
+
 	caps  []string
 	auths map[string]SaslServerFactory
 	done  chan struct{}
@@ -69,23 +98,8 @@ func NewServer(be Backend) *Server {
 		done:     make(chan struct{}, 1),
 		ErrorLog: log.New(os.Stderr, "smtp/server ", log.LstdFlags),
 		caps:     []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "CHUNKING"},
-		auths: map[string]SaslServerFactory{
-			sasl.Plain: func(conn *Conn) sasl.Server {
-				return sasl.NewPlainServer(func(identity, username, password string) error {
-					if identity != "" && identity != username {
-						return errors.New("Identities not supported")
-					}
-
-					sess := conn.Session()
-					if sess == nil {
-						panic("No session when AUTH is called")
-					}
-
-					return sess.AuthPlain(username, password)
-				})
-			},
-		},
-		conns: make(map[*Conn]struct{}),
+		auths:    make(map[string]SaslServerFactory),
+		conns:    make(map[*Conn]struct{}),
 	}
 }
 
@@ -143,6 +157,11 @@ func (s *Server) handleConn(c *Conn) error {
 		s.locker.Unlock()
 	}()
 
+	if s.AuthLimiter != nil && s.AuthLimiter.Blocked(c.conn.RemoteAddr()) {
+		c.reply(421, EnhancedCode{4, 7, 0}, ReplyAuthBlocked)
+		return nil
+	}
+
 	if tlsConn, ok := c.conn.(*tls.Conn); ok {
 		if d := s.ReadTimeout; d != 0 {
 			c.conn.SetReadDeadline(time.Now().Add(d))
@@ -150,7 +169,15 @@ func (s *Server) handleConn(c *Conn) error {
 		if d := s.WriteTimeout; d != 0 {
 			c.conn.SetWriteDeadline(time.Now().Add(d))
 		}
-		if err := tlsConn.Handshake(); err != nil {
+		err := tlsConn.Handshake()
+		if err == nil {
+			state := tlsConn.ConnectionState()
+			err = s.checkTLSPolicy(state)
+			s.logTLSHandshake(c.conn, true, &state, err)
+		} else {
+			s.logTLSHandshake(c.conn, true, nil, err)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -162,7 +189,7 @@ func (s *Server) handleConn(c *Conn) error {
 		if err == nil {
 			cmd, arg, err := parseCmd(line)
 			if err != nil {
-				c.protocolError(501, EnhancedCode{5, 5, 2}, "命令错误")
+				c.protocolError(501, EnhancedCode{5, 5, 2}, s.replyText(ReplyBadCommand))
 				continue
 			}
 
@@ -172,16 +199,16 @@ func (s *Server) handleConn(c *Conn) error {
 				return nil
 			}
 			if err == ErrTooLongLine {
-				c.WriteResponse(500, EnhancedCode{5, 4, 0}, "一行太长了，关闭连接")
+				c.reply(500, EnhancedCode{5, 4, 0}, ReplyLineTooLong)
 				return nil
 			}
 
 			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				c.WriteResponse(221, EnhancedCode{2, 4, 2}, "Idle超时，再见")
+				c.reply(221, EnhancedCode{2, 4, 2}, ReplyIdleTimeout)
 				return nil
 			}
 
-			c.WriteResponse(221, EnhancedCode{2, 4, 0}, "连接错误，抱歉")
+			c.reply(221, EnhancedCode{2, 4, 0}, ReplyConnError)
 			return err
 		}
 	}
@@ -218,7 +245,7 @@ func (s *Server) ListenAndServeTLS() error {
 		addr = ":smtps"
 	}
 
-	l, err := tls.Listen("tcp", addr, s.TLSConfig)
+	l, err := tls.Listen("tcp", addr, s.tlsConfig())
 	if err != nil {
 		return err
 	}
@@ -252,10 +279,58 @@ func (s *Server) Close() error {
 }
 
 // EnableAuth 开启权限
+//
+// 注册的认证方式会覆盖同名的内置认证方式，工厂函数中可以通过 Conn.Authenticate
+// 把凭据交给会话校验。
 func (s *Server) EnableAuth(name string, f SaslServerFactory) {
 	s.auths[name] = f
 }
 
+// Clone 复制服务的配置和注册的认证方式，返回未启动的新服务
+//
+// 新服务与原服务共享 Backend、TLSConfig 和 AuthLimiter，适合同一个进程在多个端口上
+// 使用不同的策略提供服务。Server 新增导出字段时需要同时在这里复制。
+func (s *Server) Clone() *Server {
+	clone := NewServer(s.Backend)
+	clone.Addr = s.Addr
+	clone.TLSConfig = s.TLSConfig
+	clone.LMTP = s.LMTP
+	clone.Domain = s.Domain
+	clone.MaxRecipients = s.MaxRecipients
+	clone.MaxMessageBytes = s.MaxMessageBytes
+	clone.MaxLineLength = s.MaxLineLength
+	clone.AllowInsecureAuth = s.AllowInsecureAuth
+	clone.Strict = s.Strict
+	clone.Debug = s.Debug
+	clone.ErrorLog = s.ErrorLog
+	clone.ReadTimeout = s.ReadTimeout
+	clone.WriteTimeout = s.WriteTimeout
+	clone.EnableSMTPUTF8 = s.EnableSMTPUTF8
+	clone.EnableREQUIRETLS = s.EnableREQUIRETLS
+	clone.EnableBINARYMIME = s.EnableBINARYMIME
+	clone.AuthDisabled = s.AuthDisabled
+	clone.Submission = s.Submission
+	clone.SenderOwner = s.SenderOwner
+	clone.AuthLimiter = s.AuthLimiter
+	clone.RequireSTARTTLS = s.RequireSTARTTLS
+	clone.TLSExemptNetworks = s.TLSExemptNetworks
+	clone.MinTLSVersion = s.MinTLSVersion
+	clone.TLSCipherSuites = s.TLSCipherSuites
+	clone.TLSLog = s.TLSLog
+	clone.EnableVRFY = s.EnableVRFY
+	clone.EnableEXPN = s.EnableEXPN
+	clone.VerifyRequireAuth = s.VerifyRequireAuth
+	clone.VerifyTrustedNetworks = s.VerifyTrustedNetworks
+	clone.HelpText = s.HelpText
+	clone.Replies = s.Replies
+
+	clone.caps = append([]string(nil), s.caps...)
+	for name, f := range s.auths {
+		clone.auths[name] = f
+	}
+	return clone
+}
+
 // ForEachConn iterates through all opened connections.
 func (s *Server) ForEachConn(f func(*Conn)) {
 	s.locker.Lock()
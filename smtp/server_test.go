@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"testing"
+)
+
+type testOwner struct{}
+
+func (*testOwner) OwnsAddress(username, address string) bool { return true }
+
+// nonZero 返回 t 类型的非零值
+func nonZero(t *testing.T, typ reflect.Type) reflect.Value {
+	switch typ.Kind() {
+	case reflect.String:
+		return reflect.ValueOf("x").Convert(typ)
+	case reflect.Bool:
+		return reflect.ValueOf(true)
+	case reflect.Int, reflect.Int64, reflect.Uint16:
+		return reflect.ValueOf(1).Convert(typ)
+	case reflect.Ptr:
+		return reflect.New(typ.Elem())
+	case reflect.Slice:
+		return reflect.MakeSlice(typ, 1, 1)
+	case reflect.Map:
+		return reflect.MakeMap(typ)
+	case reflect.Interface:
+		for _, v := range []interface{}{&bytes.Buffer{}, log.Default(), &authTestBackend{}, &testOwner{}} {
+			if rv := reflect.ValueOf(v); rv.Type().Implements(typ) {
+				return rv
+			}
+		}
+	}
+	t.Fatalf("no test value for %s", typ)
+	return reflect.Value{}
+}
+
+func TestServerCloneCopiesConfig(t *testing.T) {
+	s := NewServer(nil)
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Type().Field(i); field.IsExported() {
+			v.Field(i).Set(nonZero(t, field.Type))
+		}
+	}
+
+	clone := reflect.ValueOf(s.Clone()).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.IsExported() && !reflect.DeepEqual(clone.Field(i).Interface(), v.Field(i).Interface()) {
+			t.Errorf("Clone does not copy %s", field.Name)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+var ErrSenderNotOwned = &SMTPError{
+	Code:         553,
+	EnhancedCode: EnhancedCode{5, 7, 1},
+	Message:      "Sender address not owned by authenticated user",
+}
+
+// AuthUserSession 会话可选实现的接口
+//
+// AUTH 成功之后服务调用 SetAuthUser，传入认证得到的用户名，
+// 便于会话在提交模式下记录邮件的发送者。
+type AuthUserSession interface {
+	SetAuthUser(username string)
+}
+
+// AddressOwner 判断认证用户是否拥有某个邮件地址，用于提交模式的发件人检查
+type AddressOwner interface {
+	OwnsAddress(username, address string) bool
+}
+
+// AddressOwnerFunc 函数形式的 AddressOwner
+type AddressOwnerFunc func(username, address string) bool
+
+func (f AddressOwnerFunc) OwnsAddress(username, address string) bool {
+	return f(username, address)
+}
+
+// SameAddressOwner 用户名就是邮件地址时使用，只允许使用与用户名相同的地址，不区分大小写
+var SameAddressOwner AddressOwner = AddressOwnerFunc(func(username, address string) bool {
+	return strings.EqualFold(username, address)
+})
+
+// AuthUser 返回当前连接认证得到的用户名，未认证时为空
+func (c *Conn) AuthUser() string {
+	if !c.didAuth {
+		return ""
+	}
+	return c.authUser
+}
+
+// submissionAuthRequired 提交模式下未认证时拒绝命令，返回是否已经拒绝
+func (c *Conn) submissionAuthRequired() bool {
+	if !c.server.Submission || c.didAuth {
+		return false
+	}
+	c.reply(ErrAuthRequired.Code, ErrAuthRequired.EnhancedCode, ReplyAuthRequired)
+	return true
+}
+
+// senderOwned 检查发件地址是否属于认证用户，空地址（退信）不检查
+func (c *Conn) senderOwned(address string) bool {
+	owner := c.server.SenderOwner
+	if owner == nil || !c.didAuth || address == "" {
+		return true
+	}
+	return owner.OwnsAddress(c.authUser, address)
+}
+
+// sessionData 把消息交给会话，需要检查发件人时先校验头部的 From 地址
+func (c *Conn) sessionData(r io.Reader) error {
+	if c.server.SenderOwner != nil && c.didAuth {
+		var err error
+		if r, err = c.checkHeaderFrom(r); err != nil {
+			return err
+		}
+	}
+	return c.Session().Data(r)
+}
+
+// checkHeaderFrom 读取消息头部并检查所有 From 地址，返回包含完整消息的 Reader
+func (c *Conn) checkHeaderFrom(r io.Reader) (io.Reader, error) {
+	var buf bytes.Buffer
+	tr := textproto.NewReader(bufio.NewReader(io.TeeReader(r, &buf)))
+	header, err := tr.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, &SMTPError{
+			Code:         550,
+			EnhancedCode: EnhancedCode{5, 6, 0},
+			Message:      c.server.replyText(ReplyMalformedHeader),
+		}
+	}
+
+	for _, value := range header.Values("From") {
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			return nil, &SMTPError{
+				Code:         550,
+				EnhancedCode: EnhancedCode{5, 6, 0},
+				Message:      c.server.replyText(ReplyMalformedFrom),
+			}
+		}
+		for _, addr := range addrs {
+			if !c.senderOwned(addr.Address) {
+				return nil, ErrSenderNotOwned
+			}
+		}
+	}
+
+	// buf 保存了已经读取的全部数据，包括缓冲区中读取到的消息体
+	return io.MultiReader(&buf, r), nil
+}
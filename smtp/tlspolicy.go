@@ -0,0 +1,174 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+var ErrSTARTTLSRequired = &SMTPError{
+	Code:         530,
+	EnhancedCode: EnhancedCode{5, 7, 0},
+	Message:      "Must issue STARTTLS first",
+}
+
+// TLSHandshakeEvent TLS握手结果，握手失败或者不满足策略时 Err 不为空
+type TLSHandshakeEvent struct {
+	Time        time.Time
+	RemoteAddr  net.Addr
+	Implicit    bool // 隐式TLS（smtps）为 true，STARTTLS 为 false
+	Version     uint16
+	CipherSuite uint16
+	ServerName  string
+	Err         error
+}
+
+func (e *TLSHandshakeEvent) String() string {
+	mode := "STARTTLS"
+	if e.Implicit {
+		mode = "implicit TLS"
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s handshake with %v failed: %v", mode, e.RemoteAddr, e.Err)
+	}
+	return fmt.Sprintf("%s handshake with %v: version=%s cipher=%s sni=%q", mode, e.RemoteAddr,
+		TLSVersionName(e.Version), tls.CipherSuiteName(e.CipherSuite), e.ServerName)
+}
+
+// TLSVersionName 返回TLS版本的名称
+func TLSVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// ParseTLSVersion 解析 "1.2"、"TLS1.2" 形式的TLS版本
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0", "TLS1.0":
+		return tls.VersionTLS10, nil
+	case "1.1", "TLS1.1":
+		return tls.VersionTLS11, nil
+	case "1.2", "TLS1.2":
+		return tls.VersionTLS12, nil
+	case "1.3", "TLS1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("smtp: unknown TLS version %q", s)
+}
+
+// ParseCipherSuites 根据名称查找加密套件，名称与 tls.CipherSuiteName 的返回值相同
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("smtp: unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseNetworks 解析 CIDR 或者单个IP组成的网络列表
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// tlsConfig 返回应用了最低版本和加密套件策略的TLS配置
+func (s *Server) tlsConfig() *tls.Config {
+	if s.TLSConfig == nil || (s.MinTLSVersion == 0 && len(s.TLSCipherSuites) == 0) {
+		return s.TLSConfig
+	}
+	config := s.TLSConfig.Clone()
+	if s.MinTLSVersion > config.MinVersion {
+		config.MinVersion = s.MinTLSVersion
+	}
+	if len(s.TLSCipherSuites) > 0 {
+		config.CipherSuites = s.TLSCipherSuites
+	}
+	return config
+}
+
+// checkTLSPolicy 检查握手之后的连接是否满足最低版本和加密套件策略
+func (s *Server) checkTLSPolicy(state tls.ConnectionState) error {
+	if s.MinTLSVersion != 0 && state.Version < s.MinTLSVersion {
+		return fmt.Errorf("smtp: TLS version %s below minimum %s",
+			TLSVersionName(state.Version), TLSVersionName(s.MinTLSVersion))
+	}
+	// TLS 1.3 的加密套件不能配置
+	if len(s.TLSCipherSuites) > 0 && state.Version < tls.VersionTLS13 {
+		for _, id := range s.TLSCipherSuites {
+			if id == state.CipherSuite {
+				return nil
+			}
+		}
+		return fmt.Errorf("smtp: cipher suite %s not allowed", tls.CipherSuiteName(state.CipherSuite))
+	}
+	return nil
+}
+
+// logTLSHandshake 记录握手结果
+func (s *Server) logTLSHandshake(conn net.Conn, implicit bool, state *tls.ConnectionState, err error) {
+	if s.TLSLog == nil {
+		return
+	}
+	event := &TLSHandshakeEvent{
+		Time:       time.Now(),
+		RemoteAddr: conn.RemoteAddr(),
+		Implicit:   implicit,
+		Err:        err,
+	}
+	if state != nil {
+		event.Version = state.Version
+		event.CipherSuite = state.CipherSuite
+		event.ServerName = state.ServerName
+	}
+	s.TLSLog.Println(event.String())
+}
+
+// tlsExempt 报告远程地址是否在免除 STARTTLS 要求的网络中
+func (s *Server) tlsExempt(addr net.Addr) bool {
+	return trustedAddr(addr, s.TLSExemptNetworks)
+}
+
+// startTLSRequired 需要 STARTTLS 而连接还没有加密时拒绝命令，返回是否已经拒绝
+func (c *Conn) startTLSRequired() bool {
+	if !c.server.RequireSTARTTLS {
+		return false
+	}
+	if _, isTLS := c.TLSConnectionState(); isTLS || c.server.tlsExempt(c.conn.RemoteAddr()) {
+		return false
+	}
+	c.reply(ErrSTARTTLSRequired.Code, ErrSTARTTLSRequired.EnhancedCode, ReplySTARTTLSRequired)
+	return true
+}
@@ -0,0 +1,203 @@
+package tlsrpt
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhangdapeng520/zdpgo_smtp/smtp"
+)
+
+// Failure 一次失败的TLS会话
+type Failure struct {
+	ResultType          ResultType
+	SendingMTAIP        string
+	ReceivingMXHostname string
+	ReceivingMXHelo     string
+	ReceivingIP         string
+	Reason              string // 附加信息，会写入 additional-information
+}
+
+type failureKey struct {
+	resultType          ResultType
+	sendingMTAIP        string
+	receivingMXHostname string
+	receivingMXHelo     string
+	receivingIP         string
+	reason              string
+}
+
+type policyStats struct {
+	policy   Policy
+	success  int64
+	failure  int64
+	failures map[failureKey]int64
+}
+
+// Collector 按照策略域名统计TLS会话结果，可以被多个协程同时使用
+type Collector struct {
+	locker sync.Mutex
+	start  time.Time
+	stats  map[string]*policyStats
+}
+
+// NewCollector 创建结果收集器
+func NewCollector() *Collector {
+	return &Collector{
+		start: time.Now().UTC(),
+		stats: make(map[string]*policyStats),
+	}
+}
+
+func (c *Collector) get(policy Policy) *policyStats {
+	key := strings.ToLower(policy.Domain)
+	s, ok := c.stats[key]
+	if !ok {
+		s = &policyStats{
+			policy:   policy,
+			failures: make(map[failureKey]int64),
+		}
+		c.stats[key] = s
+	}
+	return s
+}
+
+// Success 记录一次成功的TLS会话
+func (c *Collector) Success(policy Policy) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.get(policy).success++
+}
+
+// Failure 记录一次失败的TLS会话
+func (c *Collector) Failure(policy Policy, f Failure) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	s := c.get(policy)
+	s.failure++
+	s.failures[failureKey{
+		resultType:          f.ResultType,
+		sendingMTAIP:        f.SendingMTAIP,
+		receivingMXHostname: f.ReceivingMXHostname,
+		receivingMXHelo:     f.ReceivingMXHelo,
+		receivingIP:         f.ReceivingIP,
+		reason:              f.Reason,
+	}]++
+}
+
+// RelayHook 返回记录 smtp.Relay TLS协商结果的函数，设置为 Relay.TLSReport 即可统计转发时的TLS会话
+//
+// policyType 为转发时使用的策略类型，没有 MTA-STS 或者 DANE 策略时为 PolicyNoPolicy。
+func (c *Collector) RelayHook(policyType PolicyType) func(*smtp.RelayTLSResult) {
+	return func(res *smtp.RelayTLSResult) {
+		policy := Policy{Type: policyType, Domain: res.Domain}
+		if res.Err == nil {
+			c.Success(policy)
+			return
+		}
+		c.Failure(policy, Failure{
+			ResultType:          ResultTypeFromError(res.Err),
+			SendingMTAIP:        addrIP(res.LocalAddr),
+			ReceivingMXHostname: res.MX,
+			ReceivingIP:         addrIP(res.RemoteAddr),
+			Reason:              res.Err.Error(),
+		})
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Flush 生成从上一次Flush到现在的报告，每个策略域名一份，并清空统计数据
+func (c *Collector) Flush(org, contact string, newID func(domain string) string) []*Report {
+	c.locker.Lock()
+	stats := c.stats
+	start := c.start
+	c.stats = make(map[string]*policyStats)
+	c.start = time.Now().UTC()
+	end := c.start
+	c.locker.Unlock()
+
+	domains := make([]string, 0, len(stats))
+	for domain := range stats {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	reports := make([]*Report, 0, len(stats))
+	for _, domain := range domains {
+		s := stats[domain]
+		result := PolicyResult{
+			Policy: s.policy,
+			Summary: Summary{
+				TotalSuccessfulSessionCount: s.success,
+				TotalFailureSessionCount:    s.failure,
+			},
+		}
+		for k, n := range s.failures {
+			result.FailureDetails = append(result.FailureDetails, FailureDetail{
+				ResultType:            k.resultType,
+				SendingMTAIP:          k.sendingMTAIP,
+				ReceivingMXHostname:   k.receivingMXHostname,
+				ReceivingMXHelo:       k.receivingMXHelo,
+				ReceivingIP:           k.receivingIP,
+				FailedSessionCount:    n,
+				AdditionalInformation: k.reason,
+			})
+		}
+		sort.Slice(result.FailureDetails, func(i, j int) bool {
+			return result.FailureDetails[i].FailedSessionCount > result.FailureDetails[j].FailedSessionCount
+		})
+
+		reports = append(reports, &Report{
+			OrganizationName: org,
+			DateRange: DateRange{
+				Start: start.Truncate(time.Second),
+				End:   end.Truncate(time.Second),
+			},
+			ContactInfo: contact,
+			ReportID:    newID(s.policy.Domain),
+			Policies:    []PolicyResult{result},
+		})
+	}
+	return reports
+}
+
+// ErrSTARTTLSNotSupported 对方服务器不支持STARTTLS时，投递流程可以用这个错误调用 ResultTypeFromError
+var ErrSTARTTLSNotSupported = errors.New("tlsrpt: 服务器不支持 STARTTLS")
+
+// ResultTypeFromError 根据TLS握手错误推断失败类型
+func ResultTypeFromError(err error) ResultType {
+	var (
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+		authErr    x509.UnknownAuthorityError
+	)
+	switch {
+	case errors.Is(err, ErrSTARTTLSNotSupported), errors.Is(err, smtp.ErrSTARTTLSUnavailable):
+		return ResultSTARTTLSNotSupported
+	case errors.As(err, &hostErr):
+		return ResultCertificateHostMismatch
+	case errors.As(err, &invalidErr):
+		if invalidErr.Reason == x509.Expired {
+			return ResultCertificateExpired
+		}
+		return ResultCertificateNotTrusted
+	case errors.As(err, &authErr):
+		return ResultCertificateNotTrusted
+	default:
+		return ResultValidationFailure
+	}
+}
@@ -0,0 +1,116 @@
+package tlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// PolicyType 策略类型
+type PolicyType string
+
+const (
+	PolicySTS      PolicyType = "sts"
+	PolicyTLSA     PolicyType = "tlsa"
+	PolicyNoPolicy PolicyType = "no-policy-found"
+)
+
+// ResultType 失败类型
+type ResultType string
+
+const (
+	ResultSTARTTLSNotSupported    ResultType = "starttls-not-supported"
+	ResultCertificateHostMismatch ResultType = "certificate-host-mismatch"
+	ResultCertificateExpired      ResultType = "certificate-expired"
+	ResultCertificateNotTrusted   ResultType = "certificate-not-trusted"
+	ResultValidationFailure       ResultType = "validation-failure"
+	ResultTLSAInvalid             ResultType = "tlsa-invalid"
+	ResultDNSSECInvalid           ResultType = "dnssec-invalid"
+	ResultDANERequired            ResultType = "dane-required"
+	ResultSTSPolicyFetchError     ResultType = "sts-policy-fetch-error"
+	ResultSTSPolicyInvalid        ResultType = "sts-policy-invalid"
+	ResultSTSWebPKIInvalid        ResultType = "sts-webpki-invalid"
+)
+
+// Report TLS-RPT聚合报告，字段名称和RFC 8460第4节保持一致
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyResult `json:"policies"`
+}
+
+// DateRange 报告时间范围
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+// PolicyResult 单个策略的统计结果
+type PolicyResult struct {
+	Policy         Policy          `json:"policy"`
+	Summary        Summary         `json:"summary"`
+	FailureDetails []FailureDetail `json:"failure-details,omitempty"`
+}
+
+// Policy 策略描述
+type Policy struct {
+	Type   PolicyType `json:"policy-type"`
+	String []string   `json:"policy-string,omitempty"`
+	Domain string     `json:"policy-domain"`
+	MXHost []string   `json:"mx-host,omitempty"`
+}
+
+// Summary 会话统计
+type Summary struct {
+	TotalSuccessfulSessionCount int64 `json:"total-successful-session-count"`
+	TotalFailureSessionCount    int64 `json:"total-failure-session-count"`
+}
+
+// FailureDetail 失败详情
+type FailureDetail struct {
+	ResultType            ResultType `json:"result-type"`
+	SendingMTAIP          string     `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname   string     `json:"receiving-mx-hostname,omitempty"`
+	ReceivingMXHelo       string     `json:"receiving-mx-helo,omitempty"`
+	ReceivingIP           string     `json:"receiving-ip,omitempty"`
+	FailedSessionCount    int64      `json:"failed-session-count"`
+	AdditionalInformation string     `json:"additional-information,omitempty"`
+	FailureReasonCode     string     `json:"failure-reason-code,omitempty"`
+}
+
+// PolicyDomain 返回报告对应的策略域名
+func (r *Report) PolicyDomain() string {
+	if len(r.Policies) == 0 {
+		return ""
+	}
+	return r.Policies[0].Policy.Domain
+}
+
+// FileName 生成报告文件名
+// 格式为 submitter!policy-domain!begin-timestamp!end-timestamp!unique-id.json.gz
+func (r *Report) FileName(submitter string) string {
+	return fmt.Sprintf("%s!%s!%d!%d!%s.json.gz", submitter, r.PolicyDomain(),
+		r.DateRange.Start.Unix(), r.DateRange.End.Unix(), r.ReportID)
+}
+
+// MarshalGzip 生成gzip压缩后的JSON报告
+func (r *Report) MarshalGzip() ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
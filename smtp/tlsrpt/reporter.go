@@ -0,0 +1,276 @@
+package tlsrpt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhangdapeng520/zdpgo_smtp/smtp"
+)
+
+// MailSender 发送邮件的函数
+type MailSender func(from string, to []string, r io.Reader) error
+
+// Reporter 定期生成并发送TLS-RPT报告
+type Reporter struct {
+	Collector        *Collector
+	OrganizationName string // 报告提交者的组织名称
+	Submitter        string // 报告提交者的域名
+	ContactInfo      string // 联系方式
+	From             string // 邮件报告的发件人
+
+	Interval   time.Duration // 报告周期，默认一天，按照UTC时间对齐
+	RetryFor   time.Duration // 发送失败的报告保留重试的时间，默认3天
+	LookupTXT  LookupTXT     // 查询 _smtp._tls 记录，默认 net.LookupTXT
+	SendMail   MailSender    // 发送邮件报告，默认通过MX记录直接投递
+	HTTPClient *http.Client  // 发送HTTPS报告，默认 http.DefaultClient
+	ErrorLog   smtp.Logger
+
+	mu      sync.Mutex
+	pending []*Report // 发送失败，等待下一次 Flush 重试的报告
+}
+
+// Run 在每个UTC报告周期的边界发送报告，直到 stop 被关闭
+//
+// 默认周期为一天，报告在UTC零点生成，与RFC 8460要求的按UTC日统计一致。
+func (r *Reporter) Run(stop <-chan struct{}) {
+	interval := r.Interval
+	if interval == 0 {
+		interval = 24 * time.Hour
+	}
+
+	for {
+		now := time.Now()
+		timer := time.NewTimer(nextPeriod(now, interval).Sub(now))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			if err := r.Flush(); err != nil && r.ErrorLog != nil {
+				r.ErrorLog.Printf("发送TLS-RPT报告失败: %s", err)
+			}
+		}
+	}
+}
+
+// nextPeriod 返回 now 之后下一个报告周期的开始时间
+//
+// 零值时间是UTC零点，Truncate 按照绝对时间计算，和 now 的时区无关，得到当前周期的开始时间。
+func nextPeriod(now time.Time, interval time.Duration) time.Time {
+	return now.UTC().Truncate(interval).Add(interval)
+}
+
+// Flush 立即生成并发送当前统计周期的报告
+//
+// 发送失败的报告保留下来，在之后的 Flush 中重新发送，超过 RetryFor 之后丢弃。
+// 策略域名没有 TLS-RPT 记录时不需要发送，报告直接丢弃。
+func (r *Reporter) Flush() error {
+	r.mu.Lock()
+	reports := r.pending
+	r.pending = nil
+	r.mu.Unlock()
+	reports = append(reports, r.Collector.Flush(r.OrganizationName, r.ContactInfo, r.newReportID)...)
+
+	retryFor := r.RetryFor
+	if retryFor == 0 {
+		retryFor = 3 * 24 * time.Hour
+	}
+	now := time.Now()
+
+	var (
+		errs  []string
+		retry []*Report
+	)
+	for _, report := range reports {
+		err := r.Send(report)
+		if err == nil {
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", report.PolicyDomain(), err))
+		if !noRecord(err) && now.Sub(report.DateRange.End) < retryFor {
+			retry = append(retry, report)
+		}
+	}
+
+	if len(retry) > 0 {
+		r.mu.Lock()
+		r.pending = append(r.pending, retry...)
+		r.mu.Unlock()
+	}
+	if len(errs) > 0 {
+		return errors.New("tlsrpt: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// noRecord 判断错误是否表示策略域名没有 TLS-RPT 记录
+func noRecord(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.Is(err, ErrNoRecord) || (errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+}
+
+// Send 把报告发送到策略域名 rua 中的所有地址
+func (r *Reporter) Send(report *Report) error {
+	rec, err := Lookup(report.PolicyDomain(), r.LookupTXT)
+	if err != nil {
+		return err
+	}
+
+	body, err := report.MarshalGzip()
+	if err != nil {
+		return err
+	}
+
+	// RFC 8460 要求尝试所有地址，只要有一个成功就认为发送成功
+	var lastErr error
+	sent := false
+	for _, rua := range rec.RUA {
+		u, err := url.Parse(rua)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "mailto":
+			err = r.sendMail(report, u.Opaque, body)
+		case "https":
+			err = r.sendHTTPS(rua, body)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		sent = true
+	}
+	if !sent {
+		return lastErr
+	}
+	return nil
+}
+
+func (r *Reporter) sendHTTPS(endpoint string, body []byte) error {
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", GzipType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("tlsrpt: HTTPS上报失败: %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *Reporter) sendMail(report *Report, to string, body []byte) error {
+	to, err := url.PathUnescape(to)
+	if err != nil {
+		return err
+	}
+	// mailto 中可能带有 ?subject= 之类的参数
+	if i := strings.IndexByte(to, '?'); i >= 0 {
+		to = to[:i]
+	}
+
+	msg, err := r.composeMail(report, to, body)
+	if err != nil {
+		return err
+	}
+
+	send := r.SendMail
+	if send == nil {
+		send = deliverMX
+	}
+	return send(r.From, []string{to}, bytes.NewReader(msg))
+}
+
+// composeMail 按照RFC 8460第5.3节生成 multipart/report 邮件
+func (r *Reporter) composeMail(report *Report, to string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	headers := [][2]string{
+		{"From", r.From},
+		{"To", to},
+		{"Subject", fmt.Sprintf("Report Domain: %s Submitter: %s Report-ID: <%s>",
+			report.PolicyDomain(), r.Submitter, report.ReportID)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", report.ReportID, r.Submitter)},
+		{"TLS-Report-Domain", report.PolicyDomain()},
+		{"TLS-Report-Submitter", r.Submitter},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", fmt.Sprintf("multipart/report; report-type=\"tlsrpt\"; boundary=%q", mw.Boundary())},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=us-ascii"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "This is an aggregate TLS report from %s\r\n", r.Submitter)
+
+	fileName := report.FileName(r.Submitter)
+	attachment, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {fmt.Sprintf("%s; name=%q", GzipType, fileName)},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", fileName)},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(body)
+	for len(encoded) > 76 {
+		io.WriteString(attachment, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(attachment, encoded+"\r\n")
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *Reporter) newReportID(domain string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s.%s@%s", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(b), r.Submitter)
+}
+
+// deliverMX 根据收件人域名的MX记录直接投递邮件
+func deliverMX(from string, to []string, r io.Reader) error {
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = (&smtp.Relay{}).Deliver(context.Background(), from, nil, to, msg)
+	return err
+}
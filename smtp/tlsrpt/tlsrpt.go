@@ -0,0 +1,93 @@
+// Package tlsrpt 实现 RFC 8460 SMTP TLS Reporting (TLS-RPT)。
+//
+// 投递流程通过 Collector 记录每个策略域名的TLS会话成功和失败次数，使用 smtp.Relay
+// 转发时把 Collector.RelayHook 设置为 Relay.TLSReport 即可。
+// Reporter 定期把统计结果生成JSON聚合报告，gzip压缩后按照 _smtp._tls
+// 记录中的 rua 地址通过邮件或者HTTPS发送出去。
+package tlsrpt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// 报告相关的MIME类型和版本号
+const (
+	Version      = "TLSRPTv1"
+	MediaType    = "application/tlsrpt+json"
+	GzipType     = "application/tlsrpt+gzip"
+	recordPrefix = "_smtp._tls."
+)
+
+var ErrNoRecord = errors.New("tlsrpt: 未找到 TLSRPTv1 记录")
+
+// Record _smtp._tls TXT记录
+type Record struct {
+	RUA []string // 报告接收地址，mailto: 或者 https: URI
+}
+
+// ParseRecord 解析TLS-RPT TXT记录，例如 "v=TLSRPTv1; rua=mailto:tlsrpt@example.com"
+func ParseRecord(txt string) (*Record, error) {
+	fields := strings.Split(txt, ";")
+	if len(fields) == 0 || strings.TrimSpace(fields[0]) != "v="+Version {
+		return nil, fmt.Errorf("tlsrpt: 错误的版本: %q", txt)
+	}
+
+	rec := &Record{}
+	for _, field := range fields[1:] {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("tlsrpt: 错误的字段: %q", field)
+		}
+		if strings.TrimSpace(kv[0]) != "rua" {
+			// 未知字段按照RFC要求忽略
+			continue
+		}
+		for _, uri := range strings.Split(kv[1], ",") {
+			uri = strings.TrimSpace(uri)
+			lower := strings.ToLower(uri)
+			if !strings.HasPrefix(lower, "mailto:") && !strings.HasPrefix(lower, "https:") {
+				return nil, fmt.Errorf("tlsrpt: 不支持的rua地址: %q", uri)
+			}
+			rec.RUA = append(rec.RUA, uri)
+		}
+	}
+	if len(rec.RUA) == 0 {
+		return nil, fmt.Errorf("tlsrpt: 缺少rua字段: %q", txt)
+	}
+	return rec, nil
+}
+
+// LookupTXT 查询TXT记录的函数，便于测试时替换
+type LookupTXT func(name string) ([]string, error)
+
+// Lookup 查询策略域名的 _smtp._tls TXT记录
+//
+// 如果 lookup 为 nil，使用 net.LookupTXT。
+func Lookup(domain string, lookup LookupTXT) (*Record, error) {
+	if lookup == nil {
+		lookup = net.LookupTXT
+	}
+	txts, err := lookup(recordPrefix + strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v="+Version) {
+			found = append(found, txt)
+		}
+	}
+	// 存在多条记录时视为没有记录
+	if len(found) != 1 {
+		return nil, ErrNoRecord
+	}
+	return ParseRecord(found[0])
+}
@@ -0,0 +1,186 @@
+package tlsrpt
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhangdapeng520/zdpgo_smtp/smtp"
+)
+
+func TestCollectorFlush(t *testing.T) {
+	c := NewCollector()
+	sts := Policy{Type: PolicySTS, Domain: "example.com"}
+	c.Success(sts)
+	c.Success(Policy{Type: PolicySTS, Domain: "Example.COM"})
+	for i := 0; i < 3; i++ {
+		c.Failure(sts, Failure{ResultType: ResultCertificateExpired, ReceivingMXHostname: "mx1.example.com"})
+	}
+	c.Failure(sts, Failure{ResultType: ResultCertificateExpired, ReceivingMXHostname: "mx2.example.com"})
+
+	hook := c.RelayHook(PolicyNoPolicy)
+	hook(&smtp.RelayTLSResult{
+		Domain:     "example.org",
+		MX:         "mx.example.org",
+		LocalAddr:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000},
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 25},
+		Err:        smtp.ErrSTARTTLSUnavailable,
+	})
+
+	reports := c.Flush("Example Org", "mailto:postmaster@example.net", func(domain string) string { return "id-" + domain })
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports, want 2", len(reports))
+	}
+	for _, r := range reports {
+		if r.DateRange.Start.Location() != time.UTC || r.DateRange.End.Location() != time.UTC {
+			t.Errorf("%s: date range not in UTC: %v", r.PolicyDomain(), r.DateRange)
+		}
+	}
+
+	com := reports[0].Policies[0]
+	if com.Policy.Domain != "example.com" || reports[0].ReportID != "id-example.com" {
+		t.Errorf("first report = %s %s, want example.com", com.Policy.Domain, reports[0].ReportID)
+	}
+	if com.Summary.TotalSuccessfulSessionCount != 2 || com.Summary.TotalFailureSessionCount != 4 {
+		t.Errorf("example.com summary = %+v, want 2 successful and 4 failed sessions", com.Summary)
+	}
+	if len(com.FailureDetails) != 2 || com.FailureDetails[0].ReceivingMXHostname != "mx1.example.com" ||
+		com.FailureDetails[0].FailedSessionCount != 3 || com.FailureDetails[1].FailedSessionCount != 1 {
+		t.Errorf("example.com failure details = %+v", com.FailureDetails)
+	}
+
+	org := reports[1].Policies[0]
+	want := FailureDetail{
+		ResultType:            ResultSTARTTLSNotSupported,
+		SendingMTAIP:          "192.0.2.1",
+		ReceivingMXHostname:   "mx.example.org",
+		ReceivingIP:           "198.51.100.1",
+		FailedSessionCount:    1,
+		AdditionalInformation: smtp.ErrSTARTTLSUnavailable.Error(),
+	}
+	if org.Policy.Type != PolicyNoPolicy || len(org.FailureDetails) != 1 || org.FailureDetails[0] != want {
+		t.Errorf("example.org result = %+v", org)
+	}
+
+	// 统计数据在 Flush 之后清空，下一份报告从上一份的结束时间开始
+	next := c.Flush("Example Org", "", func(string) string { return "" })
+	if len(next) != 0 {
+		t.Errorf("got %d reports after flush, want 0", len(next))
+	}
+	c.Success(sts)
+	next = c.Flush("Example Org", "", func(string) string { return "" })
+	if len(next) != 1 || next[0].DateRange.Start.Before(reports[0].DateRange.End) {
+		t.Errorf("next report = %+v, want one starting at %v", next, reports[0].DateRange.End)
+	}
+}
+
+func TestNextPeriod(t *testing.T) {
+	beijing := time.FixedZone("CST", 8*3600)
+	tests := []struct {
+		now      time.Time
+		interval time.Duration
+		want     time.Time
+	}{
+		// 北京时间早上7点是UTC前一天23点，报告在UTC零点生成
+		{time.Date(2026, 10, 19, 7, 0, 0, 0, beijing), 24 * time.Hour, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 19, 9, 0, 0, 0, beijing), 24 * time.Hour, time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), 24 * time.Hour, time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 19, 13, 30, 0, 0, time.UTC), 6 * time.Hour, time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range tests {
+		got := nextPeriod(tc.now, tc.interval)
+		if !got.Equal(tc.want) || got.Location() != time.UTC {
+			t.Errorf("nextPeriod(%v, %v) = %v, want %v", tc.now, tc.interval, got, tc.want)
+		}
+	}
+}
+
+func TestReporterRetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		fail     = true
+		received []string
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var report Report
+		if err := json.NewDecoder(zr).Decode(&report); err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, report.ReportID)
+	}))
+	defer srv.Close()
+
+	lookup := func(name string) ([]string, error) {
+		switch name {
+		case "_smtp._tls.example.com":
+			return []string{"v=TLSRPTv1; rua=" + srv.URL + "/tlsrpt"}, nil
+		case "_smtp._tls.example.org":
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return nil, errors.New("unexpected lookup " + name)
+	}
+	c := NewCollector()
+	r := &Reporter{
+		Collector:  c,
+		Submitter:  "example.net",
+		LookupTXT:  lookup,
+		HTTPClient: srv.Client(),
+	}
+
+	c.Success(Policy{Type: PolicySTS, Domain: "example.com"})
+	c.Success(Policy{Type: PolicySTS, Domain: "example.org"})
+	if err := r.Flush(); err == nil {
+		t.Fatal("Flush succeeded while the endpoint was failing")
+	}
+	// 没有 TLS-RPT 记录的报告直接丢弃，发送失败的报告等待重试
+	if len(r.pending) != 1 || r.pending[0].PolicyDomain() != "example.com" {
+		t.Fatalf("pending = %v, want the example.com report", r.pending)
+	}
+	first := r.pending[0].ReportID
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	c.Success(Policy{Type: PolicySTS, Domain: "example.com"})
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 2 || received[0] != first {
+		t.Errorf("received %v, want the retried report %s first", received, first)
+	}
+	if len(r.pending) != 0 {
+		t.Errorf("pending = %v after successful flush", r.pending)
+	}
+
+	// 超过 RetryFor 的报告不再重试
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	r.RetryFor = time.Nanosecond
+	c.Success(Policy{Type: PolicySTS, Domain: "example.com"})
+	time.Sleep(time.Millisecond)
+	if err := r.Flush(); err == nil {
+		t.Fatal("Flush succeeded while the endpoint was failing")
+	}
+	if len(r.pending) != 0 {
+		t.Errorf("pending = %v, want expired reports dropped", r.pending)
+	}
+}
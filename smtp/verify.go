@@ -0,0 +1,138 @@
+package smtp
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// VerifySession 会话可选实现的接口，服务开启 EnableVRFY 之后用于处理 VRFY 命令
+//
+// 返回邮箱的完整形式，例如 "张三 <zhangsan@example.com>"。用户不存在时返回
+// 550 的 SMTPError，匹配到多个用户时返回 553 的 SMTPError。
+type VerifySession interface {
+	Verify(user string) (string, error)
+}
+
+// ExpandSession 会话可选实现的接口，服务开启 EnableEXPN 之后用于处理 EXPN 命令，
+// 返回邮件列表或者别名的全部成员
+type ExpandSession interface {
+	Expand(list string) ([]string, error)
+}
+
+// trustedAddr 报告远程地址是否在给定的网络中，Unix 套接字等本地连接总是可信的
+func trustedAddr(addr net.Addr, networks []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, network := range networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyAllowed 检查客户端是否可以使用 VRFY 和 EXPN，不允许时回复错误
+func (c *Conn) verifyAllowed() bool {
+	if !c.server.VerifyRequireAuth || c.didAuth || trustedAddr(c.conn.RemoteAddr(), c.server.VerifyTrustedNetworks) {
+		return true
+	}
+	c.reply(ErrAuthRequired.Code, ErrAuthRequired.EnhancedCode, ReplyAuthRequired)
+	return false
+}
+
+// verifyArg 返回 VRFY、EXPN 的参数，去掉两端的空白和一对尖括号
+//
+// RFC 5321 中参数可以是用户名、邮箱或者邮件列表名，不一定是合法的路径，所以只去掉一层尖括号。
+func verifyArg(arg string) string {
+	arg = strings.TrimSpace(arg)
+	if len(arg) >= 2 && arg[0] == '<' && arg[len(arg)-1] == '>' {
+		arg = arg[1 : len(arg)-1]
+	}
+	return arg
+}
+
+// handleVrfy 处理 VRFY 命令，没有开启时回复 252，不透露用户是否存在
+func (c *Conn) handleVrfy(arg string) {
+	sess, ok := c.Session().(VerifySession)
+	if !c.server.EnableVRFY || !ok {
+		c.reply(252, EnhancedCode{2, 5, 0}, ReplyVrfyCannot)
+		return
+	}
+	user := verifyArg(arg)
+	if user == "" {
+		c.reply(501, EnhancedCode{5, 5, 4}, ReplyVrfySyntax)
+		return
+	}
+	if !c.verifyAllowed() {
+		return
+	}
+
+	mailbox, err := sess.Verify(user)
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, c.errorText(smtpErr))
+			return
+		}
+		c.reply(451, EnhancedCode{4, 0, 0}, ReplyVerifyFailed)
+		return
+	}
+	c.WriteResponse(250, EnhancedCode{2, 1, 5}, mailbox)
+}
+
+// handleExpn 处理 EXPN 命令，每个成员一行，使用 250- 的多行响应
+func (c *Conn) handleExpn(arg string) {
+	sess, ok := c.Session().(ExpandSession)
+	if !c.server.EnableEXPN || !ok {
+		c.reply(502, EnhancedCode{5, 5, 1}, ReplyNotImplemented, "Command", "EXPN")
+		return
+	}
+	list := verifyArg(arg)
+	if list == "" {
+		c.reply(501, EnhancedCode{5, 5, 4}, ReplyExpnSyntax)
+		return
+	}
+	if !c.verifyAllowed() {
+		return
+	}
+
+	members, err := sess.Expand(list)
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, c.errorText(smtpErr))
+			return
+		}
+		c.reply(451, EnhancedCode{4, 0, 0}, ReplyVerifyFailed)
+		return
+	}
+	if len(members) == 0 {
+		c.reply(550, EnhancedCode{5, 1, 1}, ReplyExpnEmpty)
+		return
+	}
+	c.WriteResponse(250, EnhancedCode{2, 1, 5}, members...)
+}
+
+var enhancedCodeRe = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3} `)
+
+// Expand 发送 EXPN 命令，返回邮件列表或者别名的成员
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) Expand(list string) ([]string, error) {
+	if err := validateLine(list); err != nil {
+		return nil, err
+	}
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+	_, msg, err := c.cmd(250, "EXPN %s", list)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		lines[i] = enhancedCodeRe.ReplaceAllString(line, "")
+	}
+	return lines, nil
+}
@@ -0,0 +1,108 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+type verifyTestBackend struct{}
+
+func (verifyTestBackend) NewSession(ConnectionState) (Session, error) {
+	return verifyTestSession{}, nil
+}
+
+// verifyTestSession 只认识 alice，名称为 broken 时模拟后端故障
+type verifyTestSession struct{}
+
+func (verifyTestSession) Reset()                          {}
+func (verifyTestSession) Logout() error                   { return nil }
+func (verifyTestSession) Mail(string, *MailOptions) error { return nil }
+func (verifyTestSession) Rcpt(string) error               { return nil }
+func (verifyTestSession) Data(io.Reader) error            { return nil }
+
+func (verifyTestSession) lookup(name string) ([]string, error) {
+	switch name {
+	case "alice", "alice@example.com":
+		return []string{"Alice <alice@example.com>"}, nil
+	case "broken":
+		return nil, errors.New("ldap: connection refused")
+	}
+	return nil, &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 1, 1}, Message: "User unknown"}
+}
+
+func (s verifyTestSession) Verify(user string) (string, error) {
+	l, err := s.lookup(user)
+	if err != nil {
+		return "", err
+	}
+	return l[0], nil
+}
+
+func (s verifyTestSession) Expand(list string) ([]string, error) {
+	return s.lookup(list)
+}
+
+func TestVerify(t *testing.T) {
+	s := NewServer(verifyTestBackend{})
+	s.Domain = "localhost"
+	s.EnableVRFY = true
+	s.EnableEXPN = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.SetDeadline(time.Now().Add(10 * time.Second))
+	conn := textproto.NewConn(nc)
+	defer conn.Close()
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	// 会话在 EHLO 之后才创建
+	if err := conn.PrintfLine("EHLO localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cmd  string
+		code int
+		msg  string
+	}{
+		{"VRFY alice", 250, "Alice <alice@example.com>"},
+		{"VRFY  <alice@example.com> ", 250, "Alice <alice@example.com>"},
+		// 只去掉一层尖括号
+		{"VRFY <<alice>>", 550, "User unknown"},
+		{"VRFY <>", 501, DefaultReplies[ReplyVrfySyntax]},
+		{"EXPN <alice>", 250, "Alice <alice@example.com>"},
+		{"EXPN <>", 501, DefaultReplies[ReplyExpnSyntax]},
+		// 后端返回的不是 SMTPError 时不把错误内容发给客户端
+		{"VRFY broken", 451, DefaultReplies[ReplyVerifyFailed]},
+		{"EXPN broken", 451, DefaultReplies[ReplyVerifyFailed]},
+	}
+	for _, tc := range tests {
+		if err := conn.PrintfLine("%s", tc.cmd); err != nil {
+			t.Fatal(err)
+		}
+		code, msg, err := conn.ReadResponse(0)
+		if err != nil && code == 0 {
+			t.Fatal(err)
+		}
+		if code != tc.code || !strings.HasSuffix(msg, tc.msg) {
+			t.Errorf("%q: got %d %q, want %d %q", tc.cmd, code, msg, tc.code, tc.msg)
+		}
+	}
+}
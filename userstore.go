@@ -0,0 +1,314 @@
+package zdpgo_smtp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zhangdapeng520/zdpgo_yaml"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+@Time : 2026/10/19 10:12
+@Author : 张大鹏
+@File : userstore.go
+@Software: Goland2021.3.1
+@Description: 用户目录
+*/
+
+var (
+	ErrUserNotFound    = errors.New("用户不存在")
+	ErrInvalidPassword = errors.New("用户名或密码错误")
+)
+
+// UserStore 用户目录
+type UserStore interface {
+	// Authenticate 校验用户名和密码，失败时统一返回 ErrInvalidPassword
+	Authenticate(username, password string) error
+}
+
+// UserChecker 可以判断用户是否存在的用户目录，客户端证书认证时使用
+type UserChecker interface {
+	HasUser(username string) bool
+}
+
+// dummyHash 用户不存在时也计算一次哈希，避免通过响应时间判断用户是否存在
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("zdpgo_smtp"), bcrypt.DefaultCost)
+
+// PlainPrefix 明文密码的前缀，例如 {plain}secret
+//
+// 为了兼容旧的配置，不以 $ 开头的非空值也按照明文处理，但是建议显式加上这个前缀，
+// 避免明文恰好以哈希的前缀开头时被当成哈希。
+const PlainPrefix = "{plain}"
+
+// CheckPassword 校验密码，比较是恒定时间的
+//
+// hash 可以是 bcrypt、argon2id、argon2i 哈希，以 PlainPrefix 开头的明文，或者不以 $ 开头的旧格式明文，
+// 其他格式总是校验失败。
+func CheckPassword(hash, password string) bool {
+	switch {
+	case isBcrypt(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case isArgon2(hash):
+		return checkArgon2(hash, password)
+	case strings.HasPrefix(hash, PlainPrefix):
+		return checkPlain(hash[len(PlainPrefix):], password)
+	case isLegacyPlain(hash):
+		return checkPlain(hash, password)
+	}
+	return false
+}
+
+// checkPlain 比较明文密码，先计算摘要，避免比较时泄露密码长度
+func checkPlain(plain, password string) bool {
+	a := sha256.Sum256([]byte(plain))
+	b := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// CheckPasswordFormat 检查密码哈希的格式是否受 CheckPassword 支持
+func CheckPasswordFormat(hash string) error {
+	if isBcrypt(hash) || isArgon2(hash) || strings.HasPrefix(hash, PlainPrefix) || isLegacyPlain(hash) {
+		return nil
+	}
+	if hash == "" {
+		return errors.New("密码为空")
+	}
+	return errors.New("不支持的密码哈希，只支持 bcrypt 和 argon2，明文密码需要加上 " + PlainPrefix + " 前缀")
+}
+
+// isLegacyPlain 判断是否为没有 PlainPrefix 前缀的旧格式明文，以 $ 开头的值视为未知的哈希
+func isLegacyPlain(hash string) bool {
+	return hash != "" && !strings.HasPrefix(hash, "$") && !strings.HasPrefix(hash, PlainPrefix)
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func isArgon2(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$") || strings.HasPrefix(hash, "$argon2i$")
+}
+
+// checkArgon2 校验 PHC 格式的 argon2 哈希，例如 $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+func checkArgon2(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	var key []byte
+	if parts[1] == "argon2id" {
+		key = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	} else {
+		key = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// HashPassword 生成 bcrypt 密码哈希
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// MemoryUserStore 内存用户目录，key 为用户名，value 为 CheckPassword 支持的密码哈希或者明文
+type MemoryUserStore struct {
+	locker sync.RWMutex
+	users  map[string]string
+}
+
+// NewMemoryUserStore 根据配置的用户创建内存用户目录，密码格式不受支持时返回错误
+func NewMemoryUserStore(auths map[string]Auth) (*MemoryUserStore, error) {
+	users, err := authUsers(auths)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryUserStore{users: users}, nil
+}
+
+// LegacyPlainUsers 返回密码是没有 PlainPrefix 前缀的明文的用户，启动时用于提示迁移配置
+func (m *MemoryUserStore) LegacyPlainUsers() []string {
+	m.locker.RLock()
+	defer m.locker.RUnlock()
+	var names []string
+	for name, hash := range m.users {
+		if isLegacyPlain(hash) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// authUsers 检查用户的密码格式，返回用户名到密码哈希的映射
+func authUsers(auths map[string]Auth) (map[string]string, error) {
+	users := make(map[string]string, len(auths))
+	for _, auth := range auths {
+		if err := CheckPasswordFormat(auth.Password); err != nil {
+			return nil, fmt.Errorf("用户 %s: %w", auth.Username, err)
+		}
+		users[auth.Username] = auth.Password
+	}
+	return users, nil
+}
+
+// SetUsers 替换所有用户
+func (m *MemoryUserStore) SetUsers(users map[string]string) {
+	m.locker.Lock()
+	m.users = users
+	m.locker.Unlock()
+}
+
+func (m *MemoryUserStore) Authenticate(username, password string) error {
+	m.locker.RLock()
+	hash, ok := m.users[username]
+	m.locker.RUnlock()
+
+	if !ok || password == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return ErrInvalidPassword
+	}
+	if !CheckPassword(hash, password) {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+func (m *MemoryUserStore) HasUser(username string) bool {
+	m.locker.RLock()
+	defer m.locker.RUnlock()
+	_, ok := m.users[username]
+	return ok
+}
+
+// FileUserStore 从 YAML 或者 JSON 文件加载用户
+//
+// 文件格式：
+//
+//	users:
+//	  - username: zhangdapeng520@zhangdapeng520.com
+//	    password: $2y$10$...
+//
+// 密码可以是 bcrypt、argon2 哈希或者 {plain} 开头的明文（兼容没有前缀的明文），扩展名为 .json 时按照JSON解析。
+type FileUserStore struct {
+	*MemoryUserStore
+	Path string
+}
+
+type userFile struct {
+	Users []Auth `yaml:"users" json:"users"`
+}
+
+// NewFileUserStore 加载用户文件
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	s := &FileUserStore{
+		MemoryUserStore: &MemoryUserStore{},
+		Path:            path,
+	}
+	return s, s.Reload()
+}
+
+// Reload 重新加载用户文件
+func (s *FileUserStore) Reload() error {
+	var f userFile
+	if filepath.Ext(s.Path) == ".json" {
+		data, err := os.ReadFile(s.Path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &f); err != nil {
+			return err
+		}
+	} else if err := zdpgo_yaml.New().ReadConfig(s.Path, &f); err != nil {
+		return err
+	}
+
+	auths := make(map[string]Auth, len(f.Users))
+	for _, u := range f.Users {
+		auths[u.Username] = u
+	}
+	users, err := authUsers(auths)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.Path, err)
+	}
+	s.SetUsers(users)
+	return nil
+}
+
+// HtpasswdUserStore 从 htpasswd 格式的文件加载用户，每行一个 用户名:密码哈希
+//
+// 支持 bcrypt（htpasswd -B）和 argon2 哈希，不支持不安全的 MD5 和 crypt 哈希。
+type HtpasswdUserStore struct {
+	*MemoryUserStore
+	Path string
+}
+
+// NewHtpasswdUserStore 加载 htpasswd 文件
+func NewHtpasswdUserStore(path string) (*HtpasswdUserStore, error) {
+	s := &HtpasswdUserStore{
+		MemoryUserStore: &MemoryUserStore{},
+		Path:            path,
+	}
+	return s, s.Reload()
+}
+
+// Reload 重新加载 htpasswd 文件
+func (s *HtpasswdUserStore) Reload() error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: 格式错误", s.Path, n)
+		}
+		hash := line[i+1:]
+		if !isBcrypt(hash) && !isArgon2(hash) {
+			return fmt.Errorf("%s:%d: 不支持的密码哈希", s.Path, n)
+		}
+		users[line[:i]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.SetUsers(users)
+	return nil
+}
@@ -0,0 +1,303 @@
+package zdpgo_smtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+@Time : 2026/10/19 11:03
+@Author : 张大鹏
+@File : userstore_ldap.go
+@Software: Goland2021.3.1
+@Description: LDAP用户目录
+*/
+
+// LDAPBinder 执行LDAP简单绑定，返回 nil 表示用户名和密码正确
+type LDAPBinder interface {
+	Bind(dn, password string) error
+}
+
+// LDAPUserStore 通过LDAP绑定校验用户
+type LDAPUserStore struct {
+	// 用户DN模板，%s 会被替换为转义后的用户名，例如 uid=%s,ou=people,dc=example,dc=com
+	BindDN string
+	// 执行绑定，测试时可以替换为进程内的假实现
+	Binder LDAPBinder
+}
+
+// NewLDAPUserStore 创建LDAP用户目录，addr 例如 ldap.example.com:389 或者 ldaps://ldap.example.com:636
+//
+// 不是 ldaps 地址时使用 StartTLS，不允许明文发送密码。
+func NewLDAPUserStore(addr, bindDN string, tlsConfig *tls.Config) *LDAPUserStore {
+	return &LDAPUserStore{
+		BindDN: bindDN,
+		Binder: &LDAPConnBinder{Addr: addr, TLSConfig: tlsConfig},
+	}
+}
+
+func (s *LDAPUserStore) Authenticate(username, password string) error {
+	// 空密码的简单绑定是匿名绑定，总是成功
+	if username == "" || password == "" {
+		return ErrInvalidPassword
+	}
+	dn := fmt.Sprintf(s.BindDN, ldapEscapeDN(username))
+	if err := s.Binder.Bind(dn, password); err != nil {
+		if errors.Is(err, errLDAPInvalidCredentials) {
+			return ErrInvalidPassword
+		}
+		return err
+	}
+	return nil
+}
+
+// ldapEscapeDN 转义 RFC 4514 中的特殊字符
+func ldapEscapeDN(s string) string {
+	var b strings.Builder
+	for i, c := range s {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, c),
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(s)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+var errLDAPInvalidCredentials = errors.New("ldap: invalid credentials")
+
+// ldapStartTLSOID StartTLS 扩展操作的OID（RFC 4511 4.14节）
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// LDAPConnBinder 通过网络连接执行LDAP简单绑定（RFC 4511 4.2节）
+//
+// 地址以 ldaps:// 开头时使用TLS连接，否则连接之后先执行 StartTLS，
+// 只有 Insecure 为 true 时才会在明文连接上发送密码。
+type LDAPConnBinder struct {
+	Addr      string
+	TLSConfig *tls.Config // ldaps 和 StartTLS 使用，ServerName 为空时使用地址中的主机名
+	Timeout   time.Duration
+	Insecure  bool // 不使用 StartTLS，只应当用于本机或者测试环境
+}
+
+func (b *LDAPConnBinder) Bind(dn, password string) error {
+	timeout := b.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: timeout}
+	addr := b.Addr
+	implicitTLS := strings.HasPrefix(addr, "ldaps://")
+	if implicitTLS {
+		addr = strings.TrimPrefix(addr, "ldaps://")
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, b.tlsConfig(addr))
+	} else {
+		addr = strings.TrimPrefix(addr, "ldap://")
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { conn.Close() }()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if !implicitTLS && !b.Insecure {
+		tlsConn, err := LDAPStartTLS(conn, b.tlsConfig(addr))
+		if err != nil {
+			return err
+		}
+		conn = tlsConn
+	}
+	return LDAPSimpleBind(conn, dn, password)
+}
+
+func (b *LDAPConnBinder) tlsConfig(addr string) *tls.Config {
+	config := b.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return config
+}
+
+// LDAPStartTLS 在明文连接上执行 StartTLS 扩展操作并完成TLS握手
+func LDAPStartTLS(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	// ExtendedRequest ::= [APPLICATION 23] SEQUENCE { requestName [0] LDAPOID, ... }
+	req := berTLV(0x77, berTLV(0x80, []byte(ldapStartTLSOID)))
+	code, err := ldapRoundTrip(conn, req, 0x78)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("ldap: StartTLS 失败，结果码 %d", code)
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// LDAPSimpleBind 在已有的连接上执行LDAP简单绑定
+func LDAPSimpleBind(rw io.ReadWriter, dn, password string) error {
+	// BindRequest ::= [APPLICATION 0] SEQUENCE { version, name, [0] simple }
+	bind := berTLV(0x60, concat(
+		berTLV(0x02, []byte{3}),
+		berTLV(0x04, []byte(dn)),
+		berTLV(0x80, []byte(password)),
+	))
+	// BindResponse ::= [APPLICATION 1] SEQUENCE { resultCode ENUMERATED, ... }
+	code, err := ldapRoundTrip(rw, bind, 0x61)
+	if err != nil {
+		return err
+	}
+
+	switch code {
+	case 0:
+		return nil
+	case 49:
+		return errLDAPInvalidCredentials
+	default:
+		return fmt.Errorf("ldap: 绑定失败，结果码 %d", code)
+	}
+}
+
+// ldapRoundTrip 发送一个请求，读取标签为 respTag 的响应并返回其中的结果码
+func ldapRoundTrip(rw io.ReadWriter, op []byte, respTag byte) (int, error) {
+	msg := berTLV(0x30, concat(berTLV(0x02, []byte{1}), op))
+	if _, err := rw.Write(msg); err != nil {
+		return 0, err
+	}
+
+	// 逐字节读取，不读取响应之后的数据，StartTLS 之后的数据留给TLS连接
+	tag, body, err := berRead(byteReader{rw})
+	if err != nil {
+		return 0, err
+	}
+	if tag != 0x30 {
+		return 0, errors.New("ldap: 错误的响应")
+	}
+
+	// messageID 必须和请求的一致
+	br := bytes.NewReader(body)
+	tag, id, err := berRead(br)
+	if err != nil {
+		return 0, err
+	}
+	if tag != 0x02 || !bytes.Equal(id, []byte{1}) {
+		return 0, errors.New("ldap: 响应的 messageID 不匹配")
+	}
+	tag, resp, err := berRead(br)
+	if err != nil {
+		return 0, err
+	}
+	if tag != respTag {
+		return 0, errors.New("ldap: 错误的响应")
+	}
+	// LDAPResult 的第一个元素是 resultCode
+	tag, code, err := berRead(bytes.NewReader(resp))
+	if err != nil {
+		return 0, err
+	}
+	if tag != 0x0a || len(code) == 0 || len(code) > 4 {
+		return 0, errors.New("ldap: 错误的响应")
+	}
+	n := 0
+	for _, b := range code {
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// berTLV 编码 BER 的 tag-length-value
+func berTLV(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	n := len(value)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, value...)
+}
+
+// berReader 读取 BER 元素的来源
+type berReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// byteReader 不带缓冲地逐字节读取
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// berRead 读取一个 BER 元素
+func berRead(r berReader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	l, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := int(l)
+	if l&0x80 != 0 {
+		size := int(l & 0x7f)
+		if size == 0 || size > 3 {
+			return 0, nil, errors.New("ldap: 不支持的长度")
+		}
+		n = 0
+		for i := 0; i < size; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return tag, value, nil
+}
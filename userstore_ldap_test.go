@@ -0,0 +1,241 @@
+package zdpgo_smtp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeLDAP 进程内的LDAP服务，只支持 StartTLS 和简单绑定
+type fakeLDAP struct {
+	users      map[string]string // DN 到密码
+	tlsConfig  *tls.Config       // 为空时不支持 StartTLS
+	requireTLS bool              // 明文连接上的绑定返回 confidentialityRequired
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	isTLS := false
+	for {
+		tag, body, err := berRead(byteReader{conn})
+		if err != nil || tag != 0x30 {
+			return
+		}
+		br := bytes.NewReader(body)
+		if _, _, err := berRead(br); err != nil {
+			return
+		}
+		op, req, err := berRead(br)
+		if err != nil {
+			return
+		}
+
+		switch op {
+		case 0x77: // ExtendedRequest
+			_, oid, _ := berRead(bytes.NewReader(req))
+			if string(oid) != ldapStartTLSOID || f.tlsConfig == nil || isTLS {
+				conn.Write(ldapResponse(0x78, 2))
+				continue
+			}
+			conn.Write(ldapResponse(0x78, 0))
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, isTLS = tlsConn, true
+		case 0x60: // BindRequest
+			r := bytes.NewReader(req)
+			berRead(r) // version
+			_, dn, _ := berRead(r)
+			_, password, _ := berRead(r)
+			code := byte(49)
+			switch {
+			case f.requireTLS && !isTLS:
+				code = 13
+			case len(password) > 0 && f.users[string(dn)] == string(password):
+				code = 0
+			}
+			conn.Write(ldapResponse(0x61, code))
+		default:
+			return
+		}
+	}
+}
+
+// ldapResponse 生成只包含结果码的 LDAPResult 响应
+func ldapResponse(tag, code byte) []byte {
+	result := berTLV(tag, concat(
+		berTLV(0x0a, []byte{code}),
+		berTLV(0x04, nil),
+		berTLV(0x04, nil),
+	))
+	return berTLV(0x30, concat(berTLV(0x02, []byte{1}), result))
+}
+
+// listen 在本机启动 fakeLDAP，返回监听地址
+func (f *fakeLDAP) listen(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// testCertificate 生成 127.0.0.1 的自签名证书
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestLDAPSimpleBind(t *testing.T) {
+	f := &fakeLDAP{users: map[string]string{"uid=zhang,dc=example,dc=com": "secret"}}
+	tests := []struct {
+		dn       string
+		password string
+		wantErr  error
+	}{
+		{"uid=zhang,dc=example,dc=com", "secret", nil},
+		{"uid=zhang,dc=example,dc=com", "wrong", errLDAPInvalidCredentials},
+		{"uid=nobody,dc=example,dc=com", "secret", errLDAPInvalidCredentials},
+	}
+	for _, tc := range tests {
+		client, server := net.Pipe()
+		go f.serve(server)
+		err := LDAPSimpleBind(client, tc.dn, tc.password)
+		client.Close()
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("LDAPSimpleBind(%q, %q) = %v, want %v", tc.dn, tc.password, err, tc.wantErr)
+		}
+	}
+
+	// 其他结果码
+	client, server := net.Pipe()
+	defer client.Close()
+	go (&fakeLDAP{requireTLS: true}).serve(server)
+	if err := LDAPSimpleBind(client, "uid=zhang", "secret"); err == nil || errors.Is(err, errLDAPInvalidCredentials) {
+		t.Errorf("LDAPSimpleBind with result code 13 = %v, want bind failure", err)
+	}
+}
+
+func TestLDAPUserStore(t *testing.T) {
+	cert, pool := testCertificate(t)
+	f := &fakeLDAP{
+		users:      map[string]string{`uid=a\,b,ou=people,dc=example,dc=com`: "secret"},
+		tlsConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+		requireTLS: true,
+	}
+	addr := f.listen(t)
+	store := NewLDAPUserStore(addr, "uid=%s,ou=people,dc=example,dc=com", &tls.Config{RootCAs: pool})
+
+	if err := store.Authenticate("a,b", "secret"); err != nil {
+		t.Errorf("Authenticate over StartTLS = %v, want nil", err)
+	}
+	if err := store.Authenticate("a,b", "wrong"); err != ErrInvalidPassword {
+		t.Errorf("Authenticate with wrong password = %v, want ErrInvalidPassword", err)
+	}
+	if err := store.Authenticate("a,b", ""); err != ErrInvalidPassword {
+		t.Errorf("Authenticate with empty password = %v, want ErrInvalidPassword", err)
+	}
+
+	// 证书不受信任时不能发送密码
+	untrusted := NewLDAPUserStore(addr, "uid=%s,ou=people,dc=example,dc=com", nil)
+	if err := untrusted.Authenticate("a,b", "secret"); err == nil {
+		t.Error("Authenticate with untrusted certificate succeeded")
+	}
+
+	// 服务不支持 StartTLS 时默认失败，Insecure 时明文绑定
+	plain := &fakeLDAP{users: map[string]string{"uid=zhang,ou=people,dc=example,dc=com": "secret"}}
+	plainAddr := plain.listen(t)
+	store = NewLDAPUserStore("ldap://"+plainAddr, "uid=%s,ou=people,dc=example,dc=com", nil)
+	if err := store.Authenticate("zhang", "secret"); err == nil {
+		t.Error("Authenticate without StartTLS succeeded")
+	}
+	store.Binder.(*LDAPConnBinder).Insecure = true
+	if err := store.Authenticate("zhang", "secret"); err != nil {
+		t.Errorf("Authenticate with Insecure = %v, want nil", err)
+	}
+}
+
+func TestLDAPSImplicitTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	f := &fakeLDAP{users: map[string]string{"uid=zhang,dc=example,dc=com": "secret"}}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	b := &LDAPConnBinder{Addr: "ldaps://" + l.Addr().String(), TLSConfig: &tls.Config{RootCAs: pool}}
+	if err := b.Bind("uid=zhang,dc=example,dc=com", "secret"); err != nil {
+		t.Errorf("Bind over ldaps = %v, want nil", err)
+	}
+}
+
+func TestLDAPMessageIDMismatch(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		if _, _, err := berRead(byteReader{server}); err != nil {
+			return
+		}
+		resp := ldapResponse(0x61, 0)
+		resp[4] = 2 // messageID 改成 2
+		server.Write(resp)
+	}()
+	if err := LDAPSimpleBind(client, "uid=zhang,dc=example,dc=com", "secret"); err == nil {
+		t.Error("LDAPSimpleBind accepted a response with a different messageID")
+	}
+}
@@ -0,0 +1,60 @@
+package zdpgo_smtp
+
+import "testing"
+
+func TestCheckPassword(t *testing.T) {
+	bcryptHash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		{bcryptHash, "secret", true},
+		{bcryptHash, "wrong", false},
+		{"$argon2id$v=19$m=16,t=2,p=1$c2FsdHNhbHQ$mWEA7QvE4bY7Bd7rDk7B3w", "secret", false},
+		{"{plain}secret", "secret", true},
+		{"{plain}secret", "wrong", false},
+		{"{plain}", "", true},
+		// 兼容没有前缀的明文，以 $ 开头的未知哈希总是失败
+		{"secret", "secret", true},
+		{"secret", "wrong", false},
+		{"{PLAIN}secret", "{PLAIN}secret", true},
+		{"$1$salt$hash", "secret", false},
+		{"$1$salt$hash", "$1$salt$hash", false},
+		{"", "", false},
+	}
+	for _, tc := range tests {
+		if got := CheckPassword(tc.hash, tc.password); got != tc.want {
+			t.Errorf("CheckPassword(%q, %q) = %v, want %v", tc.hash, tc.password, got, tc.want)
+		}
+	}
+}
+
+func TestMemoryUserStoreFormats(t *testing.T) {
+	for _, password := range []string{"", "$1$salt$hash"} {
+		if _, err := NewMemoryUserStore(map[string]Auth{"a": {Username: "a", Password: password}}); err == nil {
+			t.Errorf("NewMemoryUserStore accepted password %q", password)
+		}
+	}
+	store, err := NewMemoryUserStore(map[string]Auth{
+		"a": {Username: "a", Password: "{plain}secret"},
+		"b": {Username: "b", Password: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := store.Authenticate(name, "secret"); err != nil {
+			t.Errorf("Authenticate(%q) = %v, want nil", name, err)
+		}
+	}
+	if err := store.Authenticate("a", "{plain}secret"); err != ErrInvalidPassword {
+		t.Errorf("Authenticate with stored value = %v, want ErrInvalidPassword", err)
+	}
+	if got := store.LegacyPlainUsers(); len(got) != 1 || got[0] != "b" {
+		t.Errorf("LegacyPlainUsers = %v, want [b]", got)
+	}
+}